@@ -6,17 +6,20 @@ import (
 	"log"
 	"os"
 	"os/signal"
-	"sync"
+	"path/filepath"
 	"syscall"
 
 	"github.com/26000/irchuu/config"
 	irchuubase "github.com/26000/irchuu/db"
+	"github.com/26000/irchuu/discord"
 	"github.com/26000/irchuu/hq"
 	irchuu "github.com/26000/irchuu/irc"
+	"github.com/26000/irchuu/matrix"
 	"github.com/26000/irchuu/paths"
 	"github.com/26000/irchuu/relay"
 	mediaserver "github.com/26000/irchuu/server"
 	"github.com/26000/irchuu/telegram"
+	"github.com/26000/irchuu/xmpp"
 )
 
 func main() {
@@ -41,35 +44,61 @@ func main() {
 		log.Fatalf("Unable to parse the config: %v\n", err)
 	}
 
-	r := relay.NewRelay()
+	r := relay.NewRouter(irchuuConf.Bridges)
 
 	if irchuuConf.DBURI != "" {
 		irchuubase.Init(irchuuConf.DBURI)
 	}
+	if irchuuConf.DBURI != "" && irchuubase.IsAvailable() {
+		r.SetQueue(irchuubase.Queue{})
+	} else {
+		q, err := relay.NewFileQueue(filepath.Join(dataDir, "queue"))
+		if err != nil {
+			log.Fatalf("Unable to open the message queue: %v\n", err)
+		}
+		r.SetQueue(q)
+	}
 
 	tg.DataDir = dataDir
 
-	if tg.Storage == "server" {
+	if tg.Stores("server") || tg.Webhook {
 		go mediaserver.Serve(tg)
 	}
 
-	hq.Report(irchuuConf, tg, irc)
+	hq.Report(irchuuConf)
 
 	sigCh := make(chan os.Signal, 2)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	go sigNotify(sigCh, r)
 
-	var wg sync.WaitGroup
-	wg.Add(2)
-	go irchuu.Launch(irc, &wg, r)
-	go telegram.Launch(tg, &wg, r)
-	wg.Wait()
+	r.Add(irchuu.NewTransport(irc))
+	r.Add(telegram.NewTransport(tg))
+	if irchuuConf.Matrix.HomeServer != "" {
+		r.Add(matrix.NewTransport(irchuuConf.Matrix))
+	}
+	if irchuuConf.Discord.Token != "" {
+		r.Add(discord.NewTransport(irchuuConf.Discord))
+	}
+	if irchuuConf.XMPP.JID != "" {
+		r.Add(xmpp.NewTransport(irchuuConf.XMPP))
+	}
+	if err := r.Start(); err != nil {
+		log.Fatalf("All transports failed: %v\n", err)
+	}
 }
 
-func sigNotify(sigCh chan os.Signal, r *relay.Relay) {
+func sigNotify(sigCh chan os.Signal, r *relay.Router) {
 	sig := <-sigCh
 	log.Printf("Caught signal: %v, exiting... (press Ctrl + C again to force)\n", sig)
-	r.TeleAlwaysCh <- relay.ServiceMessage{"shutdown", []string{}}
+	go func() {
+		if err := r.Stop(); err != nil {
+			log.Printf("Failed to stop: %v\n", err)
+		}
+		if irchuubase.IsAvailable() {
+			irchuubase.Close()
+		}
+		os.Exit(0)
+	}()
 
 	sig = <-sigCh
 	os.Exit(1)
@@ -1,9 +1,12 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"html"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	"gopkg.in/ini.v1"
 )
@@ -38,6 +41,19 @@ func ReadConfig(path string) (error, *Irc, *Telegram, *Irchuu) {
 		return err, irc, tg, irchuu
 	}
 
+	if tg.UploadLimit == 0 {
+		tg.UploadLimit = 20
+	}
+	if tg.UploadTimeout == 0 {
+		tg.UploadTimeout = 120
+	}
+	// signed links must expire before the files they point to are removed
+	if tg.Stores("server") && tg.ServerSecret != "" && tg.MediaTTL != 0 &&
+		(tg.ServerLinkTTL == 0 || tg.ServerLinkTTL > tg.MediaTTL) {
+		return errors.New("serverlinkttl must be set and not longer than mediattl"),
+			irc, tg, irchuu
+	}
+
 	tg.Prefix = html.EscapeString(tg.Prefix)
 	tg.Postfix = html.EscapeString(tg.Postfix)
 
@@ -49,10 +65,146 @@ func ReadConfig(path string) (error, *Irc, *Telegram, *Irchuu) {
 	if irc.StatusTimeout == 0 {
 		irc.StatusTimeout = 2
 	}
+	if !cfg.Section("irc").HasKey("puppetsuffix") {
+		irc.PuppetSuffix = "[tg]"
+	}
+	if irc.PuppetIdle == 0 {
+		irc.PuppetIdle = 60
+	}
+
+	irchuu.Matrix = new(Matrix)
+	err = cfg.Section("matrix").MapTo(irchuu.Matrix)
+	if err != nil {
+		return err, irc, tg, irchuu
+	}
+	if irchuu.Matrix.SyncTimeout == 0 {
+		irchuu.Matrix.SyncTimeout = 30
+	}
+	irchuu.Matrix.Storage = tg
+
+	irchuu.Discord = new(Discord)
+	err = cfg.Section("discord").MapTo(irchuu.Discord)
+	if err != nil {
+		return err, irc, tg, irchuu
+	}
+	if len(irchuu.Discord.Palette) == 0 {
+		irchuu.Discord.Palette = irc.Palette
+	}
+
+	irchuu.XMPP = new(XMPP)
+	err = cfg.Section("xmpp").MapTo(irchuu.XMPP)
+	if err != nil {
+		return err, irc, tg, irchuu
+	}
+	if irchuu.XMPP.Nick == "" {
+		irchuu.XMPP.Nick = "IRChuu"
+	}
+	if !cfg.Section("xmpp").HasKey("relayjoinsparts") {
+		irchuu.XMPP.RelayJoinsParts = true
+	}
+	if !cfg.Section("xmpp").HasKey("digestwindow") {
+		irchuu.XMPP.DigestWindow = 10
+	}
+
+	irchuu.Bridges, err = readBridges(cfg, irc, tg)
+	if err != nil {
+		return err, irc, tg, irchuu
+	}
 
 	return nil, irc, tg, irchuu
 }
 
+// StorageChain returns the names of the storage backends which are tried one
+// after another, or nil if media is not stored.
+func (c *Telegram) StorageChain() []string {
+	var chain []string
+	for _, name := range strings.Split(c.Storage, ",") {
+		if name = strings.TrimSpace(name); name != "" && name != "none" {
+			chain = append(chain, name)
+		}
+	}
+	return chain
+}
+
+// Stores returns true if the backend is in the storage chain.
+func (c *Telegram) Stores(backend string) bool {
+	for _, name := range c.StorageChain() {
+		if name == backend {
+			return true
+		}
+	}
+	return false
+}
+
+// readBridges reads all [bridge.<name>] sections. Settings which are not
+// specified in a bridge section are inherited from [irc] and [telegram]. If
+// there are no bridge sections, a single bridge named "default" is made of
+// the channel and the group from [irc] and [telegram].
+func readBridges(cfg *ini.File, irc *Irc, tg *Telegram) ([]*Bridge, error) {
+	var bridges []*Bridge
+	channels := make(map[string]string)
+	groups := make(map[int64]string)
+	for _, section := range cfg.Sections() {
+		if !strings.HasPrefix(section.Name(), "bridge.") {
+			continue
+		}
+		b := newBridge(strings.TrimPrefix(section.Name(), "bridge."), irc, tg)
+		err := section.MapTo(b)
+		if err != nil {
+			return bridges, err
+		}
+		if section.HasKey("tgprefix") {
+			b.TGPrefix = html.EscapeString(b.TGPrefix)
+		}
+		if section.HasKey("tgpostfix") {
+			b.TGPostfix = html.EscapeString(b.TGPostfix)
+		}
+		// messages are routed by channel and group, so they can't be shared
+		channel := strings.ToLower(b.Channel)
+		if other, ok := channels[channel]; ok && channel != "" {
+			return bridges, fmt.Errorf("bridges %v and %v share IRC channel %v",
+				other, b.Name, b.Channel)
+		}
+		channels[channel] = b.Name
+		if other, ok := groups[b.Group]; ok && b.Group != 0 {
+			return bridges, fmt.Errorf("bridges %v and %v share Telegram group %v",
+				other, b.Name, b.Group)
+		}
+		groups[b.Group] = b.Name
+		bridges = append(bridges, b)
+	}
+
+	if len(bridges) == 0 {
+		b := newBridge("default", irc, tg)
+		b.MatrixRoom = cfg.Section("matrix").Key("room").String()
+		b.DiscordChannel = cfg.Section("discord").Key("channel").String()
+		b.DiscordWebhook = cfg.Section("discord").Key("webhook").String()
+		b.XMPPRoom = cfg.Section("xmpp").Key("room").String()
+		bridges = append(bridges, b)
+	}
+	return bridges, nil
+}
+
+// newBridge creates a bridge with settings inherited from [irc] and [telegram].
+func newBridge(name string, irc *Irc, tg *Telegram) *Bridge {
+	return &Bridge{
+		Name:         name,
+		Channel:      irc.Channel,
+		ChanPassword: irc.ChanPassword,
+		Group:        tg.Group,
+
+		IRCPrefix:  irc.Prefix,
+		IRCPostfix: irc.Postfix,
+		TGPrefix:   tg.Prefix,
+		TGPostfix:  tg.Postfix,
+
+		IRCModeration:  irc.Moderation,
+		TGModeration:   tg.Moderation,
+		KickPermission: irc.KickPermission,
+		AllowInvites:   tg.AllowInvites,
+	}
+}
+
 // PopulateConfig copies the sample config to <path>.
 func PopulateConfig(file string) error {
 	config := `# IRChuu configuration file. See https://github.com/26000/irchuu for help.
@@ -98,18 +250,37 @@ allowinvites = false
 # (bot needs to have permissions for that in IRC)
 moderation = true
 
+# what to do with IRC colours: 'strip' them, hide text coloured the same as
+# its background under a 'spoiler', or also mark coloured text with an 'emoji'
+# of its colour
+colors = spoiler
+
 # download all media files to $XDG_DATA_HOME/irchuu or 
 downloadmedia = false
 
-# 'none', 'server' or 'pomf', where to store mediafiles from Telegram to show
-# them in IRC
+# limits for downloaded media files, 0 for none: when they take more space,
+# the least recently used ones are removed, and files older than the TTL are
+# removed anyway
+# files with the same content are stored once
+mediaquota = 0 # (MiB)
+mediattl = 0 # (days)
+
+# 'none', 'server', 'pomf' or 'komf', where to store mediafiles from Telegram
+# to show them in IRC
+#
+# several comma-separated storages are tried one after another, e. g.
+# 'pomf, server' serves the file itself if the pomf is down
 #
 # 'server' will serve files over HTTP(S), needs 'serverport', 'baseurl',
-# 'readtimeout' and 'writetimeout' to be set, 'downloadmedia' must be true
+# 'readtimeout' and 'writetimeout' to be set
 #
 # 'pomf' will upload all media files to a pomf clone, needs 'pomf' to be set
 #
 # 'komf' will upload all media files to a komf (https://github.com/koto-bank/komf), needs 'komf' to be set
+#
+# 's3' will upload all media files to an S3-compatible bucket (AWS, MinIO,
+# Garage, etc.), needs 's3endpoint', 's3bucket', 's3accesskey' and
+# 's3secretkey' to be set
 storage = none
 
 ## SERVER
@@ -124,14 +295,62 @@ writetimeout = 20 # (seconds)
 # port for the media file server
 serverport = 8080
 
+# if set, links to media files are signed with it, so they cannot be made up
+# or changed, and expire after 'serverlinkttl', which must not be longer than
+# 'mediattl'
+serversecret =
+serverlinkttl = 0 # (days, 0 for never)
+
 # usually your protocol plus IP or domain plus the port, WITHOUT THE TRAILING SLASH
 # don't forget to change http to https if enabled
 baseurl = http://localhost:8080
 
+## WEBHOOK
+# receive updates from Telegram on the server above instead of polling
+# Telegram only sends webhooks over HTTPS to ports 443, 80, 88 and 8443, so
+# set certfilepath and keyfilepath or put the server behind a proxy
+webhook = false
+
+# the public URL of the server for Telegram, WITHOUT THE TRAILING SLASH
+# blank to use baseurl
+webhookurl =
+
+# Telegram sends it with every update to prove the update is genuine
+# blank to generate a new one on every start
+webhooksecret =
+
+## UPLOADS
+# the largest file uploaded to pomf or komf
+uploadlimit = 20 # (MiB)
+
+# how long an upload may take
+uploadtimeout = 120 # (seconds)
+
 ## POMF
 # the pomf clone url
 pomf =
 
+## S3
+# the endpoint of the storage, WITHOUT THE TRAILING SLASH and the bucket
+s3endpoint = https://s3.amazonaws.com
+s3region = us-east-1
+s3bucket =
+s3accesskey =
+s3secretkey =
+
+# prepended to the names of objects, e. g. 'irchuu/'
+s3prefix =
+
+# where the bucket is publicly readable, WITHOUT THE TRAILING SLASH
+# blank to link presigned URLs instead, which work for up to 7 days
+s3publicurl =
+
+# delete the objects after this long, 0 to keep them forever
+# IRChuu adds a lifecycle rule for objects under s3prefix (the whole bucket if
+# it is blank) to the bucket, so the key needs the permission to read and
+# change its lifecycle configuration; other rules of the bucket are kept
+s3expiry = 7 # (days)
+
 ## KOMF
 # a komf site url, you can set up your own: https://github.com/koto-bank/komf
 komf =
@@ -202,6 +421,18 @@ sendnotices = true
 # forward join and part messages to Telegram
 relayjoinsparts = true
 
+# collect joins, parts and quits for this long and relay a summary instead
+# of every one of them, so netsplits do not flood the group
+# 0 to relay them immediately
+digestwindow = 10 # (seconds)
+
+# with relayjoinsparts on, relay joins, parts, quits and nick changes only of
+# users who spoke in the last <activewindow> minutes, so Telegram knows when a
+# regular leaves in the middle of a conversation without the noise from
+# everyone else
+# 0 to relay them for every user
+activewindow = 0 # (minutes)
+
 # forward mode messages to Telegram
 relaymodes = true
 
@@ -211,6 +442,17 @@ kickrejoin = true
 # announce the current topic to Telegram on join
 announcetopic = true
 
+# connect every Telegram user who writes to the group as a separate IRC user,
+# so they can be highlighted, queried and kicked like everyone else
+# (the server must allow that many connections from the host of the bot)
+puppets = false
+
+# added to the nicks of puppets
+puppetsuffix = [tg]
+
+# puppets which have not sent anything for this long quit
+puppetidle = 60 # (minutes)
+
 # list of nicknames to ignore, i. e. messages by these users won't be relayed
 ignorelist = ignoredbotnickname1,ignoredbotnickname2
 
@@ -218,6 +460,113 @@ ignorelist = ignoredbotnickname1,ignoredbotnickname2
 # (needed for /status command in Telegram; increase if it says you're not in
 # channel when you are)
 statustimeout = 2
+
+# Bridges. By default, IRChuu relays between the channel from [irc] and the
+# group from [telegram]. To serve several channel-group pairs with one IRC
+# connection and one Telegram bot, add a [bridge.<name>] section for each
+# pair. The settings below are optional and default to the ones from [irc]
+# and [telegram].
+#
+# [bridge.irchuu]
+# channel = ` + "`" + `#irchuu` + "`" + `
+# chanpassword =
+# group = 7654321
+#
+# # nick prefix and postfix in IRC and Telegram
+# ircprefix = <
+# ircpostfix = >
+# tgprefix = <
+# tgpostfix = >
+#
+# # allow ops in IRC to kick users from Telegram and vice versa
+# ircmoderation = true
+# tgmoderation = true
+# kickpermission = 4
+#
+# allowinvites = false
+#
+# # Matrix room ID or alias (needs [matrix] to be configured)
+# matrixroom = !roomid:matrix.org
+#
+# # Discord channel ID and the URL of its webhook (needs [discord] to be
+# # configured)
+# discordchannel = 123456789012345678
+# discordwebhook = https://discord.com/api/webhooks/123/token
+#
+# # XMPP multi-user chat (needs [xmpp] to be configured)
+# xmpproom = irchuu@conference.example.org
+
+[matrix]
+# Matrix homeserver URL and the access token of the bridge account,
+# leave blank to disable Matrix
+homeserver =
+accesstoken =
+
+# room ID or alias (#room:example.org) to relay to, used when there are
+# no [bridge.<name>] sections
+room =
+
+# prefix and postfix will be added before and after nicks
+prefix = <
+postfix = >
+
+# long-polling timeout for receiving new events
+synctimeout = 30 # (seconds)
+
+# media files need the access token to be downloaded from the homeserver, so
+# they are re-hosted with the 'storage' set in [telegram]; without it, links
+# to the homeserver are relayed, which only work if it serves media without
+# authentication
+
+[discord]
+# Discord bot token, leave blank to disable Discord
+# (the bot needs the Message Content intent)
+token =
+
+# channel ID and the URL of a webhook of this channel, used when there are
+# no [bridge.<name>] sections; messages are posted through the webhook with
+# the names of their senders
+channel =
+webhook =
+
+# colours of embeds (for joins, parts and media) are picked from this palette
+# of IRC colours the same way nicks are colorized in IRC, defaults to the
+# palette from [irc]
+palette =
+
+[xmpp]
+# Jabber ID and password of the bridge account, leave blank to disable XMPP
+jid =
+password =
+
+# host:port of the server, if blank it is looked up in DNS (SRV records)
+server =
+# connect with TLS right away instead of STARTTLS (usually on port 5223)
+directtls = false
+# allow logging in over an unencrypted connection (only for local servers!)
+allowplain = false
+
+# nick in multi-user chats
+nick = IRChuu
+
+# multi-user chat to relay to, used when there are no [bridge.<name>] sections
+room =
+
+# prefix and postfix will be added before and after nicks
+prefix = <
+postfix = >
+
+# forward joins, parts and nick changes of occupants to other networks
+relayjoinsparts = true
+
+# collect joins and parts for this long and relay a summary instead of every
+# one of them, 0 to relay them immediately
+digestwindow = 10 # (seconds)
+
+# with relayjoinsparts on, relay joins, parts and nick changes only of
+# occupants who spoke in the last <activewindow> minutes
+# 0 to relay them for every occupant
+activewindow = 0 # (minutes)
 `
 	return ioutil.WriteFile(file, []byte(config), os.FileMode(0600))
 }
@@ -227,6 +576,80 @@ type Irchuu struct {
 	DBURI        string
 	SendStats    bool
 	CheckUpdates bool
+
+	Bridges []*Bridge `ini:"-"`
+	Matrix  *Matrix   `ini:"-"`
+	Discord *Discord  `ini:"-"`
+	XMPP    *XMPP     `ini:"-"`
+}
+
+// Bridge is the struct of a [bridge.<name>] section in config. It pairs an
+// IRC channel with a Telegram group.
+type Bridge struct {
+	Name string `ini:"-"`
+
+	Channel      string
+	ChanPassword string
+	Group        int64
+
+	IRCPrefix  string
+	IRCPostfix string
+	TGPrefix   string
+	TGPostfix  string
+
+	IRCModeration  bool
+	TGModeration   bool
+	KickPermission int
+	AllowInvites   bool
+
+	MatrixRoom string
+
+	DiscordChannel string
+	DiscordWebhook string
+
+	XMPPRoom string
+}
+
+// Matrix is the struct of Matrix part in config.
+type Matrix struct {
+	HomeServer  string
+	AccessToken string
+	Room        string
+
+	Prefix  string
+	Postfix string
+
+	SyncTimeout int
+
+	Storage *Telegram `ini:"-"` // where media files are re-hosted, from [telegram]
+}
+
+// Discord is the struct of Discord part in config.
+type Discord struct {
+	Token   string
+	Channel string
+	Webhook string
+
+	Palette []string
+}
+
+// XMPP is the struct of XMPP part in config.
+type XMPP struct {
+	JID        string
+	Password   string
+	Server     string
+	DirectTLS  bool
+	AllowPlain bool
+
+	Nick string
+	Room string
+
+	Prefix  string
+	Postfix string
+
+	RelayJoinsParts bool
+	DigestWindow    int
+	ActiveWindow    int
 }
 
 // Irc is the stuct of IRC part in config.
@@ -259,10 +682,16 @@ type Irc struct {
 	NamesUpdateInterval int
 	SendNotices         bool
 	RelayJoinsParts     bool
+	DigestWindow        int
+	ActiveWindow        int
 	RelayModes          bool
 	KickRejoin          bool
 	AnnounceTopic       bool
 
+	Puppets      bool
+	PuppetSuffix string
+	PuppetIdle   int
+
 	IgnoreList []string
 	IgnoreMap  map[string]bool
 
@@ -284,12 +713,17 @@ type Telegram struct {
 	AllowBots    bool
 	AllowInvites bool
 	Moderation   bool
+	Colors       string
 
 	DownloadMedia bool
+	MediaQuota    int
+	MediaTTL      int
 	Storage       string
 	CertFilePath  string
 	KeyFilePath   string
 	ServerPort    uint16
+	ServerSecret  string
+	ServerLinkTTL int
 	ReadTimeout   int
 	WriteTimeout  int
 	BaseURL       string
@@ -297,6 +731,21 @@ type Telegram struct {
 	Pomf          string
 	Komf          string
 	KomfDate      string
+	UploadLimit   int
+	UploadTimeout int
+
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3AccessKey string
+	S3SecretKey string
+	S3Prefix    string
+	S3PublicURL string
+	S3Expiry    int
+
+	Webhook       bool
+	WebhookURL    string
+	WebhookSecret string
 }
 
 // muDeiPt5mAI8Ue==
@@ -32,13 +32,12 @@ func Log(msg relay.Message, logger *log.Logger) {
 			"refusing to log: %v/%v: '%v'\n", msg.FromID, msg.Nick, msg.Text)
 		return
 	}
-	if msg.Source {
-		// Telegram
+	if msg.Origin == "telegram" {
 		rows1, err := db.Query("INSERT INTO"+
-			" messages(date, source, \"text\", from_id, msg_id, extra)"+
-			" VALUES($1, $2, $3, $4, $5, $6);",
+			" messages(date, source, \"text\", from_id, msg_id, extra, bridge, origin)"+
+			" VALUES($1, $2, $3, $4, $5, $6, $7, $8);",
 			msg.Date, 1, msg.Text, msg.FromID, msg.ID,
-			extraString)
+			extraString, msg.Bridge, msg.Origin)
 		defer rows1.Close()
 		handleErrors(err, logger)
 
@@ -51,12 +50,12 @@ func Log(msg relay.Message, logger *log.Logger) {
 		defer rows2.Close()
 		handleErrors(err, logger)
 	} else {
-		// IRC
+		// IRC and other transports without Telegram users
 		rows, err := db.Query("INSERT INTO"+
-			" messages(date, source, nick, \"text\", extra)"+
-			" VALUES($1, $2, $3, $4, $5);",
+			" messages(date, source, nick, \"text\", extra, bridge, origin)"+
+			" VALUES($1, $2, $3, $4, $5, $6, $7);",
 			msg.Date, 0, msg.Nick, msg.Text,
-			extraString)
+			extraString, msg.Bridge, msg.Origin)
 		defer rows.Close()
 		handleErrors(err, logger)
 	}
@@ -87,18 +86,71 @@ func Init(dbURI string) {
 		return
 	}
 	defer rows2.Close()
+	// messages logged before bridges and transports were introduced have
+	// no bridge and origin
+	rows3, err := db.Query("ALTER TABLE messages" +
+		" ADD COLUMN IF NOT EXISTS bridge TEXT," +
+		" ADD COLUMN IF NOT EXISTS origin TEXT;")
+	if !handleErrors(err, logger) {
+		return
+	}
+	defer rows3.Close()
+	rows4, err := db.Query("CREATE TABLE IF NOT EXISTS queue" +
+		" (id BIGSERIAL PRIMARY KEY, transport TEXT NOT NULL," +
+		" message JSONB NOT NULL);")
+	if !handleErrors(err, logger) {
+		return
+	}
+	defer rows4.Close()
+	// private messages from IRC users delivered to Telegram users, so their
+	// replies find the way back
+	rows5, err := db.Query("CREATE TABLE IF NOT EXISTS private_messages" +
+		" (tg_user_id INT NOT NULL, msg_id INT NOT NULL," +
+		" irc_nick TEXT NOT NULL, bridge TEXT NOT NULL," +
+		" date TIMESTAMP WITH TIME ZONE NOT NULL," +
+		" PRIMARY KEY (tg_user_id, msg_id));")
+	if !handleErrors(err, logger) {
+		return
+	}
+	defer rows5.Close()
+	// Telegram users linked to their IRC accounts and the one-time codes
+	// which link them
+	rows6, err := db.Query("CREATE TABLE IF NOT EXISTS link_codes" +
+		" (code TEXT PRIMARY KEY, tg_user_id INT NOT NULL," +
+		" expires TIMESTAMP WITH TIME ZONE NOT NULL);")
+	if !handleErrors(err, logger) {
+		return
+	}
+	defer rows6.Close()
+	rows7, err := db.Query("CREATE TABLE IF NOT EXISTS linked_users" +
+		" (tg_user_id INT PRIMARY KEY, irc_account TEXT NOT NULL," +
+		" irc_nick TEXT NOT NULL, date TIMESTAMP WITH TIME ZONE NOT NULL);")
+	if !handleErrors(err, logger) {
+		return
+	}
+	defer rows7.Close()
+	// account names are case-insensitive in IRC
+	rows8, err := db.Query("CREATE UNIQUE INDEX IF NOT EXISTS" +
+		" linked_users_irc_account ON linked_users (lower(irc_account));")
+	if !handleErrors(err, logger) {
+		return
+	}
+	defer rows8.Close()
 	logger.Println("Successfully initialized")
 	return
 }
 
-// GetMessages gets n last messages and returns them in a slice of relay.Message.
-func GetMessages(n int) ([]relay.Message, error) {
+// GetMessages gets n last messages of a bridge and returns them in a slice of
+// relay.Message. Messages logged without a bridge are returned for every bridge.
+func GetMessages(bridge string, n int) ([]relay.Message, error) {
 	msgs := make([]relay.Message, 0, n)
-	rows, err := db.Query(`SELECT date, source, coalesce(messages.nick,
+	rows, err := db.Query(`SELECT date, coalesce(origin,
+CASE WHEN source THEN 'telegram' ELSE 'irc' END), coalesce(messages.nick,
 tg_users.nick, ''), text, coalesce(msg_id, 0), coalesce(from_id, 0),
 coalesce(first_name, ' '), coalesce(last_name, ' '), extra FROM messages
 LEFT JOIN tg_users
-ON tg_users.id = messages.from_id ORDER BY date DESC LIMIT $1;`, n)
+ON tg_users.id = messages.from_id WHERE coalesce(bridge, $2) = $2
+ORDER BY date DESC LIMIT $1;`, n, bridge)
 	defer rows.Close()
 
 	if err != nil {
@@ -107,7 +159,7 @@ ON tg_users.id = messages.from_id ORDER BY date DESC LIMIT $1;`, n)
 	for rows.Next() {
 		var (
 			date      time.Time
-			source    bool
+			origin    string
 			nick      string
 			text      string
 			ID        int
@@ -117,7 +169,7 @@ ON tg_users.id = messages.from_id ORDER BY date DESC LIMIT $1;`, n)
 			extras    []byte
 			extra     map[string]string
 		)
-		err = rows.Scan(&date, &source, &nick, &text, &ID, &fromID, &firstName,
+		err = rows.Scan(&date, &origin, &nick, &text, &ID, &fromID, &firstName,
 			&lastName, &extras)
 		if err != nil {
 			log.Println(err)
@@ -126,12 +178,67 @@ ON tg_users.id = messages.from_id ORDER BY date DESC LIMIT $1;`, n)
 		if err != nil {
 			log.Println(err)
 		}
-		msgs = append(msgs, relay.Message{date, source, nick, text, ID,
-			fromID, firstName, lastName, extra})
+		msgs = append(msgs, relay.Message{
+			Date:   date,
+			Origin: origin,
+			Bridge: bridge,
+			Nick:   nick,
+			Text:   text,
+
+			ID:        ID,
+			FromID:    fromID,
+			FirstName: firstName,
+			LastName:  lastName,
+			Extra:     extra,
+		})
 	}
 	return msgs, nil
 }
 
+// Queue is a relay.Queue which keeps messages in the database, so they
+// survive restarts.
+type Queue struct{}
+
+// Push appends a message to the queue of a transport.
+func (Queue) Push(transport string, message relay.Message) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO queue(transport, message) VALUES($1, $2);",
+		transport, data)
+	return err
+}
+
+// Peek returns the oldest message in the queue of a transport.
+func (Queue) Peek(transport string) (int64, relay.Message, bool, error) {
+	var (
+		id      int64
+		data    []byte
+		message relay.Message
+	)
+	err := db.QueryRow("SELECT id, message FROM queue WHERE transport = $1"+
+		" ORDER BY id LIMIT 1;", transport).Scan(&id, &data)
+	if err == sql.ErrNoRows {
+		return 0, message, false, nil
+	} else if err != nil {
+		return 0, message, false, err
+	}
+	if err = json.Unmarshal(data, &message); err != nil {
+		// a broken message would block the queue forever
+		db.Exec("DELETE FROM queue WHERE id = $1;", id)
+		return 0, message, false, err
+	}
+	return id, message, true, nil
+}
+
+// Remove removes a message from the queue.
+func (Queue) Remove(transport string, id int64) error {
+	_, err := db.Exec("DELETE FROM queue WHERE id = $1 AND transport = $2;",
+		id, transport)
+	return err
+}
+
 // handleErrors logs the error and returns false if it is not nil. Otherwise
 // returns true.
 func handleErrors(err error, logger *log.Logger) bool {
@@ -142,11 +249,101 @@ func handleErrors(err error, logger *log.Logger) bool {
 	return true
 }
 
+// FindUser returns the ID and the name of the Telegram user linked to the IRC
+// account or nick, or else of the one with exactly this username or full
+// name, ignoring case. It returns sql.ErrNoRows if there is no such user.
 func FindUser(name string) (id int, foundName string, err error) {
+	err = db.QueryRow("SELECT linked_users.tg_user_id, coalesce(tg_users.nick,"+
+		" tg_users.first_name || ' ' || tg_users.last_name, irc_nick)"+
+		" FROM linked_users LEFT JOIN tg_users"+
+		" ON tg_users.id = linked_users.tg_user_id"+
+		" WHERE lower(irc_account) = lower($1) OR lower(irc_nick) = lower($1)"+
+		" ORDER BY lower(irc_account) = lower($1) DESC LIMIT 1",
+		name).Scan(&id, &foundName)
+	if err != sql.ErrNoRows {
+		return
+	}
 	err = db.QueryRow("SELECT id, coalesce(nick, first_name || ' ' || last_name)"+
-		"  FROM tg_users WHERE nick LIKE $1 || '%'"+
-		" OR first_name || ' ' || last_name LIKE $1 || '%' "+
-		" ORDER BY last_active DESC LIMIT 1", name).Scan(&id, &foundName)
+		" FROM tg_users WHERE lower(nick) = lower($1)"+
+		" OR lower(first_name || ' ' || last_name) = lower($1)"+
+		" ORDER BY lower(nick) = lower($1) DESC, last_active DESC LIMIT 1",
+		name).Scan(&id, &foundName)
+	return
+}
+
+// NewLinkCode remembers the one-time code which links the Telegram user to
+// the IRC account of whoever sends it from IRC before it expires.
+func NewLinkCode(tgUserID int, code string, ttl time.Duration) error {
+	_, err := db.Exec("DELETE FROM link_codes WHERE tg_user_id = $1"+
+		" OR expires < $2;", tgUserID, time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO link_codes(code, tg_user_id, expires)"+
+		" VALUES($1, $2, $3);", code, tgUserID, time.Now().Add(ttl))
+	return err
+}
+
+// Link uses up the code and links the Telegram user who got it to the IRC
+// account. It returns sql.ErrNoRows if the code is wrong or expired.
+func Link(code, account, nick string) (tgUserID int, err error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow("DELETE FROM link_codes WHERE code = $1 AND expires > $2"+
+		" RETURNING tg_user_id;", code, time.Now()).Scan(&tgUserID)
+	if err != nil {
+		return 0, err
+	}
+	// an IRC account is linked to one Telegram user only
+	_, err = tx.Exec("DELETE FROM linked_users WHERE lower(irc_account) = lower($1)"+
+		" OR tg_user_id = $2;", account, tgUserID)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec("INSERT INTO"+
+		" linked_users(tg_user_id, irc_account, irc_nick, date)"+
+		" VALUES($1, $2, $3, $4);", tgUserID, account, nick, time.Now())
+	if err != nil {
+		return 0, err
+	}
+	return tgUserID, tx.Commit()
+}
+
+// LinkedNick returns the IRC nick of the Telegram user who linked their
+// account. It returns sql.ErrNoRows if they did not.
+func LinkedNick(tgUserID int) (nick string, err error) {
+	err = db.QueryRow("SELECT irc_nick FROM linked_users WHERE tg_user_id = $1;",
+		tgUserID).Scan(&nick)
+	return
+}
+
+// Unlink forgets the IRC account of the Telegram user.
+func Unlink(tgUserID int) error {
+	_, err := db.Exec("DELETE FROM linked_users WHERE tg_user_id = $1;",
+		tgUserID)
+	return err
+}
+
+// SavePrivate remembers that the private message with the ID was sent to the
+// Telegram user on behalf of the IRC nick.
+func SavePrivate(tgUserID, msgID int, ircNick, bridge string) error {
+	_, err := db.Exec("INSERT INTO"+
+		" private_messages(tg_user_id, msg_id, irc_nick, bridge, date)"+
+		" VALUES($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING;",
+		tgUserID, msgID, ircNick, bridge, time.Now())
+	return err
+}
+
+// FindPrivate returns the IRC nick and the bridge of the private message sent
+// to the Telegram user. With zero msgID it returns the latest one. It returns
+// sql.ErrNoRows if there are none.
+func FindPrivate(tgUserID, msgID int) (ircNick, bridge string, err error) {
+	err = db.QueryRow("SELECT irc_nick, bridge FROM private_messages"+
+		" WHERE tg_user_id = $1 AND ($2 = 0 OR msg_id = $2)"+
+		" ORDER BY date DESC LIMIT 1", tgUserID, msgID).Scan(&ircNick, &bridge)
 	return
 }
 
@@ -0,0 +1,239 @@
+package discord
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// apiURL is the base URL of the REST API.
+	apiURL = "https://discord.com/api/v10"
+	// gatewayURL is the URL of the gateway.
+	gatewayURL = "wss://gateway.discord.gg/?v=10&encoding=json"
+)
+
+// Gateway opcodes.
+const (
+	opDispatch       = 0
+	opHeartbeat      = 1
+	opIdentify       = 2
+	opReconnect      = 7
+	opInvalidSession = 9
+	opHello          = 10
+	opHeartbeatACK   = 11
+)
+
+// intents are GUILD_MESSAGES and MESSAGE_CONTENT.
+const intents = 1<<9 | 1<<15
+
+// client is a minimal Discord API client.
+type client struct {
+	api     string
+	gateway string
+	token   string
+	http    *http.Client
+}
+
+// apiError is an error returned by the API.
+type apiError struct {
+	Status  int
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%v (%v): %v", e.Status, e.Code, e.Message)
+}
+
+// payload is a gateway payload.
+type payload struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d"`
+	S  *int64          `json:"s"`
+	T  string          `json:"t"`
+}
+
+// user is a Discord user.
+type user struct {
+	ID         string `json:"id"`
+	Username   string `json:"username"`
+	GlobalName string `json:"global_name"`
+	Bot        bool   `json:"bot"`
+}
+
+// member is a guild member.
+type member struct {
+	Nick string `json:"nick"`
+}
+
+// mention is a user mentioned in a message.
+type mention struct {
+	user
+	Member *member `json:"member"`
+}
+
+// attachment is a file attached to a message.
+type attachment struct {
+	ID          string `json:"id"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+	URL         string `json:"url"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+}
+
+// stickerItem is a sticker sent in a message.
+type stickerItem struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	FormatType int    `json:"format_type"`
+}
+
+// message is a Discord message.
+type message struct {
+	ID                string        `json:"id"`
+	ChannelID         string        `json:"channel_id"`
+	WebhookID         string        `json:"webhook_id"`
+	Author            *user         `json:"author"`
+	Member            *member       `json:"member"`
+	Content           string        `json:"content"`
+	Timestamp         time.Time     `json:"timestamp"`
+	EditedTimestamp   *time.Time    `json:"edited_timestamp"`
+	Mentions          []mention     `json:"mentions"`
+	Attachments       []attachment  `json:"attachments"`
+	StickerItems      []stickerItem `json:"sticker_items"`
+	ReferencedMessage *message      `json:"referenced_message"`
+}
+
+// name returns the name of the author of the message as it is shown in the
+// channel.
+func (m *message) name() string {
+	switch {
+	case m.Author == nil:
+		return ""
+	case m.Member != nil && m.Member.Nick != "":
+		return m.Member.Nick
+	case m.Author.GlobalName != "" && m.WebhookID == "":
+		return m.Author.GlobalName
+	}
+	return m.Author.Username
+}
+
+// webhookMessage is the body of a webhook execution.
+type webhookMessage struct {
+	Content         string          `json:"content,omitempty"`
+	Username        string          `json:"username,omitempty"`
+	Embeds          []embed         `json:"embeds,omitempty"`
+	AllowedMentions allowedMentions `json:"allowed_mentions"`
+}
+
+// embed is a rich embed of a message.
+type embed struct {
+	Title       string      `json:"title,omitempty"`
+	Description string      `json:"description,omitempty"`
+	URL         string      `json:"url,omitempty"`
+	Color       int         `json:"color,omitempty"`
+	Image       *embedImage `json:"image,omitempty"`
+}
+
+// embedImage is an image of an embed.
+type embedImage struct {
+	URL string `json:"url"`
+}
+
+// allowedMentions restricts who can be pinged by a message.
+type allowedMentions struct {
+	Parse []string `json:"parse"`
+}
+
+// do makes a request and decodes the JSON response into result. Requests to
+// the API are authorized with the bot token, requests to webhooks don't need
+// it.
+func (c *client) do(method, u string, body, result interface{}) error {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		reqBody, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(u, c.api) {
+		req.Header.Set("Authorization", "Bot "+c.token)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		e := &apiError{Status: resp.StatusCode}
+		json.Unmarshal(respBody, e)
+		return e
+	}
+	if result != nil && len(respBody) != 0 {
+		return json.Unmarshal(respBody, result)
+	}
+	return nil
+}
+
+// me returns the bot user.
+func (c *client) me() (*user, error) {
+	u := new(user)
+	err := c.do("GET", c.api+"/users/@me", nil, u)
+	return u, err
+}
+
+// execute posts a message through a webhook and returns its ID.
+func (c *client) execute(webhook string, m *webhookMessage) (string, error) {
+	u, err := url.Parse(webhook)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	query.Set("wait", "true")
+	u.RawQuery = query.Encode()
+
+	var resp struct {
+		ID string `json:"id"`
+	}
+	err = c.do("POST", u.String(), m, &resp)
+	return resp.ID, err
+}
+
+// dial connects to the gateway.
+func (c *client) dial() (*websocket.Conn, error) {
+	return websocket.Dial(c.gateway, "", "https://discord.com")
+}
+
+// webhookID extracts the ID from a webhook URL
+// (https://discord.com/api/webhooks/<id>/<token>).
+func webhookID(webhook string) string {
+	parts := strings.Split(strings.TrimRight(webhook, "/"), "/")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[len(parts)-2]
+}
@@ -0,0 +1,664 @@
+// Package discord contains everything related to the Discord part of IRChuu.
+package discord
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/26000/irchuu/config"
+	irchuubase "github.com/26000/irchuu/db"
+	"github.com/26000/irchuu/relay"
+
+	"golang.org/x/net/websocket"
+)
+
+// transportName is the name of the Discord transport in the router.
+const transportName = "discord"
+
+// Delays between attempts to log in or connect to the gateway.
+const (
+	minReconnectDelay = 5 * time.Second
+	maxReconnectDelay = 5 * time.Minute
+)
+
+// The minimum and maximum lengths of a webhook username.
+const (
+	minUsername = 2
+	maxUsername = 80
+)
+
+// forbiddenUsernames are the words Discord rejects in webhook usernames, with
+// the position of the letter which is replaced by its lookalike.
+var forbiddenUsernames = map[string]int{"discord": 4, "clyde": 4}
+
+// lookalikes are the Cyrillic letters which look like the Latin ones.
+var lookalikes = map[rune]rune{'o': 'о', 'O': 'О', 'e': 'е', 'E': 'Е'}
+
+// mircColors are the RGB values of IRC colours.
+var mircColors = [16]int{
+	0xffffff, 0x000000, 0x00007f, 0x009300, 0xff0000, 0x7f0000, 0x9c009c,
+	0xfc7f00, 0xffff00, 0x00fc00, 0x009393, 0x00ffff, 0x0000fc, 0xff00ff,
+	0x7f7f7f, 0xd2d2d2,
+}
+
+var (
+	mentionRegex = regexp.MustCompile(`<@!?(\d+)>`)
+	emojiRegex   = regexp.MustCompile(`<a?(:\w+:)\d+>`)
+
+	markdownEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`,
+		"~", `\~`, "`", "\\`", "|", `\|`)
+)
+
+// Transport is the Discord transport.
+type Transport struct {
+	c        *config.Discord
+	client   *client
+	logger   *log.Logger
+	services chan relay.ServiceMessage
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu         sync.Mutex
+	conn       *websocket.Conn
+	userID     string
+	channels   map[string]*config.Bridge // by channel ID
+	webhooks   map[string]string         // webhook URLs by bridge name
+	webhookIDs map[string]bool
+	err        error
+}
+
+// NewTransport creates the Discord transport.
+func NewTransport(c *config.Discord) *Transport {
+	return &Transport{
+		c: c,
+		client: &client{
+			api:     apiURL,
+			gateway: gatewayURL,
+			token:   c.Token,
+			http:    &http.Client{Timeout: 30 * time.Second},
+		},
+		logger:   log.New(os.Stdout, "DSC ", log.LstdFlags),
+		services: make(chan relay.ServiceMessage, 20),
+		stop:     make(chan struct{}),
+
+		channels:   make(map[string]*config.Bridge),
+		webhooks:   make(map[string]string),
+		webhookIDs: make(map[string]bool),
+	}
+}
+
+// Name returns the name of the transport.
+func (t *Transport) Name() string {
+	return transportName
+}
+
+// Send posts a message through the webhook of its bridge.
+func (t *Transport) Send(message relay.Message) error {
+	t.mu.Lock()
+	userID := t.userID
+	webhook := t.webhooks[message.Bridge]
+	t.mu.Unlock()
+	if userID == "" {
+		return errors.New("not logged in")
+	}
+	if webhook == "" {
+		// the bridge has no Discord channel
+		return nil
+	}
+
+	_, err := t.client.execute(webhook, formatDiscordMessage(message, t.c))
+	if e, ok := err.(*apiError); ok && e.Status/100 == 4 && e.Status != 429 {
+		return relay.Permanent(err)
+	}
+	return err
+}
+
+// SendService queues a service command.
+func (t *Transport) SendService(message relay.ServiceMessage) error {
+	t.services <- message
+	return nil
+}
+
+// Stop disconnects from the gateway.
+func (t *Transport) Stop() error {
+	t.stopOnce.Do(func() { close(t.stop) })
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil {
+		return t.conn.Close()
+	}
+	return nil
+}
+
+// Health returns the error which broke the last gateway session, if any.
+func (t *Transport) Health() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == nil && t.err == nil {
+		return errors.New("not connected")
+	}
+	return t.err
+}
+
+// Start checks the token and keeps a gateway session until stopped, retrying
+// both with backoff.
+func (t *Transport) Start(r *relay.Router) error {
+	backoff := relay.NewBackoff(minReconnectDelay, maxReconnectDelay)
+	var me *user
+	for {
+		var err error
+		if me, err = t.client.me(); err == nil {
+			break
+		}
+		t.mu.Lock()
+		t.err = fmt.Errorf("failed to log in: %v", err)
+		t.mu.Unlock()
+		t.logger.Printf("Failed to log in: %v, retrying in %v\n", err,
+			backoff.Delay())
+		if !backoff.Wait(t.stop) {
+			return nil
+		}
+	}
+	backoff.Reset()
+	t.logger.Printf("Logged in as %v\n", me.Username)
+
+	t.mu.Lock()
+	for _, b := range r.Bridges() {
+		if b.DiscordChannel == "" || b.DiscordWebhook == "" {
+			continue
+		}
+		t.channels[b.DiscordChannel] = b
+		t.webhooks[b.Name] = b.DiscordWebhook
+		t.webhookIDs[webhookID(b.DiscordWebhook)] = true
+	}
+	t.userID = me.ID
+	t.err = nil
+	t.mu.Unlock()
+
+	go t.listenService()
+
+	for {
+		started := time.Now()
+		err := t.session(r)
+		select {
+		case <-t.stop:
+			return nil
+		default:
+		}
+		t.mu.Lock()
+		t.err = err
+		t.mu.Unlock()
+		// a session which lasted long enough resets the backoff
+		if time.Since(started) > maxReconnectDelay {
+			backoff.Reset()
+		}
+		t.logger.Printf("Gateway session ended, reconnecting in %v: %v\n",
+			backoff.Delay(), err)
+		if !backoff.Wait(t.stop) {
+			return nil
+		}
+	}
+}
+
+// session connects to the gateway, identifies and processes events until the
+// connection breaks.
+func (t *Transport) session(r *relay.Router) error {
+	conn, err := t.client.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	t.mu.Lock()
+	t.conn = conn
+	t.mu.Unlock()
+	select {
+	case <-t.stop:
+		return nil
+	default:
+	}
+
+	var p payload
+	if err := websocket.JSON.Receive(conn, &p); err != nil {
+		return err
+	}
+	if p.Op != opHello {
+		return fmt.Errorf("expected hello, got opcode %v", p.Op)
+	}
+	var hello struct {
+		HeartbeatInterval int `json:"heartbeat_interval"`
+	}
+	if err := json.Unmarshal(p.D, &hello); err != nil {
+		return err
+	}
+
+	err = websocket.JSON.Send(conn, map[string]interface{}{
+		"op": opIdentify,
+		"d": map[string]interface{}{
+			"token":   t.c.Token,
+			"intents": intents,
+			"properties": map[string]string{
+				"os":      runtime.GOOS,
+				"browser": "irchuu",
+				"device":  "irchuu",
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	seq := int64(-1)
+	done := make(chan struct{})
+	defer close(done)
+	go t.heartbeat(conn, time.Duration(hello.HeartbeatInterval)*time.Millisecond,
+		&seq, done)
+
+	for {
+		var p payload
+		if err := websocket.JSON.Receive(conn, &p); err != nil {
+			return err
+		}
+		if p.S != nil {
+			atomic.StoreInt64(&seq, *p.S)
+		}
+		switch p.Op {
+		case opDispatch:
+			t.dispatch(r, p.T, p.D)
+		case opHeartbeat:
+			sendHeartbeat(conn, &seq)
+		case opReconnect:
+			return errors.New("the gateway asked to reconnect")
+		case opInvalidSession:
+			return errors.New("invalid session")
+		}
+	}
+}
+
+// heartbeat sends heartbeats until done is closed.
+func (t *Transport) heartbeat(conn *websocket.Conn, interval time.Duration, seq *int64, done chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := sendHeartbeat(conn, seq); err != nil {
+				t.logger.Printf("Failed to send a heartbeat: %v\n", err)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// sendHeartbeat sends a heartbeat with the last sequence number.
+func sendHeartbeat(conn *websocket.Conn, seq *int64) error {
+	var d interface{}
+	if s := atomic.LoadInt64(seq); s != -1 {
+		d = s
+	}
+	return websocket.JSON.Send(conn, map[string]interface{}{
+		"op": opHeartbeat,
+		"d":  d,
+	})
+}
+
+// dispatch processes a gateway event.
+func (t *Transport) dispatch(r *relay.Router, event string, data json.RawMessage) {
+	switch event {
+	case "READY":
+		t.mu.Lock()
+		t.err = nil
+		t.mu.Unlock()
+		t.logger.Println("Connected to the gateway")
+	case "MESSAGE_CREATE", "MESSAGE_UPDATE":
+		var m message
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.logger.Printf("Failed to parse a message: %v\n", err)
+			return
+		}
+		// updates without edited_timestamp are embeds being resolved
+		if event == "MESSAGE_UPDATE" && m.EditedTimestamp == nil {
+			return
+		}
+
+		t.mu.Lock()
+		b := t.channels[m.ChannelID]
+		own := m.Author == nil || m.Author.ID == t.userID || t.webhookIDs[m.WebhookID]
+		t.mu.Unlock()
+		if b == nil || own {
+			return
+		}
+		for _, message := range formatMessage(&m, b) {
+			r.Relay(message)
+			go irchuubase.Log(message, t.logger)
+		}
+	}
+}
+
+// formatMessage maps a Discord message onto universal messages
+// (relay.Message), one for the text and every attachment.
+func formatMessage(m *message, b *config.Bridge) []relay.Message {
+	extra := make(map[string]string)
+	if m.ReferencedMessage != nil && m.ReferencedMessage.Author != nil {
+		extra["reply"] = m.ReferencedMessage.name()
+		extra["replyID"] = m.ReferencedMessage.ID
+	}
+	if m.EditedTimestamp != nil {
+		extra["edit"] = strconv.FormatInt(m.EditedTimestamp.Unix(), 10)
+	}
+
+	base := relay.Message{
+		Date:   m.Timestamp,
+		Origin: transportName,
+		Bridge: b.Name,
+		Nick:   m.name(),
+		Text:   formatContent(m),
+	}
+
+	var messages []relay.Message
+	for _, a := range m.Attachments {
+		message := base
+		message.Extra = copyExtra(extra)
+		message.Extra["media"] = attachmentMedia(a.ContentType)
+		message.Extra["url"] = a.URL
+		message.Extra["mediaName"] = a.Filename
+		message.Extra["mime"] = a.ContentType
+		message.Extra["size"] = strconv.Itoa(a.Size)
+		message.Extra["width"] = strconv.Itoa(a.Width)
+		message.Extra["height"] = strconv.Itoa(a.Height)
+		messages = append(messages, message)
+		base.Text = ""
+	}
+	for _, s := range m.StickerItems {
+		message := base
+		message.Extra = copyExtra(extra)
+		message.Extra["media"] = "sticker"
+		message.Extra["url"] = stickerURL(s)
+		message.Extra["mediaName"] = s.Name
+		messages = append(messages, message)
+		base.Text = ""
+	}
+	if len(messages) == 0 && base.Text != "" {
+		base.Extra = extra
+		messages = append(messages, base)
+	}
+	return messages
+}
+
+// copyExtra makes a copy of the extra map.
+func copyExtra(extra map[string]string) map[string]string {
+	c := make(map[string]string, len(extra)+8)
+	for k, v := range extra {
+		c[k] = v
+	}
+	return c
+}
+
+// attachmentMedia returns the media type of an attachment in terms of
+// universal messages.
+func attachmentMedia(contentType string) string {
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return "photo"
+	case strings.HasPrefix(contentType, "video/"):
+		return "video"
+	case strings.HasPrefix(contentType, "audio/"):
+		return "audio"
+	}
+	return "document"
+}
+
+// stickerURL returns the URL of the image of a sticker.
+func stickerURL(s stickerItem) string {
+	ext := "png"
+	switch s.FormatType {
+	case 3:
+		ext = "json"
+	case 4:
+		ext = "gif"
+	}
+	return fmt.Sprintf("https://media.discordapp.net/stickers/%v.%v", s.ID, ext)
+}
+
+// formatContent replaces mentions and custom emoji in the text of a message
+// with their readable forms.
+func formatContent(m *message) string {
+	text := mentionRegex.ReplaceAllStringFunc(m.Content, func(s string) string {
+		id := mentionRegex.FindStringSubmatch(s)[1]
+		for _, u := range m.Mentions {
+			if u.ID != id {
+				continue
+			}
+			if u.Member != nil && u.Member.Nick != "" {
+				return "@" + u.Member.Nick
+			}
+			if u.GlobalName != "" {
+				return "@" + u.GlobalName
+			}
+			return "@" + u.Username
+		}
+		return s
+	})
+	return emojiRegex.ReplaceAllString(text, "$1")
+}
+
+// listenService listens to service messages and executes them.
+func (t *Transport) listenService() {
+	for f := range t.services {
+		t.mu.Lock()
+		webhook := t.webhooks[f.Bridge]
+		t.mu.Unlock()
+		if webhook == "" || len(f.Arguments) == 0 {
+			continue
+		}
+		text := escapeMarkdown(relay.StripFormatting(f.Arguments[0]))
+		switch f.Command {
+		case "announce":
+		case "action":
+			text = "_" + text + "_"
+		default:
+			continue
+		}
+		if _, err := t.client.execute(webhook, &webhookMessage{
+			Content:         text,
+			AllowedMentions: allowedMentions{Parse: []string{}},
+		}); err != nil {
+			t.logger.Printf("Sending message failed: %v\n", err)
+		}
+	}
+}
+
+// formatDiscordMessage translates a universal message into a webhook message.
+// Service events and media are sent as embeds coloured like the nick of their
+// sender in IRC.
+func formatDiscordMessage(message relay.Message, c *config.Discord) *webhookMessage {
+	plain := relay.StripFormatting(message.Text)
+	text := escapeMarkdown(plain)
+	nick := message.Name()
+	m := &webhookMessage{
+		Username:        webhookUsername(nick),
+		AllowedMentions: allowedMentions{Parse: []string{}},
+	}
+
+	// event writes the formatted text into an embed, emboldening the
+	// arguments
+	event := func(format string, a ...interface{}) {
+		bold := make([]interface{}, len(a))
+		for i, v := range a {
+			bold[i] = "**" + escapeMarkdown(fmt.Sprint(v)) + "**"
+		}
+		m.Embeds = []embed{{
+			Description: fmt.Sprintf(format, bold...),
+			Color:       nickColor(nick, c.Palette),
+		}}
+	}
+
+	switch message.Extra["special"] {
+	case "ACTION":
+		m.Content = "_" + text + "_"
+	case "JOIN":
+		event("%v has joined.", nick)
+	case "PART":
+		if text == "" {
+			event("%v has left.", nick)
+		} else {
+			event("%v has left: %v.", nick, plain)
+		}
+	case "QUIT":
+		if text == "" {
+			event("%v has quit.", nick)
+		} else {
+			event("%v has quit: %v.", nick, plain)
+		}
+	case "KICK":
+		event("%v has kicked %v.", nick, plain)
+	case "NICK":
+		event("%v is now known as %v.", nick, plain)
+	case "TOPIC":
+		event("%v has set a new topic: %v.", nick, plain)
+	case "MODE":
+		event("%v has set mode %v.", nick, plain)
+	case "pin":
+		event("%v pinned %v's message: %v", message.Extra["pin"], nick,
+			plain)
+	case "newChatMember":
+		if strconv.Itoa(message.FromID) == message.Extra["memberID"] {
+			event("%v joined the group via invite link.",
+				message.Extra["memberName"])
+		} else {
+			event("%v was added by %v.", message.Extra["memberName"], nick)
+		}
+	case "leftChatMember":
+		if strconv.Itoa(message.FromID) == message.Extra["memberID"] {
+			event("%v left the group.", message.Extra["memberName"])
+		} else {
+			event("%v was removed by %v.", message.Extra["memberName"], nick)
+		}
+	case "newChatTitle":
+		event("Chat renamed to \"%v\" by %v.", message.Extra["title"], nick)
+	case "newChatPhoto":
+		event("The chat photo has been changed by %v.", nick)
+	case "deleteChatPhoto":
+		event("The chat photo has been deleted by %v.", nick)
+	default:
+		if message.Extra["forward"] != "" {
+			text = fmt.Sprintf("[fwd from @%v] %v",
+				escapeMarkdown(message.Extra["forward"]), text)
+		} else if message.Extra["forwardChatTitle"] != "" {
+			text = fmt.Sprintf("[fwd from channel %v] %v",
+				escapeMarkdown(message.Extra["forwardChatTitle"]), text)
+		} else if message.Extra["reply"] != "" {
+			text = fmt.Sprintf("**%v**, %v",
+				escapeMarkdown(message.Extra["reply"]), text)
+		}
+		if message.Extra["edit"] != "" {
+			text = "[edited] " + text
+		}
+		m.Content = text
+
+		if media := message.Extra["media"]; media != "" {
+			urls := message.MediaURLs()
+			if len(urls) == 0 {
+				urls = []string{""}
+			}
+			// an embed for every item of an album
+			for i, url := range urls {
+				e := embed{
+					Title: mediaDescription(message),
+					URL:   url,
+					Color: nickColor(nick, c.Palette),
+				}
+				if len(urls) > 1 {
+					e.Title += fmt.Sprintf(" %d", i+1)
+				}
+				if (media == "photo" || media == "sticker") && e.URL != "" {
+					e.Image = &embedImage{URL: e.URL}
+				}
+				m.Embeds = append(m.Embeds, e)
+			}
+		} else if url := message.Extra["url"]; url != "" {
+			m.Content = strings.TrimSpace(m.Content + " " + url)
+		}
+	}
+	return m
+}
+
+// mediaDescription returns a short description of the media of a message.
+func mediaDescription(message relay.Message) string {
+	switch message.Extra["media"] {
+	case "document", "audio":
+		if message.Extra["mediaName"] != "" {
+			return message.Extra["media"] + " \"" + message.Extra["mediaName"] + "\""
+		}
+	}
+	return message.Extra["media"]
+}
+
+// webhookUsername makes a name acceptable as a webhook username: forbidden
+// words are disguised and short names are padded.
+func webhookUsername(nick string) string {
+	name := []rune(strings.TrimSpace(nick))
+	for word, i := range forbiddenUsernames {
+		n := len([]rune(word))
+		for j := 0; j+n <= len(name); j++ {
+			if strings.EqualFold(string(name[j:j+n]), word) {
+				name[j+i] = lookalikes[name[j+i]]
+			}
+		}
+	}
+	for len(name) < minUsername {
+		name = append(name, '_')
+	}
+	if len(name) > maxUsername {
+		name = append(name[:maxUsername-1], '…')
+	}
+	return string(name)
+}
+
+// escapeMarkdown escapes Discord's markdown.
+func escapeMarkdown(text string) string {
+	return markdownEscaper.Replace(text)
+}
+
+// nickColor picks the colour of a nick from the palette of IRC colours like
+// it is done in IRC and returns its RGB value.
+func nickColor(nick string, palette []string) int {
+	if len(palette) == 0 {
+		return 0
+	}
+	i := djb2(nick) % int32(len(palette))
+	if i < 0 {
+		i += int32(len(palette))
+	}
+	color, err := strconv.Atoi(palette[i])
+	if err != nil || color < 0 || color >= len(mircColors) {
+		return 0
+	}
+	return mircColors[color]
+}
+
+// djb2 hashes the string and returns an integer, it is the same hash which
+// the IRC side uses to colorize nicks.
+func djb2(nick string) int32 {
+	hash := int32(5381)
+	for s := 0; s < len(nick); s++ {
+		hash = ((hash << 5) + hash) + int32(nick[s])
+	}
+	return hash
+}
@@ -0,0 +1,231 @@
+package discord
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/26000/irchuu/config"
+	"github.com/26000/irchuu/relay"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+)
+
+// fakeDiscord serves the API, the webhook and the gateway.
+type fakeDiscord struct {
+	mu       sync.Mutex
+	identify map[string]interface{}
+	sent     []webhookMessage
+	events   []string // dispatched after READY
+}
+
+func (d *fakeDiscord) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/@me", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bot token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"message":"401: Unauthorized","code":0}`)
+			return
+		}
+		fmt.Fprint(w, `{"id":"1","username":"irchuu","bot":true}`)
+	})
+	mux.HandleFunc("/webhooks/42/secret", func(w http.ResponseWriter, r *http.Request) {
+		var m webhookMessage
+		json.NewDecoder(r.Body).Decode(&m)
+		d.mu.Lock()
+		d.sent = append(d.sent, m)
+		d.mu.Unlock()
+		fmt.Fprint(w, `{"id":"100"}`)
+	})
+	mux.Handle("/gateway", websocket.Handler(func(conn *websocket.Conn) {
+		websocket.Message.Send(conn, `{"op":10,"d":{"heartbeat_interval":45000}}`)
+		var identify map[string]interface{}
+		if websocket.JSON.Receive(conn, &identify) != nil {
+			return
+		}
+		d.mu.Lock()
+		d.identify = identify
+		events := d.events
+		d.mu.Unlock()
+
+		websocket.Message.Send(conn, `{"op":0,"s":1,"t":"READY","d":{"user":{"id":"1"}}}`)
+		for i, e := range events {
+			websocket.Message.Send(conn, fmt.Sprintf(`{"op":0,"s":%v,"t":"MESSAGE_CREATE","d":%v}`,
+				i+2, e))
+		}
+		var p payload
+		for websocket.JSON.Receive(conn, &p) == nil {
+		}
+	}))
+	return mux
+}
+
+// recorder is a transport which records messages sent to it.
+type recorder struct {
+	messages chan relay.Message
+}
+
+func (t *recorder) Name() string                                   { return "irc" }
+func (t *recorder) Start(r *relay.Router) error                    { select {} }
+func (t *recorder) Stop() error                                    { return nil }
+func (t *recorder) Send(message relay.Message) error               { t.messages <- message; return nil }
+func (t *recorder) SendService(message relay.ServiceMessage) error { return nil }
+func (t *recorder) Health() error                                  { return nil }
+
+func TestTransport(t *testing.T) {
+	assert := assert.New(t)
+	d := &fakeDiscord{events: []string{
+		// own message from the webhook
+		`{"id":"2","channel_id":"10","webhook_id":"42","author":{"id":"42","username":"nick"},` +
+			`"content":"echo","timestamp":"2016-11-03T12:41:15.000000+00:00"}`,
+		// a message in another channel
+		`{"id":"3","channel_id":"11","author":{"id":"7","username":"bob"},` +
+			`"content":"hi","timestamp":"2016-11-03T12:41:16.000000+00:00"}`,
+		`{"id":"4","channel_id":"10","author":{"id":"7","username":"bob","global_name":"Bob"},` +
+			`"member":{"nick":"bobby"},"content":"look <@8> <:kawaii:123>",` +
+			`"mentions":[{"id":"8","username":"alice","global_name":"Alice"}],` +
+			`"timestamp":"2016-11-03T12:41:17.000000+00:00",` +
+			`"attachments":[{"id":"5","filename":"cat.png","content_type":"image/png",` +
+			`"size":1024,"url":"https://cdn.example.org/cat.png","width":20,"height":10}],` +
+			`"referenced_message":{"id":"2","webhook_id":"42","author":{"id":"42","username":"nick"}}}`,
+	}}
+	server := httptest.NewServer(d.handler())
+	defer server.Close()
+
+	bridges := []*config.Bridge{
+		&config.Bridge{Name: "irchuu", DiscordChannel: "10",
+			DiscordWebhook: server.URL + "/webhooks/42/secret"},
+	}
+	r := relay.NewRouter(bridges)
+	rec := &recorder{messages: make(chan relay.Message, 10)}
+	r.Add(rec)
+	tr := NewTransport(&config.Discord{Token: "token",
+		Palette: []string{"4"}})
+	tr.client.api = server.URL
+	tr.client.gateway = "ws" + strings.TrimPrefix(server.URL, "http") + "/gateway"
+	r.Add(tr)
+	go r.Start()
+	defer r.Stop()
+
+	var m relay.Message
+	select {
+	case m = <-rec.messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	assert.Equal("discord", m.Origin)
+	assert.Equal("irchuu", m.Bridge)
+	assert.Equal("bobby", m.Nick)
+	assert.Equal("look @Alice :kawaii:", m.Text)
+	assert.Equal("nick", m.Extra["reply"])
+	assert.Equal("photo", m.Extra["media"])
+	assert.Equal("https://cdn.example.org/cat.png", m.Extra["url"])
+	assert.Equal("20", m.Extra["width"])
+	assert.Equal("1024", m.Extra["size"])
+	assert.Len(rec.messages, 0)
+
+	d.mu.Lock()
+	assert.Equal(float64(opIdentify), d.identify["op"])
+	assert.Equal("token", d.identify["d"].(map[string]interface{})["token"])
+	d.mu.Unlock()
+	assert.NoError(tr.Health())
+
+	r.Relay(relay.Message{Origin: "irc", Bridge: "irchuu", Nick: "nick",
+		Text: "\x02hello\x0f *world*"})
+	assert.Eventually(func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.sent) == 1
+	}, time.Second, 10*time.Millisecond)
+	d.mu.Lock()
+	assert.Equal("nick", d.sent[0].Username)
+	assert.Equal(`hello \*world\*`, d.sent[0].Content)
+	d.mu.Unlock()
+}
+
+func TestTransport_BadToken(t *testing.T) {
+	server := httptest.NewServer((&fakeDiscord{}).handler())
+	defer server.Close()
+
+	tr := NewTransport(&config.Discord{Token: "wrong"})
+	tr.client.api = server.URL
+	done := make(chan error)
+	go func() { done <- tr.Start(relay.NewRouter(nil)) }()
+	// the transport keeps retrying and reports why it cannot log in
+	assert.Eventually(t, func() bool {
+		err := tr.Health()
+		return err != nil &&
+			err.Error() == "failed to log in: 401 (0): 401: Unauthorized"
+	}, time.Second, 10*time.Millisecond)
+	tr.Stop()
+	assert.NoError(t, <-done)
+	// the router may stop it again
+	assert.NotPanics(t, func() { tr.Stop() })
+}
+
+func TestFormatDiscordMessage(t *testing.T) {
+	assert := assert.New(t)
+	c := &config.Discord{Palette: []string{"4"}}
+
+	m := formatDiscordMessage(relay.Message{Origin: "irc", Nick: "nick",
+		Text: "bye", Extra: map[string]string{"special": "QUIT"}}, c)
+	assert.Equal("nick", m.Username)
+	assert.Equal("", m.Content)
+	assert.Equal([]embed{{Description: "**nick** has quit: **bye**.",
+		Color: 0xff0000}}, m.Embeds)
+
+	m = formatDiscordMessage(relay.Message{Origin: "telegram",
+		FirstName: "IRChuu~", Text: "look", Extra: map[string]string{
+			"media": "photo", "url": "https://example.org/a.jpg",
+			"reply": "nick_"}}, c)
+	assert.Equal("IRChuu~", m.Username)
+	assert.Equal(`**nick\_**, look`, m.Content)
+	assert.Equal([]embed{{Title: "photo", URL: "https://example.org/a.jpg",
+		Color: 0xff0000, Image: &embedImage{URL: "https://example.org/a.jpg"}}},
+		m.Embeds)
+
+	m = formatDiscordMessage(relay.Message{Origin: "telegram",
+		FirstName: "IRChuu~", Text: "trip", Extra: map[string]string{
+			"media": "album", "album": "https://a.org/1.jpg https://a.org/2.jpg",
+			"items": "2"}}, c)
+	assert.Equal("trip", m.Content)
+	assert.Equal([]embed{
+		{Title: "album 1", URL: "https://a.org/1.jpg", Color: 0xff0000},
+		{Title: "album 2", URL: "https://a.org/2.jpg", Color: 0xff0000}}, m.Embeds)
+
+	m = formatDiscordMessage(relay.Message{Origin: "irc", Nick: "nick",
+		Text: "waves", Extra: map[string]string{"special": "ACTION"}}, c)
+	assert.Equal("_waves_", m.Content)
+	assert.Equal([]string{}, m.AllowedMentions.Parse)
+}
+
+func TestNickColor(t *testing.T) {
+	assert := assert.New(t)
+	palette := []string{"1", "2", "3", "4", "5", "6", "7"}
+	// the same colours as in IRC: 26000 is 3, nick is 2
+	assert.Equal(0x009300, nickColor("26000", palette))
+	assert.Equal(0x00007f, nickColor("nick", palette))
+	assert.Equal(0, nickColor("nick", nil))
+	assert.Equal(0, nickColor("nick", []string{"x"}))
+}
+
+func TestWebhookUsername(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("26000", webhookUsername("26000"))
+	assert.Equal("Discоrd fan", webhookUsername("Discord fan"))
+	assert.Equal("CLYDЕ & discоrd", webhookUsername("CLYDE & discord"))
+	assert.Equal("a_", webhookUsername(" a "))
+	assert.Equal("__", webhookUsername(""))
+	assert.Equal(strings.Repeat("a", maxUsername-1)+"…",
+		webhookUsername(strings.Repeat("a", 100)))
+}
+
+func TestWebhookID(t *testing.T) {
+	assert.Equal(t, "123", webhookID("https://discord.com/api/webhooks/123/token"))
+}
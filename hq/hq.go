@@ -19,7 +19,7 @@ import (
 const URI = "https://26000.github.io/irchuu/version.json"
 
 // Report checks for a new version sending data if enabled.
-func Report(irchuu *config.Irchuu, tg *config.Telegram, irc *config.Irc) {
+func Report(irchuu *config.Irchuu) {
 	if !irchuu.CheckUpdates && !irchuu.SendStats {
 		return
 	}
@@ -57,7 +57,9 @@ func Report(irchuu *config.Irchuu, tg *config.Telegram, irc *config.Irc) {
 	}
 
 	if irchuu.SendStats {
-		sendTelemetry(arr[1], strconv.FormatInt(tg.Group, 10), irc.Channel)
+		for _, b := range irchuu.Bridges {
+			sendTelemetry(arr[1], strconv.FormatInt(b.Group, 10), b.Channel)
+		}
 	}
 }
 
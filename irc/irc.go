@@ -4,12 +4,16 @@ package irchuu
 import (
 	"crypto/tls"
 	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
@@ -24,24 +28,215 @@ import (
 var (
 	ircConn *irc.Connection
 	ircConf *config.Irc
+
+	// channels the bot is currently on, the keys are lowercased
+	joinedChannels = make(map[string]bool)
+	// when the bot left the channels, the keys are lowercased
+	leftChannels = make(map[string]time.Time)
+	joinedMu     sync.RWMutex
+	// whether the connection is up, go-ircevent doesn't notice it is lost
+	online bool
+	// when the connection came up
+	onlineSince time.Time
+
+	// lastID is the last ID given to a message without a msgid tag
+	lastID int64
+
+	// correction matches s/foo/bar/ corrections of the previous message
+	correction = regexp.MustCompile(`^s/((?:[^/\\]|\\.)+)/((?:[^/\\]|\\.)*)(?:/(g?))?$`)
 )
 
-// Launch starts the IRC bot and waits for messages.
-func Launch(c *config.Irc, wg *sync.WaitGroup, r *relay.Relay) {
-	defer wg.Done()
+// transportName is the name of the IRC transport in the router.
+const transportName = "irc"
+
+// Delays between attempts to reconnect.
+const (
+	minReconnectDelay = 5 * time.Second
+	maxReconnectDelay = 5 * time.Minute
+)
+
+// maxJoinWait is how long messages to a channel which is not joined are
+// retried after the join delay, e. g. while the bot is rejoining it. Later
+// they are dropped, so a channel the bot cannot join does not hold up the
+// others.
+const maxJoinWait = 2 * time.Minute
+
+// Transport is the IRC transport. There may be only one IRC transport as the
+// connection is kept in the package.
+type Transport struct {
+	c        *config.Irc
+	services chan relay.ServiceMessage
+
+	logger  *log.Logger
+	mu      sync.RWMutex
+	r       *relay.Router    // set when started
+	bridges []*config.Bridge // set when started
+	lost    map[string]bool  // bridges which were told that the link is lost
+
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// used for service messages that need to be
+	// run even when IRC bot not in channel
+	always chan relay.ServiceMessage
+}
+
+// NewTransport creates the IRC transport.
+func NewTransport(c *config.Irc) *Transport {
+	return &Transport{
+		c:        c,
+		services: make(chan relay.ServiceMessage, 20),
+		always:   make(chan relay.ServiceMessage, 20),
+		lost:     make(map[string]bool),
+		stop:     make(chan struct{}),
+		logger:   log.New(os.Stdout, "IRC ", log.LstdFlags),
+	}
+}
+
+// Name returns the name of the transport.
+func (t *Transport) Name() string {
+	return transportName
+}
+
+// Send sends a message to the channel of its bridge. It fails while the
+// channel is not joined, so the message is retried after (re)joining, unless
+// the channel has not been joined for too long.
+func (t *Transport) Send(message relay.Message) error {
+	t.mu.RLock()
+	bridges := t.bridges
+	t.mu.RUnlock()
+	if bridges == nil || !isOnline() {
+		return errors.New("not connected")
+	}
+
+	var b *config.Bridge
+	for _, bridge := range bridges {
+		if bridge.Name == message.Bridge {
+			b = bridge
+		}
+	}
+	if b == nil {
+		return relay.Permanent(fmt.Errorf("unknown bridge %v", message.Bridge))
+	}
+	if !isJoined(b.Channel) {
+		err := fmt.Errorf("not on %v", b.Channel)
+		if notJoinedFor(b.Channel) > maxJoinWait+
+			time.Duration(t.c.JoinDelay)*time.Second {
+			return relay.Permanent(err)
+		}
+		return err
+	}
+	var echoes []*echo
+	if t.c.Puppets && usesPuppet(message) {
+		p, err := getPuppet(message, b, t.logger)
+		if err == nil {
+			err = safely(func() { echoes = p.send(message, b) })
+		}
+		if err == nil {
+			t.confirm(message, b, echoes)
+			return nil
+		}
+		t.logger.Printf("The puppet of %v is unavailable, relaying by the bot: %v\n",
+			message.Name(), err)
+	}
+	if err := safely(func() { echoes = relayMessageToIRC(message, b) }); err != nil {
+		return err
+	}
+	t.confirm(message, b, echoes)
+	return nil
+}
+
+// confirm waits until the server echoes the lines of the message and
+// remembers the msgid of the first one.
+func (t *Transport) confirm(message relay.Message, b *config.Bridge, echoes []*echo) {
+	timeout := time.After(echoTimeout)
+	for i, e := range echoes {
+		select {
+		case id := <-e.ch:
+			if i == 0 && id != "" {
+				t.mu.RLock()
+				t.r.Index().SetCopy(message, transportName, id)
+				t.mu.RUnlock()
+			}
+		case <-timeout:
+			for _, e := range echoes[i:] {
+				e.cancel()
+			}
+			t.logger.Printf("The server did not echo a message sent to %v\n",
+				b.Channel)
+			return
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// SendService queues a service command.
+func (t *Transport) SendService(message relay.ServiceMessage) error {
+	if message.Command == "status" {
+		t.always <- message
+	} else {
+		t.services <- message
+	}
+	return nil
+}
 
+// Stop quits IRC.
+func (t *Transport) Stop() error {
+	t.stopOnce.Do(func() { close(t.stop) })
+	if !isOnline() {
+		return nil
+	}
+	if safely(ircConn.Quit) != nil {
+		return nil
+	}
+	// give the connection some time to send QUIT
+	time.Sleep(time.Second)
+	return nil
+}
+
+// Health returns an error if the bot is not connected or not on channels.
+func (t *Transport) Health() error {
+	if !isOnline() {
+		return errors.New("not connected")
+	}
+	t.mu.RLock()
+	bridges := t.bridges
+	t.mu.RUnlock()
+	var notJoined []string
+	for _, b := range bridges {
+		if !isJoined(b.Channel) {
+			notJoined = append(notJoined, b.Channel)
+		}
+	}
+	if len(notJoined) != 0 {
+		return fmt.Errorf("not on %v", strings.Join(notJoined, ", "))
+	}
+	return nil
+}
+
+// Start starts the IRC bot and waits for messages. It reconnects whenever
+// the connection is lost until the transport is stopped.
+func (t *Transport) Start(r *relay.Router) error {
+	c := t.c
 	startTime := time.Now()
 	ircConf = c
 
-	logger := log.New(os.Stdout, "IRC ", log.LstdFlags)
+	logger := t.logger
 	ircConn = irc.IRC(c.Nick, "IRChuu")
 	ircConn.Password = c.ServerPassword
 
+	t.mu.Lock()
+	t.r = r
+	t.bridges = r.Bridges()
+	t.mu.Unlock()
+
 	ircConn.UseTLS = c.SSL
 	if ircConn.UseTLS {
 		ircConn.TLSConfig = &tls.Config{ServerName: c.Server}
 	}
 
+	// names of every channel, the keys are lowercased channel names
 	// 0 — not on channel
 	// 1 — normal
 	// 2 — voice (+v, +)
@@ -49,9 +244,27 @@ func Launch(c *config.Irc, wg *sync.WaitGroup, r *relay.Relay) {
 	// 4 — op (+o, @)
 	// 5 — protected/admin (+a, &)
 	// 6 — owner (+q, ~)
-	names := make(map[string]int)
-	tempNames := make(map[string]int)
-	var nameQueryStarted, messageLoopStarted, serviceLoopStarted bool
+	names := make(map[string]map[string]int)
+	tempNames := make(map[string]map[string]int)
+	for _, b := range r.Bridges() {
+		names[strings.ToLower(b.Channel)] = make(map[string]int)
+		tempNames[strings.ToLower(b.Channel)] = make(map[string]int)
+	}
+	var nameQueryStarted, loopsStarted bool
+	// open netsplit and netjoin batches by their reference tags
+	batches := make(map[string]*batch)
+	// joins, parts and quits are summarized to avoid flooding
+	joinsParts := relay.NewDigest(time.Duration(c.DigestWindow)*time.Second,
+		func(f relay.Message) { r.Relay(f) },
+		func(bridge, text string) {
+			sendService(r, relay.ServiceMessage{
+				Command:   "announce",
+				Arguments: []string{text},
+				Bridge:    bridge,
+			})
+		})
+	// with the smart filter, only users who spoke recently are followed
+	speakers := relay.NewActivity(time.Duration(c.ActiveWindow) * time.Minute)
 
 	if c.SASL {
 		ircConn.UseSASL = true
@@ -87,10 +300,16 @@ func Launch(c *config.Irc, wg *sync.WaitGroup, r *relay.Relay) {
 			event.Nick)
 	})
 
+	handleCaps(logger)
+	handleWhois()
+
 	ircConn.AddCallback("NOTICE", func(event *irc.Event) {
-		if event.Arguments[0] == c.Channel {
-			f := formatMessage(event.Nick, event.Message(), "NOTICE")
-			r.IRCh <- f
+		if isEcho(event) {
+			return
+		}
+		if b := r.ByChannel(event.Arguments[0]); b != nil {
+			f := formatEvent(b, event, event.Message(), "NOTICE")
+			r.Relay(f)
 			go irchuubase.Log(f, logger)
 		} else {
 			logger.Printf("Notice from %v: %v\n",
@@ -113,31 +332,30 @@ func Launch(c *config.Irc, wg *sync.WaitGroup, r *relay.Relay) {
 		logger.Printf("Nickname already in use, changed to %v\n",
 			ircConn.GetNick())
 
-		if c.JoinDelay != 0 {
-			logger.Printf("Waiting %vs before joining the channel...", c.JoinDelay)
-			time.Sleep(time.Duration(c.JoinDelay) * time.Second)
-		}
-		ircConn.Join(fmt.Sprintf("%v %v", c.Channel, c.ChanPassword))
+		joinChannels(r, logger)
 	})
 
 	ircConn.AddCallback("473", func(event *irc.Event) {
-		logger.Printf("The channel is invite-only, please invite me\n")
+		logger.Printf("%v is invite-only, please invite me\n",
+			event.Arguments[1])
 	})
 
 	ircConn.AddCallback("471", func(event *irc.Event) {
-		logger.Printf("The channel is full\n")
+		logger.Printf("%v is full\n", event.Arguments[1])
 	})
 
 	ircConn.AddCallback("403", func(event *irc.Event) {
-		logger.Printf("The channel doesn't exist\n")
+		logger.Printf("%v doesn't exist\n", event.Arguments[1])
 	})
 
 	ircConn.AddCallback("474", func(event *irc.Event) {
-		logger.Printf("%v is banned on the channel\n", ircConn.GetNick())
+		logger.Printf("%v is banned on %v\n", ircConn.GetNick(),
+			event.Arguments[1])
 	})
 
 	ircConn.AddCallback("475", func(event *irc.Event) {
-		logger.Printf("The channel password is incorrect\n")
+		logger.Printf("The password for %v is incorrect\n",
+			event.Arguments[1])
 	})
 
 	ircConn.AddCallback("476", func(event *irc.Event) {
@@ -150,146 +368,179 @@ func Launch(c *config.Irc, wg *sync.WaitGroup, r *relay.Relay) {
 
 	// You are not channel operator
 	ircConn.AddCallback("482", func(event *irc.Event) {
-		if event.Arguments[1] == c.Channel {
-			r.IRCServiceCh <- relay.ServiceMessage{"announce", []string{"I need to be an operator in IRC for that action."}}
+		if b := r.ByChannel(event.Arguments[1]); b != nil {
+			sendService(r, relay.ServiceMessage{
+				Command:   "announce",
+				Arguments: []string{"I need to be an operator in IRC for that action."},
+				Bridge:    b.Name,
+			})
 		}
 	})
 
 	ircConn.AddCallback("INVITE", func(event *irc.Event) {
 		logger.Printf("Invited to %v by %v\n", event.Arguments[1], event.Nick)
-		if c.Channel == event.Arguments[1] {
-			ircConn.Join(fmt.Sprintf("%v %v", c.Channel, c.ChanPassword))
+		if b := r.ByChannel(event.Arguments[1]); b != nil {
+			ircConn.Join(fmt.Sprintf("%v %v", b.Channel, b.ChanPassword))
 		}
 	})
 
 	ircConn.AddCallback("341", func(event *irc.Event) {
-		s := relay.ServiceMessage{"announce",
-			[]string{fmt.Sprintf("Invited %v to %v.", event.Arguments[1],
-				event.Arguments[2])}}
-
-		r.IRCServiceCh <- s
-		r.TeleServiceCh <- s
+		b := r.ByChannel(event.Arguments[2])
+		if b == nil {
+			return
+		}
+		text := fmt.Sprintf("Invited %v to %v.", event.Arguments[1],
+			event.Arguments[2])
+		ircConn.Privmsg(b.Channel, text)
+		sendService(r, relay.ServiceMessage{
+			Command:   "announce",
+			Arguments: []string{text},
+			Bridge:    b.Name,
+		})
 	})
 
 	// TODO: add bold for these messages
 	ircConn.AddCallback("443", func(event *irc.Event) {
-		s := relay.ServiceMessage{"announce",
-			[]string{fmt.Sprintf("User %v is already on channel.",
-				event.Arguments[1])}}
-
-		r.IRCServiceCh <- s
-	})
-
-	/*
-		ircConn.AddCallback("401", func(event *irc.Event) {
-			s := relay.ServiceMessage{"announce",
-				[]string{fmt.Sprintf("No such nick: %v.", event.Arguments[1])}}
-
-			r.IRCServiceCh <- s
-			r.TeleServiceCh <- s
+		b := r.ByChannel(event.Arguments[2])
+		if b == nil {
+			return
+		}
+		sendService(r, relay.ServiceMessage{
+			Command: "announce",
+			Arguments: []string{fmt.Sprintf("User %v is already on channel.",
+				event.Arguments[1])},
+			Bridge: b.Name,
 		})
-	*/
+	})
 
 	// On joined...
 	ircConn.AddCallback("JOIN", func(event *irc.Event) {
+		b := r.ByChannel(event.Arguments[0])
 		if event.Nick == ircConn.GetNick() {
 			logger.Printf("Joined %v\n", event.Arguments[0])
-			if event.Arguments[0] == c.Channel {
-				if !messageLoopStarted {
-					go relayMessagesToIRC(r)
-					messageLoopStarted = true
-				}
+			if b != nil {
+				setJoined(b.Channel, true)
+				t.restored(r, b)
 
-				if !serviceLoopStarted {
-					go listenService(r, &names)
-					serviceLoopStarted = true
+				if !loopsStarted {
+					go listenService(r, t.services, names)
+					loopsStarted = true
 				}
 
 				if !nameQueryStarted {
-					go updateNames()
+					go updateNames(r, time.Second*
+						time.Duration(c.NamesUpdateInterval), t.stop)
 					nameQueryStarted = true
 				}
 			}
-		} else {
-			if event.Arguments[0] == c.Channel {
-				f := formatMessage(event.Nick, "", "JOIN")
-				if c.RelayJoinsParts {
-					r.IRCh <- f
-				}
-				go irchuubase.Log(f, logger)
-				names[event.Nick] = 1
+		} else if b != nil && !isPuppet(event.Nick) {
+			f := formatEvent(b, event, "", "JOIN")
+			if !collect(batches, event, "netjoin", b.Name) && c.RelayJoinsParts &&
+				speakers.Active(b.Name, event.Nick) {
+				joinsParts.Add(f)
 			}
+			go irchuubase.Log(f, logger)
+			names[strings.ToLower(b.Channel)][event.Nick] = 1
+			lookupNick(event.Nick)
 		}
 	})
 
 	if c.AnnounceTopic {
 		// Topic
 		ircConn.AddCallback("332", func(event *irc.Event) {
-			if event.Arguments[1] == c.Channel {
-				r.IRCServiceCh <- relay.ServiceMessage{"announce",
-					[]string{fmt.Sprintf("The topic for %v is %v.",
-						c.Channel, event.Arguments[2])}}
+			if b := r.ByChannel(event.Arguments[1]); b != nil {
+				sendService(r, relay.ServiceMessage{
+					Command: "announce",
+					Arguments: []string{fmt.Sprintf("The topic for %v is %v.",
+						b.Channel, event.Arguments[2])},
+					Bridge: b.Name,
+				})
 			}
 		})
 
 		// No topic
 		ircConn.AddCallback("331", func(event *irc.Event) {
-			if event.Arguments[1] == c.Channel {
-				r.IRCServiceCh <- relay.ServiceMessage{"announce",
-					[]string{"No topic is set."}}
+			if b := r.ByChannel(event.Arguments[1]); b != nil {
+				sendService(r, relay.ServiceMessage{
+					Command:   "announce",
+					Arguments: []string{"No topic is set."},
+					Bridge:    b.Name,
+				})
 			}
 		})
 	}
 
 	// Names
 	ircConn.AddCallback("353", func(event *irc.Event) {
-		if event.Arguments[2] == c.Channel {
-			for _, name := range strings.Split(event.Arguments[3], " ") {
-				if len(name) == 0 {
-					continue
-				}
-				switch name[0] {
-				case '+':
-					tempNames[name[1:]] = 2
-				case '%':
-					tempNames[name[1:]] = 3
-				case '@':
-					tempNames[name[1:]] = 4
-				case '&':
-					tempNames[name[1:]] = 5
-				case '~':
-					tempNames[name[1:]] = 6
-				default:
-					tempNames[name] = 1
-				}
+		b := r.ByChannel(event.Arguments[2])
+		if b == nil {
+			return
+		}
+		temp := tempNames[strings.ToLower(b.Channel)]
+		for _, name := range strings.Split(event.Arguments[3], " ") {
+			if len(name) == 0 {
+				continue
+			}
+			switch name[0] {
+			case '+':
+				temp[name[1:]] = 2
+			case '%':
+				temp[name[1:]] = 3
+			case '@':
+				temp[name[1:]] = 4
+			case '&':
+				temp[name[1:]] = 5
+			case '~':
+				temp[name[1:]] = 6
+			default:
+				temp[name] = 1
 			}
 		}
 	})
 
 	// End of names
 	ircConn.AddCallback("366", func(event *irc.Event) {
-		if event.Arguments[1] == c.Channel {
-			names = tempNames
+		if b := r.ByChannel(event.Arguments[1]); b != nil {
+			channel := strings.ToLower(b.Channel)
+			names[channel] = tempNames[channel]
+			tempNames[channel] = make(map[string]int)
+			// members are looked up before they are mentioned
+			for nick := range names[channel] {
+				lookupNick(nick)
+			}
 		}
 	})
 
 	ircConn.AddCallback("PRIVMSG", func(event *irc.Event) {
-		if event.Arguments[0] == c.Channel {
+		if isEcho(event) || isPuppet(event.Nick) {
+			echoed(event)
+			return
+		}
+		if b := r.ByChannel(event.Arguments[0]); b != nil {
 			if c.IgnoreMap[event.Nick] {
 				return
 			}
+			speakers.Said(b.Name, event.Nick)
 
-			f := formatMessage(event.Nick, event.Message(), "")
-			r.IRCh <- f
+			if f, ok := correct(r, b, event.Nick, event.Message(), eventTime(event)); ok {
+				r.Relay(f)
+				go irchuubase.Log(f, logger)
+				return
+			}
+			f := formatEvent(b, event, event.Message(), "")
+			f.Extra["msgid"] = msgID(event)
+			f.SetMentions(findMentions(f.Text, names[strings.ToLower(b.Channel)]))
+			setReply(r, b, event, f)
+			r.Relay(f)
 			go irchuubase.Log(f, logger)
 			if strings.HasPrefix(event.Message(), c.Nick) {
-				processCmd(event, r, &names)
+				processCmd(event, r, b, names[strings.ToLower(b.Channel)])
 			}
 		} else {
 			logger.Printf("Message from %v: %v\n",
 				event.Nick, event.Message())
-			if names[event.Nick] != 0 {
-				processPMCmd(event, r)
+			if b := findMember(r, names, event.Nick); b != nil {
+				processPMCmd(event, r, b)
 			} else {
 				noticeOrMsg(c.SendNotices, event.Nick,
 					"I work only for my channel members."+
@@ -300,9 +551,15 @@ func Launch(c *config.Irc, wg *sync.WaitGroup, r *relay.Relay) {
 	})
 
 	ircConn.AddCallback("CTCP_ACTION", func(event *irc.Event) {
-		if event.Arguments[0] == c.Channel {
-			f := formatMessage(event.Nick, event.Message(), "ACTION")
-			r.IRCh <- f
+		if isEcho(event) || isPuppet(event.Nick) {
+			return
+		}
+		if b := r.ByChannel(event.Arguments[0]); b != nil {
+			speakers.Said(b.Name, event.Nick)
+			f := formatEvent(b, event, event.Message(), "ACTION")
+			f.Extra["msgid"] = msgID(event)
+			f.SetMentions(findMentions(f.Text, names[strings.ToLower(b.Channel)]))
+			r.Relay(f)
 			go irchuubase.Log(f, logger)
 		} else {
 			logger.Printf("CTCP ACTION from %v: %v\n",
@@ -311,83 +568,139 @@ func Launch(c *config.Irc, wg *sync.WaitGroup, r *relay.Relay) {
 	})
 
 	ircConn.AddCallback("KICK", func(event *irc.Event) {
-		if event.Arguments[0] == c.Channel {
-			f := formatMessage(event.Nick, event.Arguments[1], "KICK")
-			r.IRCh <- f // TODO: kick reasons are not saved
+		if b := r.ByChannel(event.Arguments[0]); b != nil {
+			f := formatEvent(b, event, event.Arguments[1], "KICK")
+			r.Relay(f) // TODO: kick reasons are not saved
 			go irchuubase.Log(f, logger)
-			names[event.Arguments[1]] = 0
+			names[strings.ToLower(b.Channel)][event.Arguments[1]] = 0
 			if event.Arguments[1] == ircConn.GetNick() {
-				stopMsg := relay.Message{Extra: map[string]string{"break": "true"}}
-				stopCmd := relay.ServiceMessage{Command: "break"}
-
-				r.TeleCh <- stopMsg
-				r.TeleServiceCh <- stopCmd
-
-				messageLoopStarted = false
-				serviceLoopStarted = false
+				setJoined(b.Channel, false)
 
 				if c.KickRejoin {
-					ircConn.Join(fmt.Sprintf("%v %v", c.Channel, c.ChanPassword))
+					ircConn.Join(fmt.Sprintf("%v %v", b.Channel, b.ChanPassword))
 				}
 			}
 		}
 	})
 
 	ircConn.AddCallback("NICK", func(event *irc.Event) {
-		f := formatMessage(event.Nick, event.Arguments[0], "NICK")
-		r.IRCh <- f
-		go irchuubase.Log(f, logger)
-		names[event.Arguments[0]] = names[event.Nick]
-		names[event.Nick] = 0
+		if isPuppet(event.Nick) || isPuppet(event.Arguments[0]) {
+			return
+		}
+		for _, b := range r.Bridges() {
+			channelNames := names[strings.ToLower(b.Channel)]
+			if channelNames[event.Nick] == 0 {
+				continue
+			}
+			f := formatEvent(b, event, event.Arguments[0], "NICK")
+			// nick changes are filtered like joins and parts
+			if !c.RelayJoinsParts || speakers.Active(b.Name, event.Nick) {
+				r.Relay(f)
+			}
+			go irchuubase.Log(f, logger)
+			channelNames[event.Arguments[0]] = channelNames[event.Nick]
+			channelNames[event.Nick] = 0
+		}
+		speakers.Rename(event.Nick, event.Arguments[0])
+		setAway(event.Arguments[0], isAway(event.Nick))
+		setAway(event.Nick, false)
 	})
 
 	ircConn.AddCallback("PART", func(event *irc.Event) {
-		if event.Arguments[0] == c.Channel {
+		if b := r.ByChannel(event.Arguments[0]); b != nil && !isPuppet(event.Nick) {
 			var reason string
 			if len(event.Arguments) > 1 {
 				reason = event.Arguments[1]
 			}
-			f := formatMessage(event.Nick, reason, "PART")
-			if c.RelayJoinsParts {
-				r.IRCh <- f
+			f := formatEvent(b, event, reason, "PART")
+			if c.RelayJoinsParts && speakers.Active(b.Name, event.Nick) {
+				joinsParts.Add(f)
 			}
 			go irchuubase.Log(f, logger)
-			names[event.Nick] = 0
+			names[strings.ToLower(b.Channel)][event.Nick] = 0
 		}
 	})
 
 	ircConn.AddCallback("QUIT", func(event *irc.Event) {
+		if puppetQuit(event.Nick) {
+			return
+		}
 		var reason string
 		if len(event.Arguments) > 0 {
 			reason = event.Arguments[0]
 		}
-		f := formatMessage(event.Nick, reason, "QUIT")
-		if c.RelayJoinsParts {
-			r.IRCh <- f
+		for _, b := range r.Bridges() {
+			channelNames := names[strings.ToLower(b.Channel)]
+			if channelNames[event.Nick] == 0 {
+				continue
+			}
+			f := formatEvent(b, event, reason, "QUIT")
+			if !collect(batches, event, "netsplit", b.Name) && c.RelayJoinsParts &&
+				speakers.Active(b.Name, event.Nick) {
+				joinsParts.Add(f)
+			}
+			go irchuubase.Log(f, logger)
+			channelNames[event.Nick] = 0
+		}
+		setAway(event.Nick, false)
+	})
+
+	// Netsplits and netjoins are announced once instead of every QUIT and JOIN
+	ircConn.AddCallback("BATCH", func(event *irc.Event) {
+		openBatch(batches, event)
+		bt := closeBatch(batches, event)
+		if bt == nil || !c.RelayJoinsParts {
+			return
+		}
+		for _, b := range r.Bridges() {
+			if text := bt.announcement(b.Name); text != "" {
+				sendService(r, relay.ServiceMessage{
+					Command:   "announce",
+					Arguments: []string{text},
+					Bridge:    b.Name,
+				})
+			}
 		}
-		go irchuubase.Log(f, logger)
-		names[event.Nick] = 0
+	})
+
+	ircConn.AddCallback("AWAY", func(event *irc.Event) {
+		setAway(event.Nick, len(event.Arguments) != 0)
 	})
 
 	ircConn.AddCallback("MODE", func(event *irc.Event) {
-		if event.Arguments[0] == c.Channel {
-			f := formatMessage(event.Nick, strings.Join(event.Arguments, " "), "MODE")
+		if b := r.ByChannel(event.Arguments[0]); b != nil {
+			f := formatEvent(b, event, strings.Join(event.Arguments, " "), "MODE")
 			if c.RelayModes {
-				r.IRCh <- f
+				r.Relay(f)
 			}
 			go irchuubase.Log(f, logger)
 			if len(event.Arguments) > 2 {
+				channelNames := names[strings.ToLower(b.Channel)]
 				for k, o := range parseMode(event) {
-					names[k] = o
+					channelNames[k] = o
 				}
 			}
 		}
 	})
 
+	// Deleted messages (draft/message-redaction)
+	ircConn.AddCallback("REDACT", func(event *irc.Event) {
+		if len(event.Arguments) < 2 {
+			return
+		}
+		if b := r.ByChannel(event.Arguments[0]); b != nil {
+			sendService(r, relay.ServiceMessage{
+				Command:   "delete",
+				Arguments: []string{event.Arguments[1]},
+				Bridge:    b.Name,
+			})
+		}
+	})
+
 	ircConn.AddCallback("TOPIC", func(event *irc.Event) {
-		if event.Arguments[0] == c.Channel {
-			f := formatMessage(event.Nick, event.Arguments[1], "TOPIC")
-			r.IRCh <- f
+		if b := r.ByChannel(event.Arguments[0]); b != nil {
+			f := formatEvent(b, event, event.Arguments[1], "TOPIC")
+			r.Relay(f)
 			go irchuubase.Log(f, logger)
 		}
 	})
@@ -399,22 +712,194 @@ func Launch(c *config.Irc, wg *sync.WaitGroup, r *relay.Relay) {
 			ircConn.Privmsgf("NickServ", "IDENTIFY %v", c.Password)
 		}
 
-		if c.JoinDelay != 0 {
-			logger.Printf("Waiting %vs before joining the channel...", c.JoinDelay)
-			time.Sleep(time.Duration(c.JoinDelay) * time.Second)
-		}
-		ircConn.Join(fmt.Sprintf("%v %v", c.Channel, c.ChanPassword))
+		joinChannels(r, logger)
 	})
 	/* CALLBACKS END */
 
-	go listenAlways(r)
+	go listenAlways(r, t.always)
+	if c.Puppets {
+		go expirePuppets(time.Duration(c.PuppetIdle)*time.Minute, t.stop)
+	}
 
-	err := ircConn.Connect(fmt.Sprintf("%v:%d", c.Server, c.Port))
-	if err != nil {
-		logger.Fatalf("Cannot connect: %v\n", err)
+	ircConn.Server = fmt.Sprintf("%v:%d", c.Server, c.Port)
+	backoff := relay.NewBackoff(minReconnectDelay, maxReconnectDelay)
+	for {
+		if !t.connect(backoff, logger) {
+			return nil
+		}
+		connected := time.Now()
+		err := <-ircConn.ErrorChan()
+		ircConn.Disconnect()
+		select {
+		case <-t.stop:
+			return nil
+		default:
+		}
+		logger.Printf("Disconnected: %v\n", err)
+
+		// names are requested again after rejoining
+		batches = make(map[string]*batch)
+		for _, b := range r.Bridges() {
+			tempNames[strings.ToLower(b.Channel)] = make(map[string]int)
+		}
+		t.linkLost(r)
+		if time.Since(connected) > maxReconnectDelay {
+			backoff.Reset()
+		}
+	}
+}
+
+// connect connects to the server, retrying with exponential backoff until it
+// succeeds. It returns false if the transport is stopped meanwhile.
+func (t *Transport) connect(backoff *relay.Backoff, logger *log.Logger) bool {
+	for {
+		err := ircConn.Reconnect()
+		if err == nil {
+			setOnline(true)
+			return true
+		}
+		if ircConn.Connected() {
+			// the socket was opened, but the registration failed
+			ircConn.Disconnect()
+		}
+		logger.Printf("Cannot connect: %v, retrying in %v\n", err, backoff.Delay())
+		if !backoff.Wait(t.stop) {
+			return false
+		}
+	}
+}
+
+// linkLost marks all channels as left and tells the other side that messages
+// will be relayed later.
+func (t *Transport) linkLost(r *relay.Router) {
+	setOnline(false)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range r.Bridges() {
+		setJoined(b.Channel, false)
+		if t.lost[b.Name] {
+			continue
+		}
+		t.lost[b.Name] = true
+		sendService(r, relay.ServiceMessage{
+			Command: "announce",
+			Arguments: []string{"IRC link lost, messages will be relayed " +
+				"when it is restored."},
+			Bridge: b.Name,
+		})
+	}
+}
+
+// restored announces that the channel of the bridge is joined again after the
+// link was lost and replays the messages queued meanwhile.
+func (t *Transport) restored(r *relay.Router, b *config.Bridge) {
+	r.Resume(transportName)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.lost[b.Name] {
+		return
+	}
+	delete(t.lost, b.Name)
+	sendService(r, relay.ServiceMessage{
+		Command:   "announce",
+		Arguments: []string{"IRC link restored."},
+		Bridge:    b.Name,
+	})
+}
+
+// safely calls f, which writes to the IRC connection, and returns an error if
+// the connection was closed meanwhile instead of panicking.
+func safely(f func()) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			if re, ok := e.(runtime.Error); ok &&
+				strings.Contains(re.Error(), "closed channel") {
+				err = errors.New("connection lost")
+				return
+			}
+			panic(e)
+		}
+	}()
+	f()
+	return nil
+}
+
+// sendService sends a service message from IRC to other transports.
+func sendService(r *relay.Router, message relay.ServiceMessage) {
+	message.Origin = transportName
+	r.Service(message)
+}
+
+// joinChannels joins the channels of all bridges after the configured delay.
+func joinChannels(r *relay.Router, logger *log.Logger) {
+	if ircConf.JoinDelay != 0 {
+		logger.Printf("Waiting %vs before joining the channels...", ircConf.JoinDelay)
+		time.Sleep(time.Duration(ircConf.JoinDelay) * time.Second)
 	}
+	for _, b := range r.Bridges() {
+		ircConn.Join(fmt.Sprintf("%v %v", b.Channel, b.ChanPassword))
+	}
+}
 
-	ircConn.Loop()
+// setJoined marks the channel as joined or left.
+func setJoined(channel string, joined bool) {
+	joinedMu.Lock()
+	defer joinedMu.Unlock()
+	joinedChannels[strings.ToLower(channel)] = joined
+	if joined {
+		delete(leftChannels, strings.ToLower(channel))
+	} else {
+		leftChannels[strings.ToLower(channel)] = time.Now()
+	}
+}
+
+// isJoined returns true if the bot is on the channel.
+func isJoined(channel string) bool {
+	joinedMu.RLock()
+	defer joinedMu.RUnlock()
+	return joinedChannels[strings.ToLower(channel)]
+}
+
+// notJoinedFor returns how long the bot has been connected but not on the
+// channel.
+func notJoinedFor(channel string) time.Duration {
+	joinedMu.RLock()
+	defer joinedMu.RUnlock()
+	if !online || joinedChannels[strings.ToLower(channel)] {
+		return 0
+	}
+	since := onlineSince
+	if left := leftChannels[strings.ToLower(channel)]; left.After(since) {
+		since = left
+	}
+	return time.Since(since)
+}
+
+// setOnline marks the connection as up or down.
+func setOnline(up bool) {
+	joinedMu.Lock()
+	defer joinedMu.Unlock()
+	online = up
+	if up {
+		onlineSince = time.Now()
+	}
+}
+
+// isOnline returns true if the bot is connected.
+func isOnline() bool {
+	joinedMu.RLock()
+	defer joinedMu.RUnlock()
+	return online
+}
+
+// findMember returns the first bridge whose channel the nick is on or nil.
+func findMember(r *relay.Router, names map[string]map[string]int, nick string) *config.Bridge {
+	for _, b := range r.Bridges() {
+		if names[strings.ToLower(b.Channel)][nick] != 0 {
+			return b
+		}
+	}
+	return nil
 }
 
 // noticeOrMsg sends NOTICE if the second arg is true or PRIVMSG else.
@@ -504,71 +989,102 @@ func parseMode(event *irc.Event) map[string]int {
 	return m
 }
 
-// updateNames tries to update the name list occasionally.
-func updateNames() {
+// updateNames tries to update the name lists occasionally until the
+// transport is stopped.
+func updateNames(r *relay.Router, interval time.Duration, stop chan struct{}) {
 	for {
-		time.Sleep(time.Second * time.Duration(ircConf.NamesUpdateInterval))
-		ircConn.SendRawf("NAMES %v", ircConf.Channel)
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+		for _, b := range r.Bridges() {
+			if isJoined(b.Channel) {
+				safely(func() { ircConn.SendRawf("NAMES %v", b.Channel) })
+			}
+		}
 	}
 }
 
-// relayMessagesToIRC listens to the Telegram channel and sends every message
-// into IRC.
-func relayMessagesToIRC(r *relay.Relay) {
-	for message := range r.TeleCh {
-		if message.Extra["break"] == "true" {
-			break
-		}
-		var messages []string
-		if message.Extra["special"] == "" {
-			messages = formatIRCMessages(message, 0)
-		} else {
-			messages = formatSpecialIRCMessages(message)
+// relayMessageToIRC sends a message into the IRC channel of its bridge. If
+// the server echoes messages, it returns the lines waiting for the echo.
+func relayMessageToIRC(message relay.Message, b *config.Bridge) (echoes []*echo) {
+	var messages []string
+	if message.Extra["special"] == "" {
+		messages = formatIRCMessages(message, b, 0)
+	} else {
+		messages = formatSpecialIRCMessages(message)
+	}
+	for _, m := range messages {
+		if hasCap("echo-message") {
+			echoes = append(echoes, expectEcho(b.Channel, m))
 		}
-		for _, m := range messages {
-			ircConn.Privmsg(ircConf.Channel, m)
-			if ircConf.FloodDelay != 0 {
-				time.Sleep(time.Duration(ircConf.FloodDelay) * time.Millisecond)
-			}
+		ircConn.Privmsg(b.Channel, m)
+		if ircConf.FloodDelay != 0 {
+			time.Sleep(time.Duration(ircConf.FloodDelay) * time.Millisecond)
 		}
 	}
+	return
 }
 
-// listenService listens to service messages and executes them.
-func listenService(r *relay.Relay, names *map[string]int) {
-Loop:
-	for f := range r.TeleServiceCh {
-		switch f.Command {
-		case "break":
-			break Loop
-		case "announce":
-			fallthrough
-		case "bot":
-			if len(f.Arguments) != 0 {
-				ircConn.Privmsg(ircConf.Channel, f.Arguments[0])
-			}
-		case "action":
-			ircConn.Action(ircConf.Channel, f.Arguments[0])
-		case "kick":
-			if len(f.Arguments) == 2 && f.Arguments[0] != ircConn.GetNick() {
-				ircConn.Kick(f.Arguments[0], ircConf.Channel,
-					"by "+f.Arguments[1])
-			}
-		case "ops":
-			ops := "Operators online: "
-			for name, rank := range *names {
-				if rank >= 4 {
-					ops += name + " "
+// listenService listens to service messages and executes them in the channel
+// of their bridge.
+func listenService(r *relay.Router, services chan relay.ServiceMessage, names map[string]map[string]int) {
+	for f := range services {
+		b := r.Bridge(f.Bridge)
+		if b == nil || !isJoined(b.Channel) {
+			continue
+		}
+		safely(func() {
+			switch f.Command {
+			case "announce":
+				fallthrough
+			case "bot":
+				if len(f.Arguments) != 0 {
+					ircConn.Privmsg(b.Channel, f.Arguments[0])
 				}
+			case "action":
+				ircConn.Action(b.Channel, f.Arguments[0])
+			case "pm":
+				// a reply of a Telegram user or a delivery error
+				if len(f.Arguments) < 2 {
+					break
+				}
+				for _, line := range strings.Split(f.Arguments[1], "\n") {
+					if len(f.Arguments) > 2 {
+						line = fmt.Sprintf("\x02@%v\x0f: %v", f.Arguments[2], line)
+					}
+					noticeOrMsg(ircConf.SendNotices, f.Arguments[0],
+						strings.TrimRight(line, "\r"))
+				}
+			case "kick":
+				if len(f.Arguments) == 2 && f.Arguments[0] != ircConn.GetNick() {
+					ircConn.Kick(f.Arguments[0], b.Channel,
+						"by "+f.Arguments[1])
+				}
+			case "ops":
+				ops := "Operators online: "
+				for name, rank := range names[strings.ToLower(b.Channel)] {
+					if rank >= 4 && isAway(name) {
+						ops += name + " (away) "
+					} else if rank >= 4 {
+						ops += name + " "
+					}
+				}
+				sendService(r, relay.ServiceMessage{
+					Command:   "announce",
+					Arguments: []string{ops},
+					Bridge:    b.Name,
+					Target:    f.Origin,
+				})
+			case "invite":
+				if len(f.Arguments) != 0 {
+					ircConn.SendRawf("INVITE %v %v", f.Arguments[0], b.Channel)
+				}
+			case "topic":
+				ircConn.SendRawf("TOPIC %v", b.Channel)
 			}
-			r.IRCServiceCh <- relay.ServiceMessage{"announce", []string{ops}}
-		case "invite":
-			if len(f.Arguments) != 0 {
-				ircConn.SendRawf("INVITE %v %v", f.Arguments[0], ircConf.Channel)
-			}
-		case "topic":
-			ircConn.SendRawf("TOPIC %v", ircConf.Channel)
-		}
+		})
 
 		if ircConf.FloodDelay != 0 {
 			time.Sleep(time.Duration(ircConf.FloodDelay) * time.Millisecond)
@@ -576,57 +1092,68 @@ Loop:
 	}
 }
 
-// listenAlways listens to service messages from TeleAlwaysCh and executes them.
-func listenAlways(r *relay.Relay) {
-	for f := range r.TeleAlwaysCh {
-		switch f.Command {
-		case "shutdown":
-			if irchuubase.IsAvailable() {
-				irchuubase.Close()
-			}
-
-			ircConn.Quit()
-			time.Sleep(time.Second)
-			os.Exit(0)
-		case "status":
-			if !ircConn.Connected() {
-				r.IRCServiceCh <- relay.ServiceMessage{"announce",
-					[]string{"IRC bot is offline."}}
-				break
-			}
-
-			var receivedInfo, inChannel bool
-			text := "IRC bot is online and "
+// listenAlways listens to service messages which must be executed even when
+// the bot is not on channel.
+func listenAlways(r *relay.Router, always chan relay.ServiceMessage) {
+	for f := range always {
+		safely(func() {
+			switch f.Command {
+			case "status":
+				b := r.Bridge(f.Bridge)
+				if b == nil {
+					break
+				}
+				if !isOnline() {
+					sendService(r, relay.ServiceMessage{
+						Command:   "announce",
+						Arguments: []string{"IRC bot is offline."},
+						Bridge:    b.Name,
+						Target:    f.Origin,
+					})
+					break
+				}
 
-			chansCb := ircConn.AddCallback("319", func(event *irc.Event) {
-				for _, v := range event.Arguments {
-					if strings.Trim(v, " ") == ircConf.Channel {
-						inChannel = true
+				var receivedInfo, inChannel bool
+				text := "IRC bot is online and "
+
+				chansCb := ircConn.AddCallback("319", func(event *irc.Event) {
+					for _, v := range event.Arguments {
+						for _, ch := range strings.Fields(v) {
+							// channels may be prefixed with the user's status
+							ch = strings.TrimLeft(ch, "+%@&~")
+							if strings.EqualFold(ch, b.Channel) {
+								inChannel = true
+							}
+						}
 					}
+				})
+
+				endCb := ircConn.AddCallback("318", func(event *irc.Event) {
+					receivedInfo = true
+				})
+
+				ircConn.Whois(ircConn.GetNick())
+				time.Sleep(time.Duration(ircConf.StatusTimeout) * time.Second)
+				ircConn.RemoveCallback("319", chansCb)
+				ircConn.RemoveCallback("318", endCb)
+
+				switch {
+				case inChannel:
+					text += "present in channel."
+				case receivedInfo:
+					text += "(almost certainly) not in channel."
+				case !receivedInfo:
+					text += "unable to determine if it's in channel."
 				}
-			})
-
-			endCb := ircConn.AddCallback("318", func(event *irc.Event) {
-				receivedInfo = true
-			})
 
-			ircConn.Whois(ircConn.GetNick())
-			time.Sleep(time.Duration(ircConf.StatusTimeout) * time.Second)
-			ircConn.RemoveCallback("319", chansCb)
-			ircConn.RemoveCallback("318", endCb)
-
-			switch {
-			case inChannel:
-				text += "present in channel."
-			case receivedInfo:
-				text += "(almost certainly) not in channel."
-			case !receivedInfo:
-				text += "unable to determine if it's in channel."
+				sendService(r, relay.ServiceMessage{
+					Command:   "announce",
+					Arguments: []string{text},
+					Bridge:    b.Name,
+					Target:    f.Origin,
+				})
 			}
-
-			r.IRCServiceCh <- relay.ServiceMessage{"announce",
-				[]string{text}}
-		}
+		})
 
 		if ircConf.FloodDelay != 0 {
 			time.Sleep(time.Duration(ircConf.FloodDelay) * time.Millisecond)
@@ -634,17 +1161,86 @@ func listenAlways(r *relay.Relay) {
 	}
 }
 
+// msgID returns the msgid tag of the event or a new local ID if the server
+// doesn't tag messages.
+func msgID(event *irc.Event) string {
+	if id := event.Tags["msgid"]; id != "" {
+		return id
+	}
+	return "irchuu-" + strconv.FormatInt(atomic.AddInt64(&lastID, 1), 10)
+}
+
+// setReply marks the message as a reply to the message in the +draft/reply
+// tag or to the latest message of the user it is addressed to.
+func setReply(r *relay.Router, b *config.Bridge, event *irc.Event, f relay.Message) {
+	if id := event.Tags["+draft/reply"]; id != "" {
+		f.Extra["replyID"] = id
+		f.Extra["replyOrigin"] = transportName
+	} else if origin, id, ok := r.Index().Addressed(b.Name, f.Text); ok {
+		f.Extra["replyID"] = id
+		f.Extra["replyOrigin"] = origin
+	}
+}
+
+// correct turns an s/foo/bar/ correction into an edit of the previous message
+// of the nick, sent at the date. It returns false if the text is not a
+// correction or there is nothing to correct.
+func correct(r *relay.Router, b *config.Bridge, nick, text string, date time.Time) (relay.Message, bool) {
+	match := correction.FindStringSubmatch(text)
+	if match == nil {
+		return relay.Message{}, false
+	}
+	id, previous, ok := r.Index().Last(b.Name, transportName, nick)
+	if !ok {
+		return relay.Message{}, false
+	}
+	unescape := strings.NewReplacer(`\/`, "/", `\\`, `\`)
+	from, to := unescape.Replace(match[1]), unescape.Replace(match[2])
+	n := 1
+	if match[3] == "g" {
+		n = -1
+	}
+	corrected := strings.Replace(previous, from, to, n)
+	if corrected == previous {
+		return relay.Message{}, false
+	}
+
+	f := formatMessage(b, nick, corrected, "")
+	f.Date = date
+	f.Extra["msgid"] = id
+	f.Extra["edit"] = strconv.FormatInt(f.Date.Unix(), 10)
+	return f, true
+}
+
 // formatIRCMessage translates universal messages into IRC.
-func formatIRCMessages(message relay.Message, prefixLen int) []string {
+func formatIRCMessages(message relay.Message, b *config.Bridge, prefixLen int) []string {
 	var nick string
 
-	if !message.Source {
-		nick = ircConf.Prefix + colorizeNick(message.Nick) + ircConf.Postfix
+	if message.Origin == transportName {
+		nick = b.IRCPrefix + colorizeNick(message.Nick) + b.IRCPostfix
 	} else {
-		nick = ircConf.Prefix + formatNick(message) + ircConf.Postfix
+		nick = b.IRCPrefix + formatNick(message) + b.IRCPostfix
 	}
 	// 512 - 2 for CRLF - 7 for "PRIVMSG" - 4 for spaces - 9 just in case - 50 just in case
-	acceptibleLength := 440 - len(nick) - len(ircConf.Channel) - prefixLen
+	acceptibleLength := 440 - len(nick) - len(b.Channel) - prefixLen
+
+	return splitLines(formatIRCText(message), acceptibleLength, nick+" ")
+}
+
+// formatPuppetMessages translates universal messages into IRC lines sent by
+// the puppet with the nick, without the nick of the sender.
+func formatPuppetMessages(message relay.Message, b *config.Bridge, nick string) []string {
+	// the server prefixes the lines with the nick of the puppet
+	acceptibleLength := 440 - len(nick) - len(b.Channel)
+	return splitLines(formatIRCText(message), acceptibleLength, "")
+}
+
+// formatIRCText translates the text of a universal message into IRC.
+func formatIRCText(message relay.Message) string {
+	message = translateMentions(message)
+	if message.Extra["edit"] != "" && message.Extra["original"] != "" {
+		message.Text = diff(message.Extra["original"], message.Text)
+	}
 
 	if ircConf.Ellipsis != "" {
 		message.Text = strings.Replace(message.Text, "\n", ircConf.Ellipsis, -1)
@@ -674,9 +1270,59 @@ func formatIRCMessages(message relay.Message, prefixLen int) []string {
 	if message.Extra["media"] != "" {
 		message.Text = formatMediaMessage(message)
 	}
+	return message.Text
+}
+
+// diffContext is the number of unchanged words shown around a change.
+const diffContext = 2
+
+// diff shows the change of an edited text compactly: the removed words are
+// red and struck through, the added ones are green. It returns the new text
+// if the diff is not shorter.
+func diff(before, after string) string {
+	o, n := strings.Fields(before), strings.Fields(after)
+	prefix := 0
+	for prefix < len(o) && prefix < len(n) && o[prefix] == n[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(o)-prefix && suffix < len(n)-prefix &&
+		o[len(o)-1-suffix] == n[len(n)-1-suffix] {
+		suffix++
+	}
+	removed := o[prefix : len(o)-suffix]
+	added := n[prefix : len(n)-suffix]
+	if len(removed) == 0 && len(added) == 0 {
+		return after
+	}
+
+	var parts []string
+	start := prefix - diffContext
+	if start > 0 {
+		parts = append(parts, "…")
+	} else {
+		start = 0
+	}
+	parts = append(parts, n[start:prefix]...)
+	if len(removed) != 0 {
+		parts = append(parts, "\x0304\x1e"+strings.Join(removed, " ")+"\x0f")
+	}
+	if len(added) != 0 {
+		parts = append(parts, "\x0303"+strings.Join(added, " ")+"\x0f")
+	}
+	end := len(n) - suffix + diffContext
+	if end < len(n) {
+		parts = append(parts, n[len(n)-suffix:end]...)
+		parts = append(parts, "…")
+	} else {
+		parts = append(parts, n[len(n)-suffix:]...)
+	}
 
-	messages := splitLines(message.Text, acceptibleLength, nick+" ")
-	return messages
+	result := strings.Join(parts, " ")
+	if len(relay.StripFormatting(result)) >= len(after) {
+		return after
+	}
+	return result
 }
 
 // formatMediaMessage formats media messages.
@@ -716,6 +1362,12 @@ func formatMediaMessage(message relay.Message) string {
 		text += fmt.Sprintf("(%v, %vs, %viB)",
 			message.Extra["media"], message.Extra["duration"],
 			size)
+	case "album":
+		if message.Extra["album"] != "" {
+			text += fmt.Sprintf("(album: %v)", message.Extra["album"])
+		} else {
+			text += fmt.Sprintf("(album, %v items)", message.Extra["items"])
+		}
 	}
 	return text
 }
@@ -773,8 +1425,23 @@ func formatSpecialIRCMessages(message relay.Message) (messages []string) {
 			colorizeNick(message.Nick))}
 	case "NICK":
 		messages = []string{fmt.Sprintf("%v is now known as %v.",
-			colorizeNick(message.Text),
+			colorizeNick(message.Nick),
+			colorizeNick(message.Text))}
+	case "JOIN":
+		messages = []string{fmt.Sprintf("%v has joined.",
 			colorizeNick(message.Nick))}
+	case "PART", "QUIT":
+		verb := "left"
+		if message.Extra["special"] == "QUIT" {
+			verb = "quit"
+		}
+		if message.Text == "" {
+			messages = []string{fmt.Sprintf("%v has %v.",
+				colorizeNick(message.Nick), verb)}
+		} else {
+			messages = []string{fmt.Sprintf("%v has %v: %v.",
+				colorizeNick(message.Nick), verb, message.Text)}
+		}
 	case "TOPIC":
 		messages = []string{fmt.Sprintf("%v set the topic to \"%v\".",
 			colorizeNick(message.Nick), message.Text)}
@@ -785,8 +1452,8 @@ func formatSpecialIRCMessages(message relay.Message) (messages []string) {
 	return
 }
 
-// processCmd executes commands.
-func processCmd(event *irc.Event, r *relay.Relay, names *map[string]int) {
+// processCmd executes commands sent in the channel of the bridge.
+func processCmd(event *irc.Event, r *relay.Router, b *config.Bridge, names map[string]int) {
 	cmd := strings.SplitN(event.Message(), " ", 3)
 	if len(cmd) < 2 {
 		return
@@ -808,7 +1475,7 @@ func processCmd(event *irc.Event, r *relay.Relay, names *map[string]int) {
 		if irchuubase.IsAvailable() {
 			texts[4] = ircConf.Nick +
 				" \x02hist [n]\x0f — get [n] last messages in PM"
-			if ircConf.Moderation {
+			if b.IRCModeration {
 				texts[5] = ircConf.Nick +
 					" \x02kick [nick || full name]\x0f —" +
 					" kick a user from the Telegram group"
@@ -818,7 +1485,7 @@ func processCmd(event *irc.Event, r *relay.Relay, names *map[string]int) {
 		}
 		for _, text := range texts {
 			if text != "" {
-				ircConn.Privmsg(ircConf.Channel, text)
+				ircConn.Privmsg(b.Channel, text)
 				if ircConf.FloodDelay != 0 {
 					time.Sleep(time.Duration(ircConf.FloodDelay) * time.Millisecond)
 				}
@@ -830,72 +1497,85 @@ func processCmd(event *irc.Event, r *relay.Relay, names *map[string]int) {
 			if len(cmd) > 2 && cmd[2] != "" {
 				n, _ = strconv.Atoi(cmd[2])
 			}
-			go sendHistory(event.Nick, n)
+			go safely(func() { sendHistory(event.Nick, b, n) })
 		}
 	case "kick":
-		if ircConf.Moderation && irchuubase.IsAvailable() && len(cmd) > 2 {
-			if (*names)[event.Nick] >= ircConf.KickPermission {
-				modifyUser(r, cmd[2], ircConf.Channel, false)
+		if b.IRCModeration && irchuubase.IsAvailable() && len(cmd) > 2 {
+			if names[event.Nick] >= b.KickPermission {
+				modifyUser(r, cmd[2], b, false)
 			} else {
-				ircConn.Privmsg(ircConf.Channel, "Insufficient permission.")
+				ircConn.Privmsg(b.Channel, "Insufficient permission.")
 			}
 		}
 	case "ops":
-		r.IRCServiceCh <- relay.ServiceMessage{"ops", nil}
+		sendService(r, relay.ServiceMessage{Command: "ops", Bridge: b.Name})
 	case "sticker":
 		if ircConf.AllowStickers && len(cmd) > 2 {
 			time.Sleep(time.Duration(50) * time.Millisecond)
-			r.IRCServiceCh <- relay.ServiceMessage{"sticker", []string{cmd[2]}}
+			sendService(r, relay.ServiceMessage{
+				Command:   "sticker",
+				Arguments: []string{cmd[2]},
+				Bridge:    b.Name,
+			})
 		}
 	case "count":
-		r.IRCServiceCh <- relay.ServiceMessage{"count", nil}
+		sendService(r, relay.ServiceMessage{Command: "count", Bridge: b.Name})
 	case "unban":
-		if ircConf.Moderation && irchuubase.IsAvailable() && len(cmd) > 2 {
-			if (*names)[event.Nick] >= ircConf.KickPermission {
-				modifyUser(r, cmd[2], ircConf.Channel, true)
+		if b.IRCModeration && irchuubase.IsAvailable() && len(cmd) > 2 {
+			if names[event.Nick] >= b.KickPermission {
+				modifyUser(r, cmd[2], b, true)
 			} else {
-				ircConn.Privmsg(ircConf.Channel, "Insufficient permission.")
+				ircConn.Privmsg(b.Channel, "Insufficient permission.")
 			}
 		}
 	case "status":
-		r.IRCServiceCh <- relay.ServiceMessage{"status", nil}
+		sendService(r, relay.ServiceMessage{Command: "status", Bridge: b.Name})
 	}
 }
 
-// modifyUser kicks a Telegram user from the groupchat or unbans them. Mode true
-// unbans, mode false kicks.
-func modifyUser(r *relay.Relay, name, channel string, mode bool) {
+// modifyUser kicks a Telegram user from the group of the bridge or unbans
+// them. Mode true unbans, mode false kicks.
+func modifyUser(r *relay.Router, name string, b *config.Bridge, mode bool) {
 	id, foundName, err := irchuubase.FindUser(name)
 	if err == sql.ErrNoRows {
-		ircConn.Privmsg(channel, "No such user.")
+		ircConn.Privmsg(b.Channel, "No such user.")
 		return
 	} else if err != nil {
-		ircConn.Privmsg(channel, "An error occurred.")
+		ircConn.Privmsg(b.Channel, "An error occurred.")
 		return
 	}
+	command := "kick"
 	if mode {
-		r.IRCServiceCh <- relay.ServiceMessage{"unban", []string{strconv.Itoa(id), foundName}}
-	} else {
-		r.IRCServiceCh <- relay.ServiceMessage{"kick", []string{strconv.Itoa(id), foundName}}
+		command = "unban"
 	}
+	sendService(r, relay.ServiceMessage{
+		Command:   command,
+		Arguments: []string{strconv.Itoa(id), foundName},
+		Bridge:    b.Name,
+	})
 }
 
-// processPMCmd executes commands sent in private.
-func processPMCmd(event *irc.Event, r *relay.Relay) {
+// processPMCmd executes commands sent in private. b is the bridge of a
+// channel the sender is on.
+func processPMCmd(event *irc.Event, r *relay.Router, b *config.Bridge) {
 	cmd := strings.Split(event.Message(), " ")
 	if len(cmd) < 1 {
 		return
 	}
 	switch cmd[0] {
 	case "help":
-		texts := make([]string, 5)
+		texts := make([]string, 7)
 		texts[0] = "Available commands:"
 		texts[1] = "\x02help\x0f — show this help"
-		texts[3] = "\x02/ctcp " + ircConn.GetNick() +
+		texts[5] = "\x02/ctcp " + ircConn.GetNick() +
 			" version\x0f — get version info"
-		texts[4] = "More commands are available in the channel."
+		texts[6] = "More commands are available in the channel."
 		if irchuubase.IsAvailable() {
 			texts[2] = "\x02hist [n]\x0f — get [n] last messages"
+			texts[3] = "\x02@username text\x0f — send a private message " +
+				"to a Telegram user"
+			texts[4] = "\x02link <code>\x0f — link your NickServ account " +
+				"to your Telegram account"
 		}
 		for _, text := range texts {
 			if text != "" {
@@ -905,29 +1585,67 @@ func processPMCmd(event *irc.Event, r *relay.Relay) {
 				}
 			}
 		}
+	case "link":
+		if !irchuubase.IsAvailable() || len(cmd) < 2 {
+			noticeOrMsg(ircConf.SendNotices, event.Nick, "Send /link to the "+
+				"Telegram bot privately to get a code, then \x02link <code>\x0f here.")
+			return
+		}
+		go safely(func() { link(event.Nick, event.Tags["account"], cmd[1], r, b) })
 	case "hist":
 		if irchuubase.IsAvailable() {
 			var n int
 			if len(cmd) > 1 && cmd[1] != "" {
 				n, _ = strconv.Atoi(cmd[1])
 			}
-			go sendHistory(event.Nick, n)
+			go safely(func() { sendHistory(event.Nick, b, n) })
 		}
 	default:
+		if strings.HasPrefix(cmd[0], "@") && len(cmd) > 1 {
+			text := strings.SplitN(event.Message(), " ", 2)[1]
+			sendPM(event.Nick, r, b, cmd[0][1:], text)
+			return
+		}
 		noticeOrMsg(ircConf.SendNotices, event.Nick, "No such command. Enter"+
 			" \x02help\x0f for the list of commands.")
 	}
 }
 
-// sendHistory retrieves the message history from DB and sends it to <nick>.
-func sendHistory(nick string, n int) {
+// sendPM forwards a private message of the IRC user to the Telegram user with
+// the username.
+func sendPM(nick string, r *relay.Router, b *config.Bridge, username, text string) {
+	if !irchuubase.IsAvailable() {
+		noticeOrMsg(ircConf.SendNotices, nick,
+			"Private messages work only with a database configured.")
+		return
+	}
+	id, _, err := irchuubase.FindUser(username)
+	if err == sql.ErrNoRows {
+		noticeOrMsgf(ircConf.SendNotices, nick,
+			"There is no Telegram user \x02@%v\x0f in the group.", username)
+		return
+	} else if err != nil {
+		noticeOrMsgf(ircConf.SendNotices, nick, "An error occurred: %v", err)
+		return
+	}
+	sendService(r, relay.ServiceMessage{
+		Command:   "pm",
+		Arguments: []string{strconv.Itoa(id), nick, text},
+		Bridge:    b.Name,
+		Target:    "telegram",
+	})
+}
+
+// sendHistory retrieves the message history of the bridge from DB and sends
+// it to <nick>.
+func sendHistory(nick string, b *config.Bridge, n int) {
 	if n == 0 || n > ircConf.MaxHist {
 		n = ircConf.MaxHist
 	}
 	var msgs []relay.Message
-	msgs, err := irchuubase.GetMessages(n)
+	msgs, err := irchuubase.GetMessages(b.Name, n)
 	if err != nil {
-		ircConn.Privmsgf(ircConf.Channel, "%v: an error occurred during your request.",
+		ircConn.Privmsgf(b.Channel, "%v: an error occurred during your request.",
 			nick)
 		return
 	}
@@ -937,7 +1655,7 @@ func sendHistory(nick string, n int) {
 		date := "[\x0310" + msg.Date.Format("15:04:05") + "\x0f] "
 		var rawMsgs []string
 		if msg.Extra["special"] == "" {
-			rawMsgs = formatIRCMessages(msg, 14)
+			rawMsgs = formatIRCMessages(msg, b, 14)
 		} else {
 			rawMsgs = formatSpecialIRCMessages(msg)
 		}
@@ -951,6 +1669,7 @@ func sendHistory(nick string, n int) {
 }
 
 // splitLines splits Unicode lines so that they are not longer than max bytes.
+// Formatting which spans several lines is turned on again on each of them.
 func splitLines(text string, max int, prefix string) []string {
 	var lines []string
 	size := 0
@@ -958,12 +1677,12 @@ func splitLines(text string, max int, prefix string) []string {
 	for len(text) > 0 {
 		r, s := utf8.DecodeRuneInString(text)
 		if r == '\n' {
-			lines = append(lines, prefix+string(runes))
+			lines = append(lines, string(runes))
 			runes = nil
 			size = 0
 			text = text[s:]
 		} else if size+s > max {
-			lines = append(lines, prefix+string(runes))
+			lines = append(lines, string(runes))
 			runes = nil
 			size = 0
 		} else {
@@ -972,10 +1691,59 @@ func splitLines(text string, max int, prefix string) []string {
 			text = text[s:]
 		}
 	}
-	lines = append(lines, prefix+string(runes))
+	lines = append(lines, string(runes))
+
+	var open string
+	for i, line := range lines {
+		lines[i] = prefix + open + line
+		open = activeFormatting(open + line)
+	}
 	return lines
 }
 
+// ircColor matches IRC colour codes.
+var ircColor = regexp.MustCompile("^\x03(?:(\\d{1,2})(?:,(\\d{1,2}))?)?")
+
+// activeFormatting returns the IRC codes which turn on the formatting still
+// active at the end of the line.
+func activeFormatting(line string) string {
+	toggles := "\x02\x1d\x1f\x1e\x11\x16"
+	on := make(map[rune]bool)
+	var fg, bg string
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case c == '\x0f':
+			on = make(map[rune]bool)
+			fg, bg = "", ""
+		case c == '\x03':
+			m := ircColor.FindStringSubmatch(line[i:])
+			fg = m[1]
+			if fg == "" {
+				bg = ""
+			} else if m[2] != "" {
+				bg = m[2]
+			}
+			i += len(m[0]) - 1
+		case strings.IndexByte(toggles, c) >= 0:
+			on[rune(c)] = !on[rune(c)]
+		}
+	}
+	var codes string
+	for _, c := range toggles {
+		if on[c] {
+			codes += string(c)
+		}
+	}
+	// two digits, so the colour does not take digits from the text
+	if fg != "" {
+		codes += fmt.Sprintf("\x03%02s", fg)
+		if bg != "" {
+			codes += fmt.Sprintf(",%02s", bg)
+		}
+	}
+	return codes
+}
+
 // formatNick processes nicknames.
 func formatNick(message relay.Message) string {
 	nick := message.Name()
@@ -990,18 +1758,22 @@ func formatNick(message relay.Message) string {
 		nick = colorizeNick(nick)
 	}
 
-	nick = "@" + nick
+	// Telegram nicknames are usernames
+	if message.Origin == "telegram" {
+		nick = "@" + nick
+	}
 	return nick
 }
 
 // formatMessage creates a Message in the universal format of an IRC message.
-func formatMessage(nick string, text string, action string) relay.Message {
+func formatMessage(b *config.Bridge, nick string, text string, action string) relay.Message {
 	extra := make(map[string]string)
 	extra["special"] = action
 
 	return relay.Message{
 		Date:   time.Now(),
-		Source: false,
+		Origin: transportName,
+		Bridge: b.Name,
 		Nick:   nick,
 		Text:   text,
 		Extra:  extra,
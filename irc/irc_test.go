@@ -1,6 +1,11 @@
 package irchuu
 
 import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -8,6 +13,7 @@ import (
 	"github.com/26000/irchuu/relay"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/thoj/go-ircevent"
 )
 
 var (
@@ -75,7 +81,7 @@ var (
 	testMessages = []*relay.Message{
 		&relay.Message{
 			Date:   centralTime,
-			Source: false,
+			Origin: "irc",
 			Nick:   "irchuu",
 			Text:   "konnichiha!",
 
@@ -130,3 +136,525 @@ func TestDjb2(t *testing.T) {
 		assert.Equal(k, djb2(i))
 	}
 }
+
+// fakeServer is an IRC server which lets the bot join any channel and records
+// messages sent to it.
+type fakeServer struct {
+	listener net.Listener
+	conns    chan net.Conn
+	sent     chan string
+	caps     string            // advertised capabilities
+	onJoin   []string          // lines sent after the bot joins
+	accounts map[string]string // NickServ accounts by nicks
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{listener: l, conns: make(chan net.Conn, 10),
+		sent: make(chan string, 10)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(c net.Conn) {
+	defer c.Close()
+	var nick string
+	var echo bool
+	n := 0
+	scanner := bufio.NewScanner(c)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "NICK":
+			nick = fields[1]
+			fmt.Fprintf(c, ":irc.example.org 001 %v :Welcome\r\n", nick)
+		case "CAP":
+			if fields[1] == "LS" && s.caps != "" {
+				fmt.Fprintf(c, ":irc.example.org CAP %v LS :%v\r\n", nick, s.caps)
+			} else if fields[1] == "REQ" {
+				caps := strings.TrimPrefix(strings.Join(fields[2:], " "), ":")
+				echo = strings.Contains(caps, "echo-message")
+				fmt.Fprintf(c, ":irc.example.org CAP %v ACK :%v\r\n", nick, caps)
+			}
+		case "JOIN":
+			fmt.Fprintf(c, ":%v!irchuu@example.org JOIN %v\r\n", nick, fields[1])
+			for _, line := range s.onJoin {
+				fmt.Fprint(c, line+"\r\n")
+			}
+			s.conns <- c
+		case "WHOIS":
+			if account := s.accounts[fields[1]]; account != "" {
+				fmt.Fprintf(c, ":irc.example.org 330 %v %v %v :is logged in as\r\n",
+					nick, fields[1], account)
+			}
+			fmt.Fprintf(c, ":irc.example.org 318 %v %v :End of /WHOIS list.\r\n",
+				nick, fields[1])
+		case "QUIT":
+			fmt.Fprint(c, "ERROR :Closing link\r\n")
+			return
+		case "PRIVMSG":
+			if echo {
+				n++
+				fmt.Fprintf(c, "@msgid=echo%d :%v!irchuu@example.org %v\r\n",
+					n, nick, scanner.Text())
+			}
+			s.sent <- nick + " " + scanner.Text()
+		}
+	}
+}
+
+// recorder is a transport which records messages sent to it.
+type recorder struct {
+	messages chan relay.Message
+	services chan relay.ServiceMessage
+	stop     chan struct{}
+}
+
+// newRecorder creates a recorder.
+func newRecorder() *recorder {
+	return &recorder{messages: make(chan relay.Message, 10),
+		services: make(chan relay.ServiceMessage, 10),
+		stop:     make(chan struct{})}
+}
+
+func (t *recorder) Name() string { return "telegram" }
+func (t *recorder) Start(r *relay.Router) error {
+	<-t.stop
+	return nil
+}
+func (t *recorder) Stop() error {
+	close(t.stop)
+	return nil
+}
+func (t *recorder) Send(message relay.Message) error {
+	t.messages <- message
+	return nil
+}
+func (t *recorder) Health() error { return nil }
+func (t *recorder) SendService(m relay.ServiceMessage) error {
+	t.services <- m
+	return nil
+}
+
+func TestTransport_Reconnect(t *testing.T) {
+	assert := assert.New(t)
+	s := newFakeServer(t)
+	defer s.listener.Close()
+
+	addr := s.listener.Addr().(*net.TCPAddr)
+	c := &config.Irc{Server: "127.0.0.1", Port: uint16(addr.Port),
+		Nick: "irchuu", Prefix: "<", Postfix: ">", MaxLength: 24,
+		NamesUpdateInterval: 300}
+	bridges := []*config.Bridge{&config.Bridge{Name: "irchuu",
+		Channel: "#irchuu"}}
+	r := relay.NewRouter(bridges)
+	rec := newRecorder()
+	r.Add(rec)
+	r.Add(NewTransport(c))
+	done := make(chan error)
+	go func() { done <- r.Start() }()
+	// the transport uses package state, so the next test waits for it
+	defer func() {
+		r.Stop()
+		<-done
+	}()
+
+	announcement := func() string {
+		select {
+		case m := <-rec.services:
+			assert.Equal("announce", m.Command)
+			assert.Equal("irchuu", m.Bridge)
+			return m.Arguments[0]
+		case <-time.After(5 * time.Second):
+			t.Fatal("no announcement")
+		}
+		return ""
+	}
+
+	// the server drops the first connection after the bot joins
+	(<-s.conns).Close()
+	assert.Equal("IRC link lost, messages will be relayed when it is "+
+		"restored.", announcement())
+	r.Relay(relay.Message{Origin: "telegram", Bridge: "irchuu", Nick: "nick",
+		Text: "hi", Date: time.Now()})
+
+	<-s.conns
+	assert.Equal("IRC link restored.", announcement())
+	select {
+	case m := <-s.sent:
+		assert.Contains(m, "PRIVMSG #irchuu :")
+		assert.Contains(m, "hi")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message was not replayed")
+	}
+}
+
+func TestTransport_SendNotJoined(t *testing.T) {
+	assert := assert.New(t)
+	tr := NewTransport(&config.Irc{})
+	tr.bridges = []*config.Bridge{{Name: "a", Channel: "#banned"}}
+	joinedMu.Lock()
+	delete(leftChannels, "#banned")
+	joinedMu.Unlock()
+	setOnline(true)
+	defer setOnline(false)
+
+	// the channel may be joined soon
+	err := tr.Send(relay.Message{Bridge: "a", Text: "hi"})
+	assert.EqualError(err, "not on #banned")
+	assert.False(relay.IsPermanent(err))
+
+	// but not after so long, so the message does not hold up the others
+	joinedMu.Lock()
+	onlineSince = time.Now().Add(-maxJoinWait - time.Minute)
+	joinedMu.Unlock()
+	err = tr.Send(relay.Message{Bridge: "a", Text: "hi"})
+	assert.True(relay.IsPermanent(err))
+	setJoined("#banned", false)
+	assert.False(relay.IsPermanent(tr.Send(relay.Message{Bridge: "a", Text: "hi"})))
+}
+
+func TestDiff(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("… very quick \x0304\x1ebrown\x0f \x0303red\x0f fox jumps …",
+		diff("the very quick brown fox jumps over the dog",
+			"the very quick red fox jumps over the dog"))
+	assert.Equal("quick brown \x03032\x0f foxes jump …",
+		diff("quick brown foxes jump over the lazy dog",
+			"quick brown 2 foxes jump over the lazy dog"))
+	// short texts are shown completely
+	assert.Equal("hello!", diff("hello", "hello!"))
+	assert.Equal("same  text", diff("same text", "same  text"))
+}
+
+func TestSplitLines(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal([]string{"> \x11a := 1", "> \x11b := 2\x0f done"},
+		splitLines("\x11a := 1\nb := 2\x0f done", 100, "> "))
+	assert.Equal([]string{"\x02\x034,1bold", "\x02\x0304,01red\x03 2"},
+		splitLines("\x02\x034,1bold\nred\x03 2", 100, ""))
+	assert.Equal([]string{"\x1fabc", "\x1fdef"}, splitLines("\x1fabcdef", 4, ""))
+	assert.Equal([]string{"plain", "text"}, splitLines("plain\ntext", 100, ""))
+}
+
+func TestFormatMediaMessage(t *testing.T) {
+	assert := assert.New(t)
+	album := relay.Message{Text: "trip", Extra: map[string]string{"media": "album",
+		"album": "https://a.org/1.jpg https://a.org/2.jpg", "items": "2"}}
+	assert.Equal("trip (album: https://a.org/1.jpg https://a.org/2.jpg)",
+		formatMediaMessage(album))
+	album.Extra["album"] = ""
+	assert.Equal("trip (album, 2 items)", formatMediaMessage(album))
+}
+
+func TestFormatSpecialIRCMessages(t *testing.T) {
+	assert := assert.New(t)
+	ircConf = &config.Irc{}
+	special := func(nick, text, special string) []string {
+		return formatSpecialIRCMessages(relay.Message{Origin: "xmpp", Nick: nick,
+			Text: text, Extra: map[string]string{"special": special}})
+	}
+	assert.Equal([]string{"alice is now known as alice2."},
+		special("alice", "alice2", "NICK"))
+	assert.Equal([]string{"bob has joined."}, special("bob", "", "JOIN"))
+	assert.Equal([]string{"bob has left."}, special("bob", "", "PART"))
+	assert.Equal([]string{"bob has left: bye."}, special("bob", "bye", "PART"))
+}
+
+func TestCorrect(t *testing.T) {
+	assert := assert.New(t)
+	b := &config.Bridge{Name: "irchuu", Channel: "#irchuu"}
+	r := relay.NewRouter([]*config.Bridge{b})
+	date := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	_, ok := correct(r, b, "nick", "s/a/b/", date)
+	assert.False(ok)
+
+	m := formatMessage(b, "nick", "a/b a/b", "")
+	m.Extra["msgid"] = "1"
+	r.Relay(m)
+	m = formatMessage(b, "other", "a/b", "")
+	m.Extra["msgid"] = "2"
+	r.Relay(m)
+
+	f, ok := correct(r, b, "nick", `s/a\/b/c/`, date)
+	assert.True(ok)
+	assert.Equal("c a/b", f.Text)
+	assert.Equal("1", f.Extra["msgid"])
+	// the edit is dated by the server time of the correction
+	assert.Equal(date, f.Date)
+	assert.Equal(strconv.FormatInt(date.Unix(), 10), f.Extra["edit"])
+
+	f, ok = correct(r, b, "nick", `s/a\/b/c/g`, date)
+	assert.True(ok)
+	assert.Equal("c c", f.Text)
+
+	_, ok = correct(r, b, "nick", "s/x/y/", date)
+	assert.False(ok)
+	_, ok = correct(r, b, "nick", "just text", date)
+	assert.False(ok)
+}
+
+func TestSetReply(t *testing.T) {
+	assert := assert.New(t)
+	b := &config.Bridge{Name: "irchuu", Channel: "#irchuu"}
+	r := relay.NewRouter([]*config.Bridge{b})
+	r.Relay(relay.Message{Origin: "telegram", Bridge: "irchuu", ID: 42,
+		Nick: "tguser", Text: "hello"})
+
+	f := formatMessage(b, "nick", "@tguser hi", "")
+	setReply(r, b, &irc.Event{}, f)
+	assert.Equal("42", f.Extra["replyID"])
+	assert.Equal("telegram", f.Extra["replyOrigin"])
+
+	f = formatMessage(b, "nick", "tguser: hi", "")
+	setReply(r, b, &irc.Event{Tags: map[string]string{"+draft/reply": "abc"}}, f)
+	assert.Equal("abc", f.Extra["replyID"])
+	assert.Equal("irc", f.Extra["replyOrigin"])
+
+	f = formatMessage(b, "nick", "hi everyone", "")
+	setReply(r, b, &irc.Event{}, f)
+	assert.Empty(f.Extra["replyID"])
+}
+
+func TestTransport_IRCv3(t *testing.T) {
+	assert := assert.New(t)
+	s := newFakeServer(t)
+	defer s.listener.Close()
+	s.caps = "sasl server-time message-tags echo-message batch"
+	s.onJoin = []string{
+		":irc.example.org 353 irchuu = #irchuu :irchuu alice bob",
+		":irc.example.org 366 irchuu #irchuu :End of /NAMES list.",
+		"@time=2016-11-03T12:41:15.000Z;msgid=m1 :alice!a@example.org PRIVMSG #irchuu :hi",
+		":irc.example.org BATCH +split netsplit hub.example.org leaf.example.org",
+		"@batch=split :alice!a@example.org QUIT :hub.example.org leaf.example.org",
+		"@batch=split :bob!b@example.org QUIT :hub.example.org leaf.example.org",
+		":irc.example.org BATCH -split",
+	}
+
+	addr := s.listener.Addr().(*net.TCPAddr)
+	c := &config.Irc{Server: "127.0.0.1", Port: uint16(addr.Port),
+		Nick: "irchuu", Prefix: "<", Postfix: ">", MaxLength: 24,
+		NamesUpdateInterval: 300, RelayJoinsParts: true}
+	bridges := []*config.Bridge{&config.Bridge{Name: "irchuu",
+		Channel: "#irchuu"}}
+	r := relay.NewRouter(bridges)
+	rec := newRecorder()
+	r.Add(rec)
+	r.Add(NewTransport(c))
+	done := make(chan error)
+	go func() { done <- r.Start() }()
+	// the transport uses package state, so the next test waits for it
+	defer func() {
+		r.Stop()
+		<-done
+	}()
+
+	select {
+	case m := <-rec.messages:
+		assert.Equal("alice", m.Nick)
+		assert.Equal("m1", m.Extra["msgid"])
+		assert.Equal(time.Date(2016, 11, 3, 12, 41, 15, 0, time.UTC), m.Date.UTC())
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	select {
+	case m := <-rec.services:
+		assert.Equal("Netsplit between hub.example.org and leaf.example.org, "+
+			"quit: alice, bob.", m.Arguments[0])
+	case <-time.After(5 * time.Second):
+		t.Fatal("the netsplit was not announced")
+	}
+	select {
+	case m := <-rec.messages:
+		t.Fatalf("unexpected message: %v", m)
+	default:
+	}
+
+	// the echoed line is remembered as the copy of the message
+	assert.Eventually(func() bool { return hasCap("echo-message") },
+		5*time.Second, 10*time.Millisecond)
+	message := relay.Message{Origin: "telegram", Bridge: "irchuu", ID: 42,
+		Nick: "nick", Text: "hello", Date: time.Now()}
+	r.Relay(message)
+	<-s.sent
+	assert.Eventually(func() bool {
+		id, _ := r.Index().Copy("irchuu", "telegram", "42", "irc")
+		return id == "echo1"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestBatch_Announcement(t *testing.T) {
+	assert := assert.New(t)
+	bt := &batch{kind: "netjoin", servers: []string{"a", "b"},
+		nicks: map[string][]string{"irchuu": []string{"alice", "bob"}}}
+	assert.Equal("Netsplit between a and b is over, returned: alice, bob.",
+		bt.announcement("irchuu"))
+	assert.Equal("", bt.announcement("koto"))
+
+	bt.kind, bt.servers = "netsplit", nil
+	for i := 0; i < relay.MaxListedNicks; i++ {
+		bt.nicks["irchuu"] = append(bt.nicks["irchuu"], "x")
+	}
+	assert.Equal("Netsplit, quit: alice, bob, x, x, x, x, x, x, x, x and 2 more.",
+		bt.announcement("irchuu"))
+}
+
+func TestTransport_Puppets(t *testing.T) {
+	assert := assert.New(t)
+	s := newFakeServer(t)
+	defer s.listener.Close()
+
+	addr := s.listener.Addr().(*net.TCPAddr)
+	c := &config.Irc{Server: "127.0.0.1", Port: uint16(addr.Port),
+		Nick: "irchuu", Prefix: "<", Postfix: ">", MaxLength: 24,
+		NamesUpdateInterval: 300, Puppets: true, PuppetSuffix: "[tg]",
+		PuppetIdle: 60}
+	bridges := []*config.Bridge{&config.Bridge{Name: "irchuu",
+		Channel: "#irchuu"}}
+	r := relay.NewRouter(bridges)
+	r.Add(newRecorder())
+	r.Add(NewTransport(c))
+	done := make(chan error)
+	go func() { done <- r.Start() }()
+	defer func() {
+		r.Stop()
+		<-done
+		// puppets quit with the transport
+		assert.Eventually(func() bool { return puppetNickOf(7) == "" },
+			5*time.Second, 10*time.Millisecond)
+		// its nick is taken for a puppet until the bot sees the QUIT
+		assert.True(isPuppet("alice[tg]"))
+		assert.True(puppetQuit("Alice[tg]"))
+		assert.False(isPuppet("alice[tg]"))
+	}()
+	<-s.conns
+
+	for _, text := range []string{"hello", "again"} {
+		r.Relay(relay.Message{Origin: "telegram", Bridge: "irchuu", FromID: 7,
+			Nick: "alice", Text: text, Date: time.Now()})
+		select {
+		case m := <-s.sent:
+			assert.Equal("alice[tg] PRIVMSG #irchuu :"+text, m)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the puppet did not send the message")
+		}
+	}
+	assert.True(isPuppet("Alice[tg]"))
+	assert.False(isPuppet("irchuu"))
+}
+
+func TestGetPuppet_Stalled(t *testing.T) {
+	assert := assert.New(t)
+	// the server accepts the puppet but never registers it
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if c, err := l.Accept(); err == nil {
+			accepted <- c
+		}
+	}()
+
+	addr := l.Addr().(*net.TCPAddr)
+	ircConf = &config.Irc{Server: "127.0.0.1", Port: uint16(addr.Port),
+		Puppets: true, PuppetSuffix: "[tg]"}
+	ircConn = irc.IRC("irchuu", "irchuu")
+	connected := make(chan error)
+	go func() {
+		_, err := getPuppet(relay.Message{Origin: "telegram", FromID: 9,
+			Nick: "bob"}, &config.Bridge{Channel: "#irchuu"}, ircConn.Log)
+		connected <- err
+	}()
+	c := <-accepted
+
+	// the read loop and other users are not blocked by the connection
+	checked := make(chan bool)
+	go func() { checked <- isPuppet("bob[tg]") }()
+	select {
+	case found := <-checked:
+		assert.False(found)
+	case <-time.After(time.Second):
+		t.Fatal("isPuppet is blocked by a connecting puppet")
+	}
+	quitPuppets(0)
+
+	c.Close()
+	select {
+	case err := <-connected:
+		assert.Error(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the puppet did not fail")
+	}
+	assert.False(isPuppet("bob[tg]"))
+}
+
+func TestPuppetNick(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("alice[tg]", puppetNick(relay.Message{Nick: "alice"}, "[tg]"))
+	assert.Equal("JohnDoe[tg]", puppetNick(relay.Message{FirstName: "John",
+		LastName: "Doe"}, "[tg]"))
+	assert.Equal("tg42|tg", puppetNick(relay.Message{FirstName: "Ваня",
+		FromID: 42}, "|tg"))
+	assert.Equal("_1337", puppetNick(relay.Message{Nick: "1337"}, ""))
+	assert.Len(puppetNick(relay.Message{Nick: strings.Repeat("a", 40)}, "[tg]"),
+		maxPuppetNick)
+}
+
+func TestTransport_PM(t *testing.T) {
+	assert := assert.New(t)
+	s := newFakeServer(t)
+	defer s.listener.Close()
+	s.accounts = map[string]string{"bob": "bobby"}
+
+	addr := s.listener.Addr().(*net.TCPAddr)
+	c := &config.Irc{Server: "127.0.0.1", Port: uint16(addr.Port),
+		Nick: "irchuu", Prefix: "<", Postfix: ">", MaxLength: 24,
+		NamesUpdateInterval: 300}
+	bridges := []*config.Bridge{&config.Bridge{Name: "irchuu",
+		Channel: "#irchuu"}}
+	r := relay.NewRouter(bridges)
+	r.Add(newRecorder())
+	r.Add(NewTransport(c))
+	done := make(chan error)
+	go func() { done <- r.Start() }()
+	defer func() {
+		r.Stop()
+		<-done
+	}()
+	<-s.conns
+
+	// a reply of a Telegram user to a private message
+	r.Service(relay.ServiceMessage{Command: "pm", Bridge: "irchuu",
+		Origin: "telegram", Target: "irc",
+		Arguments: []string{"bob", "hi\nthere", "alice"}})
+	for _, line := range []string{"hi", "there"} {
+		select {
+		case m := <-s.sent:
+			assert.Equal("irchuu PRIVMSG bob :\x02@alice\x0f: "+line, m)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the reply was not delivered")
+		}
+	}
+
+	// accounts for linking come from WHOIS without account-tag
+	assert.Equal("bobby", whoisAccount("bob"))
+	assert.Equal("", whoisAccount("eve"))
+}
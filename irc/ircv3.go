@@ -0,0 +1,246 @@
+package irchuu
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/26000/irchuu/config"
+	"github.com/26000/irchuu/relay"
+
+	"github.com/thoj/go-ircevent"
+)
+
+// capabilities are the IRCv3 capabilities requested from the server.
+var capabilities = []string{"server-time", "message-tags", "echo-message",
+	"batch", "account-tag", "away-notify", "draft/message-redaction"}
+
+// echoTimeout is how long the bot waits for its lines to be echoed.
+const echoTimeout = 30 * time.Second
+
+var (
+	// capabilities acknowledged by the server
+	acked   = make(map[string]bool)
+	ackedMu sync.RWMutex
+
+	// lines waiting to be echoed by their keys
+	echoes   = make(map[string][]*echo)
+	echoesMu sync.Mutex
+
+	// nicks which are away
+	away   = make(map[string]bool)
+	awayMu sync.RWMutex
+)
+
+// hasCap returns true if the server acknowledged the capability.
+func hasCap(name string) bool {
+	ackedMu.RLock()
+	defer ackedMu.RUnlock()
+	return acked[name]
+}
+
+// handleCaps requests the capabilities after the registration and remembers
+// which of them were acknowledged. go-ircevent only negotiates SASL.
+func handleCaps(logger *log.Logger) {
+	var available []string
+	// replies to the SASL negotiation of go-ircevent are not ours
+	var listing bool
+	ircConn.AddCallback("001", func(event *irc.Event) {
+		ackedMu.Lock()
+		acked = make(map[string]bool)
+		ackedMu.Unlock()
+		available, listing = nil, true
+		ircConn.SendRaw("CAP LS 302")
+	})
+
+	ircConn.AddCallback("CAP", func(event *irc.Event) {
+		if len(event.Arguments) < 3 {
+			return
+		}
+		caps := strings.Fields(event.Arguments[len(event.Arguments)-1])
+		switch event.Arguments[1] {
+		case "LS":
+			if !listing {
+				return
+			}
+			for _, c := range caps {
+				// values of capabilities are not needed
+				available = append(available, strings.SplitN(c, "=", 2)[0])
+			}
+			// "*" means that more capabilities follow
+			if event.Arguments[2] == "*" {
+				return
+			}
+			listing = false
+			var wanted []string
+			for _, c := range capabilities {
+				for _, a := range available {
+					if c == a {
+						wanted = append(wanted, c)
+					}
+				}
+			}
+			if len(wanted) != 0 {
+				ircConn.SendRawf("CAP REQ :%v", strings.Join(wanted, " "))
+			}
+		case "ACK":
+			ackedMu.Lock()
+			for _, c := range caps {
+				acked[strings.TrimPrefix(c, "-")] = !strings.HasPrefix(c, "-")
+			}
+			ackedMu.Unlock()
+			logger.Printf("Enabled capabilities: %v\n", strings.Join(caps, " "))
+		case "NAK":
+			logger.Printf("The server refused capabilities: %v\n",
+				strings.Join(caps, " "))
+		}
+	})
+}
+
+// echo is a line waiting to be echoed by the server.
+type echo struct {
+	key string
+	ch  chan string // receives the msgid
+}
+
+// expectEcho starts waiting for the line sent to the target to be echoed.
+func expectEcho(target, text string) *echo {
+	e := &echo{key: strings.ToLower(target) + " " + text,
+		ch: make(chan string, 1)}
+	echoesMu.Lock()
+	echoes[e.key] = append(echoes[e.key], e)
+	echoesMu.Unlock()
+	return e
+}
+
+// cancel stops waiting for the line.
+func (e *echo) cancel() {
+	echoesMu.Lock()
+	defer echoesMu.Unlock()
+	for i, other := range echoes[e.key] {
+		if other == e {
+			echoes[e.key] = append(echoes[e.key][:i], echoes[e.key][i+1:]...)
+			break
+		}
+	}
+	if len(echoes[e.key]) == 0 {
+		delete(echoes, e.key)
+	}
+}
+
+// echoed passes the msgid of an echoed line to the sender waiting for it.
+func echoed(event *irc.Event) {
+	key := strings.ToLower(event.Arguments[0]) + " " + event.Message()
+	echoesMu.Lock()
+	defer echoesMu.Unlock()
+	if len(echoes[key]) == 0 {
+		return
+	}
+	echoes[key][0].ch <- event.Tags["msgid"]
+	if echoes[key] = echoes[key][1:]; len(echoes[key]) == 0 {
+		delete(echoes, key)
+	}
+}
+
+// setAway marks the nick as away or back.
+func setAway(nick string, isAway bool) {
+	awayMu.Lock()
+	defer awayMu.Unlock()
+	if isAway {
+		away[nick] = true
+	} else {
+		delete(away, nick)
+	}
+}
+
+// isAway returns true if the nick is away.
+func isAway(nick string) bool {
+	awayMu.RLock()
+	defer awayMu.RUnlock()
+	return away[nick]
+}
+
+// isEcho returns true if the event is the bot's own message echoed by the
+// server.
+func isEcho(event *irc.Event) bool {
+	return event.Nick == ircConn.GetNick() && hasCap("echo-message")
+}
+
+// eventTime returns the time of the event from the server-time tag or now.
+func eventTime(event *irc.Event) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, event.Tags["time"]); err == nil {
+		return t
+	}
+	return time.Now()
+}
+
+// formatEvent creates a Message in the universal format of an IRC event,
+// keeping its time, msgid and account tags.
+func formatEvent(b *config.Bridge, event *irc.Event, text string, action string) relay.Message {
+	f := formatMessage(b, event.Nick, text, action)
+	f.Date = eventTime(event)
+	if account := event.Tags["account"]; account != "" {
+		f.Extra["account"] = account
+	}
+	return f
+}
+
+// batch is an IRCv3 batch of netsplit or netjoin events.
+type batch struct {
+	kind    string
+	servers []string
+	nicks   map[string][]string // by bridge
+}
+
+// openBatch starts a batch of netsplit or netjoin events. Other batches are
+// not collapsed.
+func openBatch(batches map[string]*batch, event *irc.Event) {
+	if len(event.Arguments) < 2 || len(event.Arguments[0]) < 2 {
+		return
+	}
+	ref, kind := event.Arguments[0], event.Arguments[1]
+	if ref[0] == '+' && (kind == "netsplit" || kind == "netjoin") {
+		batches[ref[1:]] = &batch{kind: kind, servers: event.Arguments[2:],
+			nicks: make(map[string][]string)}
+	}
+}
+
+// collect adds the nick to the batch of the event if it is of the kind.
+func collect(batches map[string]*batch, event *irc.Event, kind, bridge string) bool {
+	bt := batches[event.Tags["batch"]]
+	if bt == nil || bt.kind != kind {
+		return false
+	}
+	bt.nicks[bridge] = append(bt.nicks[bridge], event.Nick)
+	return true
+}
+
+// closeBatch ends a batch and returns it or nil if it was not collected.
+func closeBatch(batches map[string]*batch, event *irc.Event) *batch {
+	if len(event.Arguments) == 0 || !strings.HasPrefix(event.Arguments[0], "-") {
+		return nil
+	}
+	ref := event.Arguments[0][1:]
+	bt := batches[ref]
+	delete(batches, ref)
+	return bt
+}
+
+// announcement describes the netsplit or netjoin to the bridge.
+func (bt *batch) announcement(bridge string) string {
+	nicks := bt.nicks[bridge]
+	if len(nicks) == 0 {
+		return ""
+	}
+	list := relay.ListNicks(nicks)
+	between := ""
+	if len(bt.servers) == 2 {
+		between = fmt.Sprintf(" between %v and %v", bt.servers[0], bt.servers[1])
+	}
+	if bt.kind == "netjoin" {
+		return fmt.Sprintf("Netsplit%v is over, returned: %v.", between, list)
+	}
+	return fmt.Sprintf("Netsplit%v, quit: %v.", between, list)
+}
@@ -0,0 +1,102 @@
+package irchuu
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/26000/irchuu/config"
+	irchuubase "github.com/26000/irchuu/db"
+	"github.com/26000/irchuu/relay"
+
+	"github.com/thoj/go-ircevent"
+)
+
+// whoisTimeout is how long the bot waits for the reply to WHOIS.
+const whoisTimeout = 10 * time.Second
+
+var (
+	// WHOIS requests waiting for the account by lowercase nicks
+	whois   = make(map[string][]chan string)
+	whoisMu sync.Mutex
+)
+
+// handleWhois passes the accounts from WHOIS replies to those waiting for
+// them.
+func handleWhois() {
+	// RPL_WHOISACCOUNT: <me> <nick> <account> :is logged in as
+	ircConn.AddCallback("330", func(event *irc.Event) {
+		if len(event.Arguments) > 2 {
+			whoisReply(event.Arguments[1], event.Arguments[2])
+		}
+	})
+	// RPL_ENDOFWHOIS: the nick is not identified if 330 did not come before
+	ircConn.AddCallback("318", func(event *irc.Event) {
+		if len(event.Arguments) > 1 {
+			whoisReply(event.Arguments[1], "")
+		}
+	})
+}
+
+// whoisReply passes the account of the nick to those waiting for it.
+func whoisReply(nick, account string) {
+	nick = strings.ToLower(nick)
+	whoisMu.Lock()
+	defer whoisMu.Unlock()
+	for _, ch := range whois[nick] {
+		ch <- account
+	}
+	delete(whois, nick)
+}
+
+// whoisAccount returns the NickServ account the nick is identified as, or an
+// empty string.
+func whoisAccount(nick string) string {
+	ch := make(chan string, 1)
+	whoisMu.Lock()
+	whois[strings.ToLower(nick)] = append(whois[strings.ToLower(nick)], ch)
+	whoisMu.Unlock()
+	if safely(func() { ircConn.SendRawf("WHOIS %v", nick) }) != nil {
+		return ""
+	}
+	select {
+	case account := <-ch:
+		return account
+	case <-time.After(whoisTimeout):
+		return ""
+	}
+}
+
+// link links the NickServ account of the nick to the Telegram user who got
+// the code from the bot. The account comes from the account-tag of the
+// message or else from WHOIS.
+func link(nick, account, code string, r *relay.Router, b *config.Bridge) {
+	if !hasCap("account-tag") {
+		account = whoisAccount(nick)
+	}
+	if account == "" {
+		noticeOrMsg(ircConf.SendNotices, nick,
+			"Identify with NickServ first to link your account.")
+		return
+	}
+	id, err := irchuubase.Link(code, account, nick)
+	if err == sql.ErrNoRows {
+		noticeOrMsg(ircConf.SendNotices, nick, "The code is wrong or expired. "+
+			"Send /link to the Telegram bot privately to get a new one.")
+		return
+	} else if err != nil {
+		noticeOrMsgf(ircConf.SendNotices, nick, "An error occurred: %v", err)
+		return
+	}
+	forgetNicks()
+	noticeOrMsgf(ircConf.SendNotices, nick,
+		"Your account \x02%v\x0f is now linked to your Telegram account.", account)
+	sendService(r, relay.ServiceMessage{
+		Command:   "linked",
+		Arguments: []string{strconv.Itoa(id), account},
+		Bridge:    b.Name,
+		Target:    "telegram",
+	})
+}
@@ -0,0 +1,240 @@
+package irchuu
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	irchuubase "github.com/26000/irchuu/db"
+	"github.com/26000/irchuu/relay"
+)
+
+// mentionTrim is trimmed from the end of words which may be mentions.
+const mentionTrim = ":,.!?"
+
+const (
+	// knownNickTTL is how long the Telegram IDs of nicks looked up in the
+	// database are remembered, and also the nicks which are not found.
+	knownNickTTL = 10 * time.Minute
+	// maxKnownNicks is the number of remembered nicks which triggers pruning.
+	maxKnownNicks = 1000
+)
+
+var (
+	// Telegram IDs of nicks looked up in the database by lowercase nicks, 0
+	// if not found
+	knownNicks   = make(map[string]knownNick)
+	knownNicksMu sync.Mutex
+
+	// nicks to be looked up in the database, one after another
+	lookups    = make(chan string, maxKnownNicks)
+	lookupOnce sync.Once
+)
+
+// knownNick is the Telegram ID of a nick found in the database.
+type knownNick struct {
+	id      int
+	expires time.Time
+}
+
+// findMentions finds the Telegram users whom the text of an IRC message
+// mentions with "nick: text", "nick, text" or "@nick" by the nicks of their
+// puppets, their linked IRC accounts or their usernames. Only puppets and
+// members of the channel are mentioned with "nick: text".
+func findMentions(text string, members map[string]int) []relay.Mention {
+	var candidates []relay.Mention
+	first := true
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if unicode.IsSpace(r) {
+			i += size
+			continue
+		}
+		end := strings.IndexFunc(text[i:], unicode.IsSpace)
+		if end < 0 {
+			end = len(text)
+		} else {
+			end += i
+		}
+		word := text[i:end]
+		if strings.HasPrefix(word, "@") && len(word) > 1 {
+			word = strings.TrimRight(word, mentionTrim)
+			candidates = append(candidates, relay.Mention{Offset: i, Length: len(word)})
+		} else if first && len(word) > 1 &&
+			(strings.HasSuffix(word, ":") || strings.HasSuffix(word, ",")) &&
+			isMember(members, word[:len(word)-1]) {
+			candidates = append(candidates, relay.Mention{Offset: i, Length: len(word) - 1})
+		}
+		first = false
+		i = end
+	}
+
+	nicks := make([]string, len(candidates))
+	for i, c := range candidates {
+		nicks[i] = strings.TrimPrefix(text[c.Offset:c.Offset+c.Length], "@")
+	}
+	ids := telegramIDs(nicks)
+	var mentions []relay.Mention
+	for i, c := range candidates {
+		if c.ID = ids[nicks[i]]; c.ID != 0 {
+			mentions = append(mentions, c)
+		}
+	}
+	return mentions
+}
+
+// isMember returns true if the nick is a puppet or in the channel members.
+func isMember(members map[string]int, nick string) bool {
+	if puppetID(nick) != 0 {
+		return true
+	}
+	for member, mode := range members {
+		if mode != 0 && strings.EqualFold(member, nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// telegramIDs returns the IDs of the Telegram users known by the nicks in
+// IRC. It never waits for the database: the nicks which have not been looked
+// up yet are looked up in the background for the next messages.
+func telegramIDs(nicks []string) map[string]int {
+	ids := make(map[string]int)
+	for _, nick := range nicks {
+		if nick == "" {
+			continue
+		}
+		if id := puppetID(nick); id != 0 {
+			ids[nick] = id
+			continue
+		}
+		knownNicksMu.Lock()
+		known, ok := knownNicks[strings.ToLower(nick)]
+		knownNicksMu.Unlock()
+		if ok && time.Now().Before(known.expires) {
+			if known.id != 0 {
+				ids[nick] = known.id
+			}
+		} else {
+			lookupNick(nick)
+		}
+	}
+	return ids
+}
+
+// lookupNick looks the nick up in the database in the background unless it
+// is remembered already, e. g. when a member joins the channel.
+func lookupNick(nick string) {
+	if !irchuubase.IsAvailable() {
+		return
+	}
+	key := strings.ToLower(nick)
+	knownNicksMu.Lock()
+	if known, ok := knownNicks[key]; ok && time.Now().Before(known.expires) {
+		knownNicksMu.Unlock()
+		return
+	}
+	// not found until it is, so it is looked up once
+	knownNicks[key] = knownNick{expires: time.Now().Add(knownNickTTL)}
+	knownNicksMu.Unlock()
+
+	lookupOnce.Do(func() { go lookUp() })
+	select {
+	case lookups <- nick:
+	default:
+		knownNicksMu.Lock()
+		delete(knownNicks, key)
+		knownNicksMu.Unlock()
+	}
+}
+
+// lookUp looks up the nicks sent to lookups.
+func lookUp() {
+	for nick := range lookups {
+		id, _, err := irchuubase.FindUser(nick)
+		if err == nil || err == sql.ErrNoRows {
+			rememberNick(nick, id)
+		}
+	}
+}
+
+// rememberNick remembers the Telegram ID of the nick looked up in the
+// database, 0 if it is not found.
+func rememberNick(nick string, id int) {
+	knownNicksMu.Lock()
+	defer knownNicksMu.Unlock()
+	if len(knownNicks) >= maxKnownNicks {
+		for nick, known := range knownNicks {
+			if time.Now().After(known.expires) {
+				delete(knownNicks, nick)
+			}
+		}
+	}
+	knownNicks[strings.ToLower(nick)] = knownNick{id: id,
+		expires: time.Now().Add(knownNickTTL)}
+}
+
+// forgetNicks forgets the nicks looked up in the database after accounts are
+// linked.
+func forgetNicks() {
+	knownNicksMu.Lock()
+	defer knownNicksMu.Unlock()
+	knownNicks = make(map[string]knownNick)
+}
+
+// ircNick returns the nick by which the Telegram user is known in IRC, the
+// one of their puppet or their linked account, or an empty string.
+func ircNick(id int) string {
+	if id == 0 {
+		return ""
+	}
+	if nick := puppetNickOf(id); nick != "" {
+		return nick
+	}
+	if irchuubase.IsAvailable() {
+		if nick, err := irchuubase.LinkedNick(id); err == nil {
+			return nick
+		}
+	}
+	return ""
+}
+
+// translateMentions replaces the mentions of Telegram users and the user
+// replied to with their IRC nicks, so they are highlighted in IRC.
+func translateMentions(message relay.Message) relay.Message {
+	mentions := message.Mentions()
+	replyID, _ := strconv.Atoi(message.Extra["replyUserID"])
+	if len(mentions) == 0 && replyID == 0 {
+		return message
+	}
+	// replaced from the end, so the offsets of the others stay valid
+	limit := len(message.Text)
+	for i := len(mentions) - 1; i >= 0; i-- {
+		m := mentions[i]
+		if m.Offset+m.Length > limit {
+			// overlaps the mention replaced before
+			continue
+		}
+		limit = m.Offset
+		if nick := ircNick(m.ID); nick != "" {
+			message.Text = message.Text[:m.Offset] + nick +
+				message.Text[m.Offset+m.Length:]
+		}
+	}
+	if nick := ircNick(replyID); replyID != 0 && nick != "" {
+		// Extra is shared with other transports
+		extra := make(map[string]string, len(message.Extra))
+		for k, v := range message.Extra {
+			extra[k] = v
+		}
+		extra["reply"] = nick
+		delete(extra, "replyUserID")
+		message.Extra = extra
+	}
+	return message
+}
@@ -0,0 +1,57 @@
+package irchuu
+
+import (
+	"testing"
+
+	"github.com/26000/irchuu/relay"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/thoj/go-ircevent"
+)
+
+func TestMentions(t *testing.T) {
+	assert := assert.New(t)
+	puppetsMu.Lock()
+	puppets["42"] = &puppet{conn: irc.IRC("alice[tg]", "irchuu"), id: 42}
+	puppetsMu.Unlock()
+	defer func() {
+		puppetsMu.Lock()
+		delete(puppets, "42")
+		puppetsMu.Unlock()
+	}()
+
+	assert.Equal([]relay.Mention{{Offset: 0, Length: 9, ID: 42}},
+		findMentions("alice[tg]: hi", nil))
+	assert.Equal([]relay.Mention{{Offset: 3, Length: 10, ID: 42}},
+		findMentions("hi @alice[tg]! and bob: hi", nil))
+	assert.Empty(findMentions("bob: hi @", nil))
+
+	m := relay.Message{Text: "Alice, hi", Extra: map[string]string{"replyUserID": "42"}}
+	m.SetMentions([]relay.Mention{{Offset: 0, Length: 5, ID: 42}})
+	translated := translateMentions(m)
+	assert.Equal("alice[tg], hi", translated.Text)
+	assert.Equal("alice[tg]", translated.Extra["reply"])
+	assert.Empty(translated.Extra["replyUserID"])
+	assert.Equal("42", m.Extra["replyUserID"], "Extra of the original is kept")
+
+	// only the mention itself is replaced, not the same text elsewhere
+	m = relay.Message{Text: "@al hi, @alice and @al"}
+	m.SetMentions([]relay.Mention{{Offset: 0, Length: 3, ID: 42},
+		{Offset: 19, Length: 3, ID: 42}})
+	assert.Equal("alice[tg] hi, @alice and alice[tg]", translateMentions(m).Text)
+}
+
+func TestTelegramIDs(t *testing.T) {
+	assert := assert.New(t)
+	rememberNick("Bob", 7)
+	defer forgetNicks()
+	rememberNick("Well", 0)
+	assert.Equal(map[string]int{"bob": 7}, telegramIDs([]string{"bob", "carol", "well"}))
+	assert.Equal([]relay.Mention{{Offset: 4, Length: 4, ID: 7}},
+		findMentions("hi, @bob: @", nil))
+	// only members are mentioned with "nick: text"
+	assert.Empty(findMentions("Bob: hi", map[string]int{"alice": 1}))
+	assert.Empty(findMentions("Bob: hi", map[string]int{"Bob": 0}))
+	assert.Equal([]relay.Mention{{Offset: 0, Length: 3, ID: 7}},
+		findMentions("Bob: hi", map[string]int{"bob": 1}))
+}
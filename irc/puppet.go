@@ -0,0 +1,370 @@
+package irchuu
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/26000/irchuu/config"
+	"github.com/26000/irchuu/relay"
+
+	"github.com/thoj/go-ircevent"
+)
+
+// puppetTimeout is how long a puppet may take to connect or join a channel.
+const puppetTimeout = 30 * time.Second
+
+// parkedTimeout is how long the nick of a disconnected puppet is still taken
+// for a puppet, until its QUIT reaches the bot.
+const parkedTimeout = 2 * time.Minute
+
+// maxPuppetNick is the maximum length of puppet nicks, including the suffix.
+const maxPuppetNick = 30
+
+var (
+	// puppets of Telegram users by their IDs
+	puppets = make(map[string]*puppet)
+	// puppets being connected by the IDs of Telegram users
+	connecting = make(map[string]*pendingPuppet)
+	// lowercase nicks of disconnected puppets whose QUIT has not been seen
+	// by the bot, with the time of disconnection
+	parked    = make(map[string]time.Time)
+	puppetsMu sync.Mutex
+)
+
+// pendingPuppet is a puppet being connected. The lock is not held while it
+// connects, so the IRC callbacks and other users are not blocked.
+type pendingPuppet struct {
+	ready chan struct{} // closed when the connection is done
+	p     *puppet
+	err   error
+}
+
+// puppet is an IRC connection of a Telegram user, so IRC users can highlight,
+// query and kick them like everyone else.
+type puppet struct {
+	conn *irc.Connection
+	id   int           // Telegram user ID, if known
+	done chan struct{} // closed when the connection is lost
+
+	mu      sync.Mutex
+	joined  map[string]bool       // by lowercase channel
+	waiting map[string]chan error // joins in progress by lowercase channel
+	used    time.Time
+}
+
+// usesPuppet returns true if the message is to be sent by the puppet of its
+// sender.
+func usesPuppet(message relay.Message) bool {
+	return message.Origin == "telegram" && message.Extra["special"] == "" &&
+		(message.FromID != 0 || message.Name() != "")
+}
+
+// puppetKey identifies the sender of the message.
+func puppetKey(message relay.Message) string {
+	if message.FromID != 0 {
+		return strconv.Itoa(message.FromID)
+	}
+	return message.Name()
+}
+
+// puppetNick makes an IRC nick of the sender of the message.
+func puppetNick(message relay.Message, suffix string) string {
+	var nick []byte
+	for _, r := range message.Name() {
+		if r < 128 && (r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' ||
+			r >= '0' && r <= '9' || strings.ContainsRune("-[]\\^_`{|}", r)) {
+			nick = append(nick, byte(r))
+		}
+	}
+	if len(nick) == 0 {
+		nick = []byte("tg" + strconv.Itoa(message.FromID))
+	} else if nick[0] == '-' || nick[0] >= '0' && nick[0] <= '9' {
+		nick = append([]byte("_"), nick...)
+	}
+	if max := maxPuppetNick - len(suffix); len(nick) > max && max > 0 {
+		nick = nick[:max]
+	}
+	return string(nick) + suffix
+}
+
+// getPuppet returns the puppet of the sender of the message, connecting it if
+// needed, and makes it join the channel of the bridge.
+func getPuppet(message relay.Message, b *config.Bridge, logger *log.Logger) (*puppet, error) {
+	key := puppetKey(message)
+	puppetsMu.Lock()
+	p := puppets[key]
+	if p == nil {
+		pending := connecting[key]
+		if pending == nil {
+			pending = &pendingPuppet{ready: make(chan struct{})}
+			connecting[key] = pending
+			puppetsMu.Unlock()
+			connectPending(pending, key, message, logger)
+		} else {
+			puppetsMu.Unlock()
+			<-pending.ready
+		}
+		if pending.err != nil {
+			return nil, pending.err
+		}
+		p = pending.p
+	} else {
+		puppetsMu.Unlock()
+	}
+
+	p.mu.Lock()
+	p.used = time.Now()
+	p.mu.Unlock()
+	return p, p.join(b)
+}
+
+// connectPending connects the pending puppet of the sender of the message
+// without holding the lock and publishes it.
+func connectPending(pending *pendingPuppet, key string, message relay.Message, logger *log.Logger) {
+	p, err := connectPuppet(puppetNick(message, ircConf.PuppetSuffix), logger)
+	if err == nil {
+		p.id = message.FromID
+	}
+	puppetsMu.Lock()
+	delete(connecting, key)
+	if err == nil {
+		puppets[key] = p
+	}
+	pending.p, pending.err = p, err
+	puppetsMu.Unlock()
+	close(pending.ready)
+	if err != nil {
+		return
+	}
+
+	go func() {
+		<-p.done
+		puppetsMu.Lock()
+		if puppets[key] == p {
+			delete(puppets, key)
+		}
+		parked[strings.ToLower(p.conn.GetNick())] = time.Now()
+		puppetsMu.Unlock()
+	}()
+}
+
+// connectPuppet connects a puppet with the nick and waits for the
+// registration.
+func connectPuppet(nick string, logger *log.Logger) (*puppet, error) {
+	conn := irc.IRC(nick, "irchuu")
+	conn.Password = ircConf.ServerPassword
+	conn.UseTLS = ircConf.SSL
+	if conn.UseTLS {
+		conn.TLSConfig = &tls.Config{ServerName: ircConf.Server}
+	}
+	conn.Debug = ircConf.Debug
+	conn.Log = logger
+	conn.QuitMessage = "IRChuu!bye"
+	conn.Version = ircConn.Version
+
+	p := &puppet{
+		conn:    conn,
+		done:    make(chan struct{}),
+		joined:  make(map[string]bool),
+		waiting: make(map[string]chan error),
+	}
+	registered := make(chan struct{})
+	conn.AddCallback("001", func(event *irc.Event) {
+		close(registered)
+	})
+	conn.AddCallback("JOIN", func(event *irc.Event) {
+		if event.Nick == conn.GetNick() {
+			p.setJoined(event.Arguments[0], nil)
+		}
+	})
+	// cannot join: full, invite only, banned, wrong key, needs registration
+	for _, code := range []string{"471", "473", "474", "475", "477"} {
+		conn.AddCallback(code, func(event *irc.Event) {
+			if len(event.Arguments) > 1 {
+				p.setJoined(event.Arguments[1], errors.New(event.Message()))
+			}
+		})
+	}
+	conn.AddCallback("KICK", func(event *irc.Event) {
+		if len(event.Arguments) > 1 && event.Arguments[1] == conn.GetNick() {
+			p.mu.Lock()
+			delete(p.joined, strings.ToLower(event.Arguments[0]))
+			p.mu.Unlock()
+		}
+	})
+
+	if err := conn.Connect(fmt.Sprintf("%v:%d", ircConf.Server, ircConf.Port)); err != nil {
+		return nil, err
+	}
+	go func() {
+		err := <-conn.ErrorChan()
+		logger.Printf("Puppet %v disconnected: %v\n", conn.GetNick(), err)
+		conn.Disconnect()
+		close(p.done)
+	}()
+
+	select {
+	case <-registered:
+		return p, nil
+	case <-p.done:
+		return nil, errors.New("disconnected")
+	case <-time.After(puppetTimeout):
+		safely(conn.Quit)
+		return nil, errors.New("registration timed out")
+	}
+}
+
+// join joins the channel of the bridge unless the puppet is already on it.
+func (p *puppet) join(b *config.Bridge) error {
+	channel := strings.ToLower(b.Channel)
+	p.mu.Lock()
+	if p.joined[channel] {
+		p.mu.Unlock()
+		return nil
+	}
+	wait := make(chan error, 1)
+	p.waiting[channel] = wait
+	p.mu.Unlock()
+
+	if err := safely(func() {
+		p.conn.Join(fmt.Sprintf("%v %v", b.Channel, b.ChanPassword))
+	}); err != nil {
+		return err
+	}
+	select {
+	case err := <-wait:
+		return err
+	case <-p.done:
+		return errors.New("disconnected")
+	case <-time.After(puppetTimeout):
+		return fmt.Errorf("cannot join %v: timed out", b.Channel)
+	}
+}
+
+// setJoined marks the channel as joined or tells why it cannot be joined.
+func (p *puppet) setJoined(channel string, err error) {
+	channel = strings.ToLower(channel)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		p.joined[channel] = true
+	}
+	if wait := p.waiting[channel]; wait != nil {
+		wait <- err
+		delete(p.waiting, channel)
+	}
+}
+
+// send sends the message as bare text from the puppet. If the bot receives
+// message tags, it returns the lines waiting to be seen by the bot.
+func (p *puppet) send(message relay.Message, b *config.Bridge) (echoes []*echo) {
+	for _, m := range formatPuppetMessages(message, b, p.conn.GetNick()) {
+		// the bot sees the lines of puppets and learns their msgid
+		if hasCap("message-tags") {
+			echoes = append(echoes, expectEcho(b.Channel, m))
+		}
+		p.conn.Privmsg(b.Channel, m)
+		if ircConf.FloodDelay != 0 {
+			time.Sleep(time.Duration(ircConf.FloodDelay) * time.Millisecond)
+		}
+	}
+	return
+}
+
+// isPuppet returns true if the nick belongs to a puppet, including one which
+// has disconnected but whose QUIT has not been seen yet.
+func isPuppet(nick string) bool {
+	puppetsMu.Lock()
+	defer puppetsMu.Unlock()
+	for _, p := range puppets {
+		if strings.EqualFold(p.conn.GetNick(), nick) {
+			return true
+		}
+	}
+	for parkedNick, since := range parked {
+		if time.Since(since) > parkedTimeout {
+			delete(parked, parkedNick)
+		}
+	}
+	_, ok := parked[strings.ToLower(nick)]
+	return ok
+}
+
+// puppetQuit returns true if the quitting nick belongs to a puppet and forgets
+// it if the puppet has already disconnected.
+func puppetQuit(nick string) bool {
+	if !isPuppet(nick) {
+		return false
+	}
+	puppetsMu.Lock()
+	delete(parked, strings.ToLower(nick))
+	puppetsMu.Unlock()
+	return true
+}
+
+// puppetID returns the Telegram user ID of the puppet with the nick or 0.
+func puppetID(nick string) int {
+	puppetsMu.Lock()
+	defer puppetsMu.Unlock()
+	for _, p := range puppets {
+		if strings.EqualFold(p.conn.GetNick(), nick) {
+			return p.id
+		}
+	}
+	return 0
+}
+
+// puppetNickOf returns the nick of the puppet of the Telegram user or an
+// empty string.
+func puppetNickOf(id int) string {
+	puppetsMu.Lock()
+	defer puppetsMu.Unlock()
+	for _, p := range puppets {
+		if p.id == id {
+			return p.conn.GetNick()
+		}
+	}
+	return ""
+}
+
+// expirePuppets disconnects puppets which have not sent anything for the
+// idle time, until the transport is stopped. Then it disconnects all of them.
+func expirePuppets(idle time.Duration, stop chan struct{}) {
+	check := idle / 10
+	if check < time.Second {
+		check = time.Second
+	}
+	for {
+		select {
+		case <-time.After(check):
+		case <-stop:
+			quitPuppets(0)
+			return
+		}
+		quitPuppets(idle)
+	}
+}
+
+// quitPuppets disconnects puppets idle for longer than the duration.
+func quitPuppets(idle time.Duration) {
+	var expired []*puppet
+	puppetsMu.Lock()
+	for _, p := range puppets {
+		p.mu.Lock()
+		if time.Since(p.used) >= idle {
+			expired = append(expired, p)
+		}
+		p.mu.Unlock()
+	}
+	puppetsMu.Unlock()
+	// quitting writes to the connection, so it is done without the lock
+	for _, p := range expired {
+		safely(p.conn.Quit)
+	}
+}
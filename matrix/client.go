@@ -0,0 +1,209 @@
+package matrix
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// apiPrefix is the prefix of all client-server API endpoints.
+const apiPrefix = "/_matrix/client/v3"
+
+// client is a minimal Matrix client-server API client.
+type client struct {
+	txn        int64 // first to be aligned for atomic operations
+	homeServer string
+	token      string
+	http       *http.Client
+}
+
+// apiError is an error returned by the homeserver.
+type apiError struct {
+	Status  int
+	ErrCode string `json:"errcode"`
+	Message string `json:"error"`
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("%v %v: %v", e.Status, e.ErrCode, e.Message)
+}
+
+// syncResponse is the part of the /sync response IRChuu needs.
+type syncResponse struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			State struct {
+				Events []event `json:"events"`
+			} `json:"state"`
+			Timeline struct {
+				Events []event `json:"events"`
+			} `json:"timeline"`
+		} `json:"join"`
+	} `json:"rooms"`
+}
+
+// event is a room event.
+type event struct {
+	Type           string          `json:"type"`
+	EventID        string          `json:"event_id"`
+	Sender         string          `json:"sender"`
+	StateKey       *string         `json:"state_key"`
+	OriginServerTS int64           `json:"origin_server_ts"`
+	Content        json.RawMessage `json:"content"`
+}
+
+// messageContent is the content of an m.room.message event.
+type messageContent struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format,omitempty"`
+	FormattedBody string `json:"formatted_body,omitempty"`
+	URL           string `json:"url,omitempty"`
+	Info          *struct {
+		MimeType string `json:"mimetype"`
+		Size     int    `json:"size"`
+		Width    int    `json:"w"`
+		Height   int    `json:"h"`
+		Duration int    `json:"duration"`
+	} `json:"info,omitempty"`
+
+	RelatesTo  *relatesTo      `json:"m.relates_to,omitempty"`
+	NewContent *messageContent `json:"m.new_content,omitempty"`
+}
+
+// relatesTo describes replies and edits.
+type relatesTo struct {
+	RelType   string `json:"rel_type,omitempty"`
+	EventID   string `json:"event_id,omitempty"`
+	InReplyTo *struct {
+		EventID string `json:"event_id"`
+	} `json:"m.in_reply_to,omitempty"`
+}
+
+// memberContent is the content of an m.room.member event.
+type memberContent struct {
+	Membership  string `json:"membership"`
+	DisplayName string `json:"displayname"`
+}
+
+// do makes an API request and decodes the JSON response into result.
+func (c *client) do(method, path string, query url.Values, body, result interface{}) error {
+	u := c.homeServer + apiPrefix + path
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+
+	var reqBody []byte
+	if body != nil {
+		var err error
+		reqBody, err = json.Marshal(body)
+		if err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, u, bytes.NewReader(reqBody))
+	if err != nil {
+		return err
+	}
+	req.Header = c.authorization()
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		e := &apiError{Status: resp.StatusCode}
+		json.Unmarshal(respBody, e)
+		return e
+	}
+	if result != nil {
+		return json.Unmarshal(respBody, result)
+	}
+	return nil
+}
+
+// whoAmI returns the user ID of the access token owner.
+func (c *client) whoAmI() (string, error) {
+	var resp struct {
+		UserID string `json:"user_id"`
+	}
+	err := c.do("GET", "/account/whoami", nil, nil, &resp)
+	return resp.UserID, err
+}
+
+// join joins a room by its ID or alias and returns the room ID.
+func (c *client) join(room string) (string, error) {
+	var resp struct {
+		RoomID string `json:"room_id"`
+	}
+	err := c.do("POST", "/join/"+url.PathEscape(room), nil,
+		struct{}{}, &resp)
+	return resp.RoomID, err
+}
+
+// sync receives new events since the given batch token. Timeout is the
+// long-polling timeout.
+func (c *client) sync(since string, timeout time.Duration) (*syncResponse, error) {
+	query := url.Values{}
+	query.Set("timeout", strconv.FormatInt(int64(timeout/time.Millisecond), 10))
+	if since != "" {
+		query.Set("since", since)
+	}
+	resp := new(syncResponse)
+	err := c.do("GET", "/sync", query, nil, resp)
+	return resp, err
+}
+
+// send sends an m.room.message event to the room and returns its ID.
+func (c *client) send(room string, content *messageContent) (string, error) {
+	txn := atomic.AddInt64(&c.txn, 1)
+	var resp struct {
+		EventID string `json:"event_id"`
+	}
+	err := c.do("PUT", fmt.Sprintf("/rooms/%v/send/m.room.message/irchuu%v.%v",
+		url.PathEscape(room), time.Now().UnixNano(), txn), nil, content,
+		&resp)
+	return resp.EventID, err
+}
+
+// downloadURL turns an mxc:// URI into an HTTP URL of the homeserver, which
+// needs the access token.
+func (c *client) downloadURL(mxc string) string {
+	if !strings.HasPrefix(mxc, "mxc://") {
+		return mxc
+	}
+	return c.homeServer + "/_matrix/client/v1/media/download/" +
+		strings.TrimPrefix(mxc, "mxc://")
+}
+
+// publicURL turns an mxc:// URI into an HTTP URL of the homeserver which works
+// without the access token on homeservers which still allow it.
+func (c *client) publicURL(mxc string) string {
+	if !strings.HasPrefix(mxc, "mxc://") {
+		return mxc
+	}
+	return c.homeServer + "/_matrix/media/v3/download/" +
+		strings.TrimPrefix(mxc, "mxc://")
+}
+
+// authorization returns the header which authorizes requests.
+func (c *client) authorization() http.Header {
+	return http.Header{"Authorization": {"Bearer " + c.token}}
+}
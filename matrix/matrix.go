@@ -0,0 +1,580 @@
+// Package matrix contains everything related to the Matrix part of IRChuu.
+package matrix
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/26000/irchuu/config"
+	irchuubase "github.com/26000/irchuu/db"
+	"github.com/26000/irchuu/relay"
+	"github.com/26000/irchuu/upload"
+)
+
+// transportName is the name of the Matrix transport in the router.
+const transportName = "matrix"
+
+// Delays between attempts to connect or sync.
+const (
+	minReconnectDelay = 3 * time.Second
+	maxReconnectDelay = 5 * time.Minute
+)
+
+// maxKnownEvents is how many event senders are remembered to resolve replies.
+const maxKnownEvents = 1000
+
+// Transport is the Matrix transport.
+type Transport struct {
+	c        *config.Matrix
+	client   *client
+	logger   *log.Logger
+	services chan relay.ServiceMessage
+	stop     chan struct{}
+	stopOnce sync.Once
+	storage  upload.Backend // re-hosts media files, nil if they are not
+
+	mu           sync.Mutex
+	userID       string
+	rooms        map[string]*config.Bridge // by room ID
+	bridgeRooms  map[string]string         // room IDs by bridge name, empty until joined
+	displayNames map[string]string         // by user ID
+	senders      map[string]string         // sender names by event ID
+	err          error
+}
+
+// NewTransport creates the Matrix transport.
+func NewTransport(c *config.Matrix) *Transport {
+	return &Transport{
+		c: c,
+		client: &client{
+			homeServer: strings.TrimRight(c.HomeServer, "/"),
+			token:      c.AccessToken,
+			http: &http.Client{
+				Timeout: time.Duration(c.SyncTimeout+30) * time.Second,
+			},
+		},
+		logger:   log.New(os.Stdout, "MTX ", log.LstdFlags),
+		services: make(chan relay.ServiceMessage, 20),
+		stop:     make(chan struct{}),
+
+		rooms:        make(map[string]*config.Bridge),
+		bridgeRooms:  make(map[string]string),
+		displayNames: make(map[string]string),
+		senders:      make(map[string]string),
+	}
+}
+
+// Name returns the name of the transport.
+func (t *Transport) Name() string {
+	return transportName
+}
+
+// Send sends a message to the room of its bridge. It fails until the room is
+// joined.
+func (t *Transport) Send(message relay.Message) error {
+	t.mu.Lock()
+	userID := t.userID
+	roomID, ok := t.bridgeRooms[message.Bridge]
+	t.mu.Unlock()
+	if userID == "" {
+		return errors.New("not logged in")
+	}
+	if !ok {
+		// the bridge has no Matrix room
+		return nil
+	}
+	if roomID == "" {
+		return errors.New("not in the room")
+	}
+
+	eventID, err := t.client.send(roomID, formatMatrixMessage(message, t.c))
+	if e, ok := err.(*apiError); ok && e.Status/100 == 4 && e.Status != 429 {
+		return relay.Permanent(err)
+	} else if err != nil {
+		return err
+	}
+	t.remember(eventID, message.Name())
+	return nil
+}
+
+// SendService queues a service command.
+func (t *Transport) SendService(message relay.ServiceMessage) error {
+	t.services <- message
+	return nil
+}
+
+// Stop stops syncing.
+func (t *Transport) Stop() error {
+	t.stopOnce.Do(func() { close(t.stop) })
+	return nil
+}
+
+// Health returns the error of the last request to the homeserver, if any.
+func (t *Transport) Health() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.userID == "" && t.err == nil {
+		return errors.New("not logged in")
+	}
+	return t.err
+}
+
+// Start logs in, joins the rooms of all bridges and syncs until stopped. Both
+// logging in and syncing are retried with backoff.
+func (t *Transport) Start(r *relay.Router) error {
+	t.mu.Lock()
+	for _, b := range r.Bridges() {
+		if b.MatrixRoom != "" {
+			t.bridgeRooms[b.Name] = ""
+		}
+	}
+	t.mu.Unlock()
+
+	if t.c.Storage != nil {
+		storage, err := upload.New(t.c.Storage)
+		if err != nil {
+			t.logger.Printf("Cannot re-host media files: %v\n", err)
+		}
+		t.storage = storage
+	}
+
+	backoff := relay.NewBackoff(minReconnectDelay, maxReconnectDelay)
+	var since string
+	for {
+		var err error
+		if since, err = t.connect(r); err == nil {
+			break
+		}
+		t.mu.Lock()
+		t.err = err
+		t.mu.Unlock()
+		t.logger.Printf("Cannot connect: %v, retrying in %v\n", err,
+			backoff.Delay())
+		if !backoff.Wait(t.stop) {
+			return nil
+		}
+	}
+	backoff.Reset()
+
+	go t.listenService()
+
+	timeout := time.Duration(t.c.SyncTimeout) * time.Second
+	for {
+		select {
+		case <-t.stop:
+			return nil
+		default:
+		}
+
+		resp, err := t.client.sync(since, timeout)
+		t.mu.Lock()
+		t.err = err
+		t.mu.Unlock()
+		if err != nil {
+			t.logger.Printf("Sync failed, retrying in %v: %v\n", backoff.Delay(), err)
+			if !backoff.Wait(t.stop) {
+				return nil
+			}
+			continue
+		}
+		backoff.Reset()
+		since = resp.NextBatch
+		t.processSync(r, resp, true)
+	}
+}
+
+// connect logs in, joins the rooms of all bridges and makes the initial sync.
+// It returns the token to sync from.
+func (t *Transport) connect(r *relay.Router) (string, error) {
+	userID, err := t.client.whoAmI()
+	if err != nil {
+		return "", fmt.Errorf("failed to log in: %v", err)
+	}
+	t.mu.Lock()
+	t.userID = userID
+	t.mu.Unlock()
+	t.logger.Printf("Logged in as %v\n", userID)
+
+	for _, b := range r.Bridges() {
+		if b.MatrixRoom == "" {
+			continue
+		}
+		roomID, err := t.client.join(b.MatrixRoom)
+		if err != nil {
+			t.logger.Printf("Failed to join %v: %v\n", b.MatrixRoom, err)
+			continue
+		}
+		t.mu.Lock()
+		t.rooms[roomID] = b
+		t.bridgeRooms[b.Name] = roomID
+		t.mu.Unlock()
+		t.logger.Printf("Joined %v\n", b.MatrixRoom)
+	}
+
+	// the initial sync is only needed to skip the history
+	resp, err := t.client.sync("", 0)
+	if err != nil {
+		return "", fmt.Errorf("initial sync failed: %v", err)
+	}
+	t.mu.Lock()
+	t.err = nil
+	t.mu.Unlock()
+	t.processSync(r, resp, false)
+	return resp.NextBatch, nil
+}
+
+// processSync processes the events of a sync response. Messages are relayed
+// only if relay is true.
+func (t *Transport) processSync(r *relay.Router, resp *syncResponse, relayMessages bool) {
+	for roomID, room := range resp.Rooms.Join {
+		t.mu.Lock()
+		b := t.rooms[roomID]
+		t.mu.Unlock()
+		if b == nil {
+			continue
+		}
+
+		for _, e := range room.State.Events {
+			t.processMember(e)
+		}
+		for _, e := range room.Timeline.Events {
+			switch e.Type {
+			case "m.room.member":
+				t.processMember(e)
+			case "m.room.message":
+				message, ok := t.formatMessage(e, b)
+				if ok && relayMessages && e.Sender != t.userID {
+					r.Relay(message)
+					go irchuubase.Log(message, t.logger)
+				}
+			}
+		}
+	}
+}
+
+// processMember remembers display names of room members.
+func (t *Transport) processMember(e event) {
+	if e.Type != "m.room.member" || e.StateKey == nil {
+		return
+	}
+	var content memberContent
+	if err := json.Unmarshal(e.Content, &content); err != nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if content.Membership == "join" && content.DisplayName != "" {
+		t.displayNames[*e.StateKey] = content.DisplayName
+	} else if content.Membership != "join" {
+		delete(t.displayNames, *e.StateKey)
+	}
+}
+
+// displayName returns the display name of a user or the localpart of their ID.
+func (t *Transport) displayName(userID string) string {
+	t.mu.Lock()
+	name := t.displayNames[userID]
+	t.mu.Unlock()
+	if name != "" {
+		return name
+	}
+	name = strings.TrimPrefix(userID, "@")
+	if i := strings.Index(name, ":"); i != -1 {
+		name = name[:i]
+	}
+	return name
+}
+
+// remember saves the sender name of an event to resolve replies to it.
+func (t *Transport) remember(eventID, name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.senders) >= maxKnownEvents {
+		t.senders = make(map[string]string)
+	}
+	t.senders[eventID] = name
+}
+
+// formatMessage maps an m.room.message event onto the universal message
+// struct (relay.Message). It returns false if the event can't be relayed.
+func (t *Transport) formatMessage(e event, b *config.Bridge) (relay.Message, bool) {
+	var content messageContent
+	if err := json.Unmarshal(e.Content, &content); err != nil {
+		return relay.Message{}, false
+	}
+
+	name := t.displayName(e.Sender)
+	t.remember(e.EventID, name)
+	extra := make(map[string]string)
+	text := content.Body
+
+	if content.RelatesTo != nil {
+		if content.RelatesTo.RelType == "m.replace" && content.NewContent != nil {
+			extra["edit"] = strconv.FormatInt(e.OriginServerTS/1000, 10)
+			text = content.NewContent.Body
+		} else if content.RelatesTo.InReplyTo != nil {
+			t.mu.Lock()
+			reply := t.senders[content.RelatesTo.InReplyTo.EventID]
+			t.mu.Unlock()
+			if reply != "" {
+				extra["reply"] = reply
+			}
+			text = stripReplyFallback(text)
+		}
+	}
+
+	switch content.MsgType {
+	case "m.text":
+	case "m.notice":
+	case "m.emote":
+		extra["special"] = "ACTION"
+	case "m.image", "m.file", "m.video", "m.audio":
+		switch content.MsgType {
+		case "m.image":
+			extra["media"] = "photo"
+		case "m.file":
+			extra["media"] = "document"
+		case "m.video":
+			extra["media"] = "video"
+		case "m.audio":
+			extra["media"] = "audio"
+		}
+		t.storeMedia(content, extra)
+		extra["mediaName"] = content.Body
+		if content.Info != nil {
+			extra["mime"] = content.Info.MimeType
+			extra["size"] = strconv.Itoa(content.Info.Size)
+			extra["width"] = strconv.Itoa(content.Info.Width)
+			extra["height"] = strconv.Itoa(content.Info.Height)
+			extra["duration"] = strconv.Itoa(content.Info.Duration / 1000)
+		}
+		text = ""
+	default:
+		return relay.Message{}, false
+	}
+
+	return relay.Message{
+		Date:   time.Unix(0, e.OriginServerTS*int64(time.Millisecond)),
+		Origin: transportName,
+		Bridge: b.Name,
+		Nick:   name,
+		Text:   text,
+		Extra:  extra,
+	}, true
+}
+
+// storeMedia re-hosts the media file of the message, since homeservers serve
+// it only with the access token, and puts its link into extra. The link to the
+// homeserver is relayed if the file is not re-hosted.
+func (t *Transport) storeMedia(content messageContent, extra map[string]string) {
+	extra["url"] = t.client.publicURL(content.URL)
+	if t.storage == nil || !strings.HasPrefix(content.URL, "mxc://") {
+		return
+	}
+	f, err := upload.Remote(content.URL, mediaName(content),
+		t.client.downloadURL(content.URL), t.client.authorization(), t.c.Storage)
+	var result upload.Result
+	if err == nil {
+		result, err = upload.StoreRemote(t.storage, f, t.c.Storage)
+	}
+	if err != nil {
+		t.logger.Printf("Cannot re-host %v: %v\n", content.URL, err)
+		return
+	}
+	extra["url"] = result.URL
+	if !result.Expires.IsZero() {
+		extra["expires"] = strconv.FormatInt(result.Expires.Unix(), 10)
+	}
+}
+
+// mediaName returns the name of the media file with the extension of its type
+// if the name has none.
+func mediaName(content messageContent) string {
+	name := content.Body
+	if path.Ext(name) == "" && content.Info != nil {
+		if exts, _ := mime.ExtensionsByType(content.Info.MimeType); len(exts) != 0 {
+			name += exts[0]
+		}
+	}
+	return name
+}
+
+// stripReplyFallback removes the quote of the original message which clients
+// put before the text of a reply.
+func stripReplyFallback(text string) string {
+	lines := strings.Split(text, "\n")
+	i := 0
+	for i < len(lines) && strings.HasPrefix(lines[i], ">") {
+		i++
+	}
+	if i == 0 {
+		return text
+	}
+	if i < len(lines) && lines[i] == "" {
+		i++
+	}
+	return strings.Join(lines[i:], "\n")
+}
+
+// listenService listens to service messages and executes them.
+func (t *Transport) listenService() {
+	for f := range t.services {
+		t.mu.Lock()
+		roomID := t.bridgeRooms[f.Bridge]
+		t.mu.Unlock()
+		if roomID == "" || len(f.Arguments) == 0 {
+			continue
+		}
+		var content *messageContent
+		switch f.Command {
+		case "announce":
+			content = &messageContent{MsgType: "m.notice",
+				Body: relay.StripFormatting(f.Arguments[0])}
+		case "action":
+			content = &messageContent{MsgType: "m.emote",
+				Body: relay.StripFormatting(f.Arguments[0])}
+		default:
+			continue
+		}
+		if _, err := t.client.send(roomID, content); err != nil {
+			t.logger.Printf("Sending message failed: %v\n", err)
+		}
+	}
+}
+
+// formatMatrixMessage translates a universal message into Matrix's one with
+// both plain and HTML bodies.
+func formatMatrixMessage(message relay.Message, c *config.Matrix) *messageContent {
+	text := relay.StripFormatting(message.Text)
+	nick := message.Name()
+	content := &messageContent{MsgType: "m.text"}
+
+	// both writes the formatted text into the plain and the HTML bodies,
+	// emboldening the arguments in HTML
+	both := func(format string, a ...interface{}) {
+		plain := make([]interface{}, len(a))
+		bold := make([]interface{}, len(a))
+		for i, v := range a {
+			plain[i] = v
+			bold[i] = "<b>" + html.EscapeString(fmt.Sprint(v)) + "</b>"
+		}
+		content.Body = fmt.Sprintf(format, plain...)
+		content.FormattedBody = fmt.Sprintf(html.EscapeString(format), bold...)
+	}
+
+	switch message.Extra["special"] {
+	case "ACTION":
+		content.MsgType = "m.emote"
+		content.Body = nick + " " + text
+		content.FormattedBody = "<b>" + html.EscapeString(nick) + "</b> " +
+			html.EscapeString(text)
+	case "JOIN":
+		both("%v has joined.", nick)
+	case "PART":
+		if text == "" {
+			both("%v has left.", nick)
+		} else {
+			both("%v has left: %v.", nick, text)
+		}
+	case "QUIT":
+		if text == "" {
+			both("%v has quit.", nick)
+		} else {
+			both("%v has quit: %v.", nick, text)
+		}
+	case "KICK":
+		both("%v has kicked %v.", nick, text)
+	case "NICK":
+		both("%v is now known as %v.", nick, text)
+	case "TOPIC":
+		both("%v has set a new topic: %v.", nick, text)
+	case "MODE":
+		both("%v has set mode %v.", nick, text)
+	case "pin":
+		both("%v pinned %v's message: %v", message.Extra["pin"], nick, text)
+	case "newChatMember":
+		if strconv.Itoa(message.FromID) == message.Extra["memberID"] {
+			both("%v joined the group via invite link.",
+				message.Extra["memberName"])
+		} else {
+			both("%v was added by %v.", message.Extra["memberName"], nick)
+		}
+	case "leftChatMember":
+		if strconv.Itoa(message.FromID) == message.Extra["memberID"] {
+			both("%v left the group.", message.Extra["memberName"])
+		} else {
+			both("%v was removed by %v.", message.Extra["memberName"], nick)
+		}
+	case "newChatTitle":
+		both("Chat renamed to \"%v\" by %v.", message.Extra["title"], nick)
+	case "newChatPhoto":
+		both("The chat photo has been changed by %v.", nick)
+	case "deleteChatPhoto":
+		both("The chat photo has been deleted by %v.", nick)
+	default:
+		if message.Extra["special"] == "NOTICE" {
+			content.MsgType = "m.notice"
+		}
+		if message.Extra["forward"] != "" {
+			text = fmt.Sprintf("[fwd from @%v] %v", message.Extra["forward"], text)
+		} else if message.Extra["forwardChatTitle"] != "" {
+			text = fmt.Sprintf("[fwd from channel %v] %v",
+				message.Extra["forwardChatTitle"], text)
+		} else if message.Extra["reply"] != "" {
+			text = fmt.Sprintf("%v, %v", message.Extra["reply"], text)
+		}
+		if message.Extra["edit"] != "" {
+			text = "[edited] " + text
+		}
+
+		htmlText := html.EscapeString(text)
+		if urls := message.MediaURLs(); len(urls) != 0 {
+			links := make([]string, len(urls))
+			for i, url := range urls {
+				description := mediaDescription(message)
+				if len(urls) > 1 {
+					description += fmt.Sprintf(" %d", i+1)
+				}
+				links[i] = fmt.Sprintf("<a href=\"%v\">%v</a>",
+					html.EscapeString(url), html.EscapeString(description))
+			}
+			text = strings.TrimSpace(text + " " + strings.Join(urls, " "))
+			htmlText = strings.TrimSpace(htmlText + " " + strings.Join(links, " "))
+		} else if message.Extra["media"] != "" {
+			text = strings.TrimSpace(text + " (" + mediaDescription(message) + ")")
+			htmlText = html.EscapeString(text)
+		}
+
+		content.Body = c.Prefix + nick + c.Postfix + " " + text
+		content.FormattedBody = html.EscapeString(c.Prefix) + "<b>" +
+			html.EscapeString(nick) + "</b>" + html.EscapeString(c.Postfix) +
+			" " + htmlText
+	}
+
+	content.Format = "org.matrix.custom.html"
+	return content
+}
+
+// mediaDescription returns a short description of the media of a message.
+func mediaDescription(message relay.Message) string {
+	switch message.Extra["media"] {
+	case "":
+		return "link"
+	case "document", "audio":
+		if message.Extra["mediaName"] != "" {
+			return message.Extra["media"] + " \"" + message.Extra["mediaName"] + "\""
+		}
+	}
+	return message.Extra["media"]
+}
@@ -0,0 +1,238 @@
+package matrix
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/26000/irchuu/config"
+	"github.com/26000/irchuu/relay"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeHomeServer is a homeserver which speaks just enough of the
+// client-server API for the transport.
+type fakeHomeServer struct {
+	mu      sync.Mutex
+	batch   int
+	pending []string                  // timeline events to return on sync
+	sent    map[string]messageContent // by room ID
+}
+
+func (s *fakeHomeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"errcode":"M_UNKNOWN_TOKEN","error":"Unknown token"}`)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.EscapedPath(), apiPrefix)
+	switch {
+	case r.URL.Path == "/_matrix/client/v1/media/download/example.org/cat":
+		fmt.Fprint(w, "meow")
+	case path == "/account/whoami":
+		fmt.Fprint(w, `{"user_id":"@irchuu:example.org"}`)
+	case path == "/join/%23irchuu:example.org":
+		fmt.Fprint(w, `{"room_id":"!room:example.org"}`)
+	case path == "/sync":
+		s.batch++
+		events := "[]"
+		if r.URL.Query().Get("since") != "" {
+			events = "[" + strings.Join(s.pending, ",") + "]"
+			s.pending = nil
+		}
+		fmt.Fprintf(w, `{"next_batch":"b%v","rooms":{"join":{"!room:example.org":`+
+			`{"state":{"events":[{"type":"m.room.member","state_key":"@alice:example.org",`+
+			`"sender":"@alice:example.org","content":{"membership":"join","displayname":"Alice"}}]},`+
+			`"timeline":{"events":%v}}}}}`, s.batch, events)
+	case strings.HasPrefix(path, "/rooms/%21room:example.org/send/m.room.message/"):
+		var content messageContent
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &content)
+		s.sent["!room:example.org"] = content
+		fmt.Fprint(w, `{"event_id":"$sent"}`)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"errcode":"M_UNRECOGNIZED","error":"Unrecognized request"}`)
+	}
+}
+
+// recorder is a transport which records messages sent to it.
+type recorder struct {
+	messages chan relay.Message
+}
+
+func (t *recorder) Name() string                                   { return "irc" }
+func (t *recorder) Start(r *relay.Router) error                    { select {} }
+func (t *recorder) Stop() error                                    { return nil }
+func (t *recorder) Send(message relay.Message) error               { t.messages <- message; return nil }
+func (t *recorder) SendService(message relay.ServiceMessage) error { return nil }
+func (t *recorder) Health() error                                  { return nil }
+
+func TestTransport(t *testing.T) {
+	assert := assert.New(t)
+	hs := &fakeHomeServer{sent: make(map[string]messageContent)}
+	hs.pending = []string{
+		`{"type":"m.room.message","event_id":"$1","sender":"@alice:example.org",` +
+			`"origin_server_ts":1478176875000,"content":{"msgtype":"m.text","body":"konnichiha!"}}`,
+		`{"type":"m.room.message","event_id":"$2","sender":"@irchuu:example.org",` +
+			`"origin_server_ts":1478176876000,"content":{"msgtype":"m.text","body":"echo"}}`,
+		`{"type":"m.room.message","event_id":"$3","sender":"@bob:example.org",` +
+			`"origin_server_ts":1478176877000,"content":{"msgtype":"m.text",` +
+			`"body":"> <@alice:example.org> konnichiha!\n\nhi","m.relates_to":` +
+			`{"m.in_reply_to":{"event_id":"$1"}}}}`,
+		`{"type":"m.room.message","event_id":"$4","sender":"@bob:example.org",` +
+			`"origin_server_ts":1478176878000,"content":{"msgtype":"m.image",` +
+			`"body":"cat.png","url":"mxc://example.org/cat","info":{"size":1024,"w":20,"h":10}}}`,
+	}
+	server := httptest.NewServer(hs)
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "irchuu")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	bridges := []*config.Bridge{
+		&config.Bridge{Name: "irchuu", MatrixRoom: "#irchuu:example.org"},
+	}
+	r := relay.NewRouter(bridges)
+	rec := &recorder{messages: make(chan relay.Message, 10)}
+	r.Add(rec)
+	tr := NewTransport(&config.Matrix{HomeServer: server.URL + "/",
+		AccessToken: "token", Prefix: "<", Postfix: ">", SyncTimeout: 1,
+		Storage: &config.Telegram{Storage: "server", BaseURL: "https://media.org",
+			DataDir: dir, UploadTimeout: 10}})
+	r.Add(tr)
+	go r.Start()
+	defer r.Stop()
+
+	m := receive(t, rec.messages)
+	assert.Equal("matrix", m.Origin)
+	assert.Equal("irchuu", m.Bridge)
+	assert.Equal("Alice", m.Nick)
+	assert.Equal("konnichiha!", m.Text)
+
+	// own messages are not relayed
+	m = receive(t, rec.messages)
+	assert.Equal("bob", m.Nick)
+	assert.Equal("hi", m.Text)
+	assert.Equal("Alice", m.Extra["reply"])
+
+	m = receive(t, rec.messages)
+	assert.Equal("photo", m.Extra["media"])
+	// the homeserver serves the file only with the token, so it is re-hosted
+	assert.Equal("https://media.org/"+
+		"404cdd7bc109c432f8cc2443b45bcfe95980f5107215c645236e577929ac3e52.png",
+		m.Extra["url"])
+	assert.Equal("1024", m.Extra["size"])
+
+	r.Relay(relay.Message{Origin: "irc", Bridge: "irchuu", Nick: "nick",
+		Text: "\x02hello\x0f & bye"})
+	assert.Eventually(func() bool {
+		hs.mu.Lock()
+		defer hs.mu.Unlock()
+		return hs.sent["!room:example.org"].Body == "<nick> hello & bye"
+	}, time.Second, 10*time.Millisecond)
+	hs.mu.Lock()
+	assert.Equal("&lt;<b>nick</b>&gt; hello &amp; bye",
+		hs.sent["!room:example.org"].FormattedBody)
+	hs.mu.Unlock()
+	assert.NoError(tr.Health())
+}
+
+func TestStoreMedia(t *testing.T) {
+	assert := assert.New(t)
+	tr := NewTransport(&config.Matrix{HomeServer: "https://example.org"})
+	extra := make(map[string]string)
+	// without a storage, the link to the homeserver is relayed
+	tr.storeMedia(messageContent{URL: "mxc://example.org/cat"}, extra)
+	assert.Equal("https://example.org/_matrix/media/v3/download/example.org/cat",
+		extra["url"])
+
+	content := messageContent{Body: "cat"}
+	assert.Equal("cat", mediaName(content))
+	content.Info = &struct {
+		MimeType string `json:"mimetype"`
+		Size     int    `json:"size"`
+		Width    int    `json:"w"`
+		Height   int    `json:"h"`
+		Duration int    `json:"duration"`
+	}{MimeType: "image/png"}
+	assert.Equal("cat.png", mediaName(content))
+}
+
+func TestTransport_BadToken(t *testing.T) {
+	server := httptest.NewServer(&fakeHomeServer{})
+	defer server.Close()
+
+	tr := NewTransport(&config.Matrix{HomeServer: server.URL,
+		AccessToken: "wrong", SyncTimeout: 1})
+	done := make(chan error)
+	go func() { done <- tr.Start(relay.NewRouter(nil)) }()
+	// the transport keeps retrying and reports why it cannot connect
+	assert.Eventually(t, func() bool {
+		err := tr.Health()
+		return err != nil &&
+			err.Error() == "failed to log in: 401 M_UNKNOWN_TOKEN: Unknown token"
+	}, time.Second, 10*time.Millisecond)
+	tr.Stop()
+	assert.NoError(t, <-done)
+	// the router may stop it again
+	assert.NotPanics(t, func() { tr.Stop() })
+}
+
+func TestFormatMatrixMessage(t *testing.T) {
+	assert := assert.New(t)
+	c := &config.Matrix{Prefix: "", Postfix: ":"}
+
+	content := formatMatrixMessage(relay.Message{Origin: "irc", Nick: "nick",
+		Text: "waves", Extra: map[string]string{"special": "ACTION"}}, c)
+	assert.Equal("m.emote", content.MsgType)
+	assert.Equal("nick waves", content.Body)
+
+	content = formatMatrixMessage(relay.Message{Origin: "irc", Nick: "nick",
+		Text: "bye", Extra: map[string]string{"special": "QUIT"}}, c)
+	assert.Equal("nick has quit: bye.", content.Body)
+	assert.Equal("<b>nick</b> has quit: <b>bye</b>.", content.FormattedBody)
+
+	content = formatMatrixMessage(relay.Message{Origin: "telegram",
+		FirstName: "IRChuu~", Text: "look", Extra: map[string]string{
+			"media": "photo", "url": "https://example.org/a.jpg"}}, c)
+	assert.Equal("IRChuu~: look https://example.org/a.jpg", content.Body)
+	assert.Equal("<b>IRChuu~</b>: look <a href=\"https://example.org/a.jpg\">photo</a>",
+		content.FormattedBody)
+
+	content = formatMatrixMessage(relay.Message{Origin: "telegram",
+		FirstName: "IRChuu~", Text: "trip", Extra: map[string]string{
+			"media": "album", "album": "https://a.org/1.jpg https://a.org/2.jpg",
+			"items": "2"}}, c)
+	assert.Equal("IRChuu~: trip https://a.org/1.jpg https://a.org/2.jpg", content.Body)
+	assert.Equal("<b>IRChuu~</b>: trip <a href=\"https://a.org/1.jpg\">album 1</a> "+
+		"<a href=\"https://a.org/2.jpg\">album 2</a>", content.FormattedBody)
+}
+
+func TestStripReplyFallback(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("hi", stripReplyFallback("> <@a:b> quote\n> more\n\nhi"))
+	assert.Equal("no quote", stripReplyFallback("no quote"))
+}
+
+// receive waits for a message.
+func receive(t *testing.T, messages chan relay.Message) relay.Message {
+	select {
+	case m := <-messages:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+	return relay.Message{}
+}
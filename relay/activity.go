@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Activity remembers when users last spoke in the channels of bridges, so
+// joins and parts are relayed only for those who took part in the
+// conversation.
+type Activity struct {
+	window time.Duration
+	mu     sync.Mutex
+	spoke  map[string]map[string]time.Time // by bridge and lowercase nick
+	pruned time.Time
+}
+
+// NewActivity creates an activity tracker. With zero window every user
+// counts as active.
+func NewActivity(window time.Duration) *Activity {
+	return &Activity{window: window,
+		spoke: make(map[string]map[string]time.Time), pruned: time.Now()}
+}
+
+// Said remembers that the nick has spoken in the bridge.
+func (a *Activity) Said(bridge, nick string) {
+	if a.window == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.spoke[bridge] == nil {
+		a.spoke[bridge] = make(map[string]time.Time)
+	}
+	a.spoke[bridge][strings.ToLower(nick)] = time.Now()
+
+	if time.Since(a.pruned) > a.window {
+		for _, nicks := range a.spoke {
+			for nick, t := range nicks {
+				if time.Since(t) > a.window {
+					delete(nicks, nick)
+				}
+			}
+		}
+		a.pruned = time.Now()
+	}
+}
+
+// Active returns true if the nick has spoken in the bridge within the window.
+func (a *Activity) Active(bridge, nick string) bool {
+	if a.window == 0 {
+		return true
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	t, ok := a.spoke[bridge][strings.ToLower(nick)]
+	return ok && time.Since(t) <= a.window
+}
+
+// Rename moves the activity of the nick to the new one in all bridges.
+func (a *Activity) Rename(nick, newNick string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	nick, newNick = strings.ToLower(nick), strings.ToLower(newNick)
+	for _, nicks := range a.spoke {
+		if t, ok := nicks[nick]; ok {
+			delete(nicks, nick)
+			nicks[newNick] = t
+		}
+	}
+}
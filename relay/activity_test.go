@@ -0,0 +1,28 @@
+package relay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActivity(t *testing.T) {
+	assert := assert.New(t)
+	a := NewActivity(time.Minute)
+	assert.False(a.Active("irchuu", "alice"))
+
+	a.Said("irchuu", "Alice")
+	assert.True(a.Active("irchuu", "alice"))
+	assert.False(a.Active("koto", "alice"))
+
+	a.Rename("alice", "alice_")
+	assert.False(a.Active("irchuu", "alice"))
+	assert.True(a.Active("irchuu", "ALICE_"))
+
+	a.spoke["irchuu"]["alice_"] = time.Now().Add(-2 * time.Minute)
+	assert.False(a.Active("irchuu", "alice_"))
+
+	// everyone is active without the window
+	assert.True(NewActivity(0).Active("irchuu", "bob"))
+}
@@ -0,0 +1,48 @@
+package relay
+
+import "time"
+
+// Backoff is a delay between attempts to connect which doubles after every
+// failed attempt up to a limit.
+type Backoff struct {
+	min, max time.Duration
+	delay    time.Duration
+}
+
+// NewBackoff creates a Backoff starting with min and growing up to max.
+func NewBackoff(min, max time.Duration) *Backoff {
+	return &Backoff{min: min, max: max, delay: min}
+}
+
+// Delay returns the delay before the next attempt.
+func (b *Backoff) Delay() time.Duration {
+	return b.delay
+}
+
+// Wait sleeps for the delay and doubles it. It returns false if stop is
+// closed meanwhile.
+func (b *Backoff) Wait(stop <-chan struct{}) bool {
+	return b.WaitOrResume(stop, nil)
+}
+
+// WaitOrResume is like Wait, but returns at once and resets the delay when
+// something is received from resume, e. g. when the other side is back.
+func (b *Backoff) WaitOrResume(stop, resume <-chan struct{}) bool {
+	select {
+	case <-time.After(b.delay):
+	case <-resume:
+		b.Reset()
+		return true
+	case <-stop:
+		return false
+	}
+	if b.delay *= 2; b.delay > b.max {
+		b.delay = b.max
+	}
+	return true
+}
+
+// Reset resets the delay after a successful attempt.
+func (b *Backoff) Reset() {
+	b.delay = b.min
+}
@@ -0,0 +1,30 @@
+package relay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+	b := NewBackoff(time.Millisecond, 3*time.Millisecond)
+	stop := make(chan struct{})
+	assert.True(b.Wait(stop))
+	assert.Equal(2*time.Millisecond, b.Delay())
+	assert.True(b.Wait(stop))
+	assert.Equal(3*time.Millisecond, b.Delay())
+	b.Reset()
+	assert.Equal(time.Millisecond, b.Delay())
+
+	resume := make(chan struct{}, 1)
+	resume <- struct{}{}
+	b = NewBackoff(time.Millisecond, time.Hour)
+	b.Wait(stop)
+	assert.True(b.WaitOrResume(stop, resume))
+	assert.Equal(time.Millisecond, b.Delay())
+
+	close(stop)
+	assert.False(NewBackoff(time.Hour, time.Hour).Wait(stop))
+}
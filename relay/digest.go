@@ -0,0 +1,188 @@
+package relay
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxListedNicks is the number of nicks listed in a summary.
+const MaxListedNicks = 10
+
+// splitMemory is how long nicks lost in a netsplit are remembered to be
+// counted as rejoined when they come back.
+const splitMemory = 30 * time.Minute
+
+// netsplitReason matches quit messages of netsplits, which consist of the
+// names of the two servers. Servers prefix quit messages of users, so they
+// cannot be faked.
+var netsplitReason = regexp.MustCompile(`^([^\s.]+\.\S+) ([^\s.]+\.\S+)$`)
+
+// Digest collects joins, parts and quits for a while and summarizes them,
+// so netsplits and floods do not flood other networks.
+type Digest struct {
+	window   time.Duration
+	single   func(Message)             // relays a single event as is
+	announce func(bridge, text string) // announces a summary
+	mu       sync.Mutex
+	pending  map[string]*digestWindow   // by bridge
+	lost     map[string]map[string]lost // nicks lost in netsplits by bridge
+}
+
+// digestWindow is the events collected for a bridge during the window.
+type digestWindow struct {
+	events []Message
+	joined []string
+	left   []string
+	splits []*split
+}
+
+// split counts users who quit in a netsplit and those who rejoined.
+type split struct {
+	servers  string
+	quit     int
+	rejoined int
+}
+
+// lost is a nick lost in a netsplit.
+type lost struct {
+	servers string
+	time    time.Time
+}
+
+// NewDigest creates a digest which summarizes the events of every window.
+// With zero window events are relayed immediately.
+func NewDigest(window time.Duration, single func(Message),
+	announce func(bridge, text string)) *Digest {
+	return &Digest{
+		window:   window,
+		single:   single,
+		announce: announce,
+		pending:  make(map[string]*digestWindow),
+		lost:     make(map[string]map[string]lost),
+	}
+}
+
+// Add collects a JOIN, PART or QUIT event.
+func (d *Digest) Add(message Message) {
+	if d.window == 0 {
+		d.single(message)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	w := d.pending[message.Bridge]
+	if w == nil {
+		w = &digestWindow{}
+		d.pending[message.Bridge] = w
+		time.AfterFunc(d.window, func() { d.flush(message.Bridge) })
+	}
+	w.events = append(w.events, message)
+
+	lostNicks := d.lost[message.Bridge]
+	if lostNicks == nil {
+		lostNicks = make(map[string]lost)
+		d.lost[message.Bridge] = lostNicks
+	}
+	nick := strings.ToLower(message.Nick)
+	switch message.Extra["special"] {
+	case "JOIN":
+		if l, ok := lostNicks[nick]; ok {
+			delete(lostNicks, nick)
+			w.split(l.servers).rejoined++
+		} else {
+			w.joined = append(w.joined, message.Nick)
+		}
+	case "QUIT":
+		if servers := netsplitReason.FindStringSubmatch(message.Text); servers != nil {
+			between := fmt.Sprintf("%v ↔ %v", servers[1], servers[2])
+			lostNicks[nick] = lost{servers: between, time: time.Now()}
+			w.split(between).quit++
+		} else {
+			w.left = append(w.left, message.Nick)
+		}
+	default:
+		w.left = append(w.left, message.Nick)
+	}
+}
+
+// split returns the counters of the netsplit between the servers.
+func (w *digestWindow) split(servers string) *split {
+	for _, s := range w.splits {
+		if s.servers == servers {
+			return s
+		}
+	}
+	s := &split{servers: servers}
+	w.splits = append(w.splits, s)
+	return s
+}
+
+// flush relays the events collected for the bridge. A single event is
+// relayed as is, several ones are summarized.
+func (d *Digest) flush(bridge string) {
+	d.mu.Lock()
+	w := d.pending[bridge]
+	delete(d.pending, bridge)
+	for nick, l := range d.lost[bridge] {
+		if time.Since(l.time) > splitMemory {
+			delete(d.lost[bridge], nick)
+		}
+	}
+	d.mu.Unlock()
+
+	if w == nil {
+		return
+	}
+	if len(w.events) == 1 {
+		d.single(w.events[0])
+		return
+	}
+	d.announce(bridge, w.summary())
+}
+
+// summary describes the events of the window in a single line.
+func (w *digestWindow) summary() string {
+	var parts []string
+	for _, s := range w.splits {
+		switch {
+		case s.quit == 0:
+			parts = append(parts, fmt.Sprintf("%v rejoined after netsplit %v",
+				users(s.rejoined), s.servers))
+		case s.rejoined == 0:
+			parts = append(parts, fmt.Sprintf("%v quit in netsplit %v",
+				users(s.quit), s.servers))
+		default:
+			parts = append(parts, fmt.Sprintf("%v quit in netsplit %v; %d rejoined",
+				users(s.quit), s.servers, s.rejoined))
+		}
+	}
+	if len(w.joined) != 0 {
+		parts = append(parts, "joined: "+ListNicks(w.joined))
+	}
+	if len(w.left) != 0 {
+		parts = append(parts, "left: "+ListNicks(w.left))
+	}
+	text := strings.Join(parts, "; ") + "."
+	return strings.ToUpper(text[:1]) + text[1:]
+}
+
+// users returns "1 user" or "n users".
+func users(n int) string {
+	if n == 1 {
+		return "1 user"
+	}
+	return fmt.Sprintf("%d users", n)
+}
+
+// ListNicks joins the nicks, listing no more than MaxListedNicks of them.
+func ListNicks(nicks []string) string {
+	if len(nicks) > MaxListedNicks {
+		return fmt.Sprintf("%v and %d more", strings.Join(nicks[:MaxListedNicks], ", "),
+			len(nicks)-MaxListedNicks)
+	}
+	return strings.Join(nicks, ", ")
+}
@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDigest(t *testing.T) {
+	assert := assert.New(t)
+	relayed := make(chan Message, 10)
+	announced := make(chan string, 10)
+	d := NewDigest(10*time.Millisecond,
+		func(m Message) { relayed <- m },
+		func(bridge, text string) { announced <- bridge + ": " + text })
+	event := func(nick, text, action string) Message {
+		return Message{Bridge: "irchuu", Nick: nick, Text: text,
+			Extra: map[string]string{"special": action}}
+	}
+
+	// a single event is relayed as is
+	d.Add(event("alice", "", "JOIN"))
+	assert.Equal("alice", (<-relayed).Nick)
+
+	for _, nick := range []string{"a", "b", "c"} {
+		d.Add(event(nick, "irc.a.org irc.b.org", "QUIT"))
+	}
+	d.Add(event("bob", "Quit: bye", "QUIT"))
+	d.Add(event("carol", "", "PART"))
+	assert.Equal("irchuu: 3 users quit in netsplit irc.a.org ↔ irc.b.org; "+
+		"left: bob, carol.", <-announced)
+
+	d.Add(event("A", "", "JOIN"))
+	d.Add(event("b", "", "JOIN"))
+	d.Add(event("dave", "", "JOIN"))
+	assert.Equal("irchuu: 2 users rejoined after netsplit irc.a.org ↔ irc.b.org; "+
+		"joined: dave.", <-announced)
+
+	d.Add(event("c", "irc.a.org irc.b.org", "QUIT"))
+	d.Add(event("c", "", "JOIN"))
+	assert.Equal("irchuu: 1 user quit in netsplit irc.a.org ↔ irc.b.org; "+
+		"1 rejoined.", <-announced)
+	assert.Empty(relayed)
+
+	d = NewDigest(0, func(m Message) { relayed <- m }, nil)
+	d.Add(event("alice", "", "PART"))
+	assert.Equal("alice", (<-relayed).Nick)
+}
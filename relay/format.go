@@ -0,0 +1,12 @@
+package relay
+
+import "regexp"
+
+// formattingRegex matches IRC formatting codes, which are used in the text of
+// universal messages.
+var formattingRegex = regexp.MustCompile("\x03(?:\\d{1,2}(?:,\\d{1,2})?)?|[\x02\x0f\x11\x16\x1d\x1e\x1f]")
+
+// StripFormatting removes IRC formatting codes from the text.
+func StripFormatting(text string) string {
+	return formattingRegex.ReplaceAllLiteralString(text, "")
+}
@@ -0,0 +1,162 @@
+package relay
+
+import (
+	"strings"
+	"sync"
+)
+
+// indexSize is the number of messages remembered by an Index.
+const indexSize = 1000
+
+// messageKey identifies a message in a transport.
+type messageKey struct {
+	bridge, transport, id string
+}
+
+// indexEntry is a message remembered by an Index.
+type indexEntry struct {
+	key    messageKey
+	nick   string // as shown in other transports
+	text   string
+	copies map[string]string // IDs of copies by transport
+}
+
+// Index remembers recently relayed messages and the IDs of their copies in
+// other transports, so edits, deletions and replies can follow them.
+type Index struct {
+	mu      sync.Mutex
+	entries map[messageKey]*indexEntry
+	order   []messageKey // ring buffer, oldest messages are forgotten
+	next    int
+}
+
+// NewIndex creates an empty Index.
+func NewIndex() *Index {
+	return &Index{
+		entries: make(map[messageKey]*indexEntry),
+		order:   make([]messageKey, 0, indexSize),
+	}
+}
+
+// add remembers a message. If it was already known, add returns its previous
+// text.
+func (i *Index) add(message Message) (string, bool) {
+	key := messageKey{message.Bridge, message.Origin, message.MessageID()}
+	if key.id == "" {
+		return "", false
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if e, ok := i.entries[key]; ok {
+		text := e.text
+		e.text = message.Text
+		return text, true
+	}
+
+	if len(i.order) < indexSize {
+		i.order = append(i.order, key)
+	} else {
+		delete(i.entries, i.order[i.next])
+		i.order[i.next] = key
+		i.next = (i.next + 1) % indexSize
+	}
+	i.entries[key] = &indexEntry{key: key, nick: message.Name(),
+		text: message.Text, copies: make(map[string]string)}
+	return "", false
+}
+
+// SetCopy remembers the ID of the copy of a message sent to a transport.
+func (i *Index) SetCopy(message Message, transport, id string) {
+	key := messageKey{message.Bridge, message.Origin, message.MessageID()}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if e, ok := i.entries[key]; ok {
+		e.copies[transport] = id
+	}
+}
+
+// Copy returns the ID of the copy sent to a transport of the message with the
+// given ID in its origin transport.
+func (i *Index) Copy(bridge, origin, id, transport string) (string, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	e, ok := i.entries[messageKey{bridge, origin, id}]
+	if !ok || e.copies[transport] == "" {
+		return "", false
+	}
+	return e.copies[transport], true
+}
+
+// Resolve returns the ID in the target transport of the message known by the
+// ID in the transport, which is either the origin of the message or has its
+// copy.
+func (i *Index) Resolve(bridge, transport, id, target string) (string, bool) {
+	if transport == target {
+		return id, true
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if e, ok := i.entries[messageKey{bridge, transport, id}]; ok {
+		return e.copies[target], e.copies[target] != ""
+	}
+	for _, e := range i.entries {
+		if e.key.bridge != bridge || e.copies[transport] != id {
+			continue
+		}
+		if e.key.transport == target {
+			return e.key.id, true
+		}
+		return e.copies[target], e.copies[target] != ""
+	}
+	return "", false
+}
+
+// Addressed finds the latest message of the user whom the text is addressed
+// to with "nick: text", "nick, text" or "@nick text" and returns its origin
+// transport and ID.
+func (i *Index) Addressed(bridge, text string) (string, string, bool) {
+	text = strings.ToLower(text)
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for n := 1; n <= len(i.order); n++ {
+		key := i.order[(i.next-n+len(i.order))%len(i.order)]
+		e := i.entries[key]
+		if key.bridge == bridge && e.nick != "" && addresses(text, strings.ToLower(e.nick)) {
+			return key.transport, key.id, true
+		}
+	}
+	return "", "", false
+}
+
+// addresses returns whether the lowercase text is addressed to the nick.
+func addresses(text, nick string) bool {
+	// rest returns whether the text continues with one of the characters or
+	// ends after the prefix
+	rest := func(prefix, chars string) bool {
+		if !strings.HasPrefix(text, prefix) {
+			return false
+		}
+		return len(text) == len(prefix) || strings.ContainsRune(chars, rune(text[len(prefix)]))
+	}
+	if rest("@"+nick, " :,") {
+		return true
+	}
+	return rest(nick+":", " ") || rest(nick+",", " ")
+}
+
+// Last returns the ID and the text of the latest message of a user in a
+// transport.
+func (i *Index) Last(bridge, transport, nick string) (string, string, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for n := 1; n <= len(i.order); n++ {
+		key := i.order[(i.next-n+len(i.order))%len(i.order)]
+		e := i.entries[key]
+		if key.bridge == bridge && key.transport == transport &&
+			strings.EqualFold(e.nick, nick) {
+			return key.id, e.text, true
+		}
+	}
+	return "", "", false
+}
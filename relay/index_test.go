@@ -0,0 +1,124 @@
+package relay
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndex(t *testing.T) {
+	assert := assert.New(t)
+	i := NewIndex()
+	tg := Message{Origin: "telegram", Bridge: "irchuu", ID: 42, Nick: "26000",
+		Text: "hello"}
+	irc := Message{Origin: "irc", Bridge: "irchuu", Nick: "nick", Text: "hi",
+		Extra: map[string]string{"msgid": "abc"}}
+
+	_, ok := i.add(tg)
+	assert.False(ok)
+	i.add(irc)
+	i.add(Message{Origin: "irc", Bridge: "irchuu", Nick: "nick", Text: "no ID"})
+	i.SetCopy(tg, "irc", "1")
+	i.SetCopy(irc, "telegram", "43")
+
+	id, ok := i.Copy("irchuu", "irc", "abc", "telegram")
+	assert.True(ok)
+	assert.Equal("43", id)
+	_, ok = i.Copy("irchuu", "telegram", "42", "matrix")
+	assert.False(ok)
+
+	tg.Text = "hello!"
+	text, ok := i.add(tg)
+	assert.True(ok)
+	assert.Equal("hello", text)
+
+	id, text, ok = i.Last("irchuu", "irc", "nick")
+	assert.True(ok)
+	assert.Equal("abc", id)
+	assert.Equal("hi", text)
+	_, _, ok = i.Last("koto", "irc", "nick")
+	assert.False(ok)
+
+	// old messages are forgotten
+	for n := 0; n < indexSize; n++ {
+		i.add(Message{Origin: "irc", Bridge: "irchuu", Nick: "nick",
+			Extra: map[string]string{"msgid": strconv.Itoa(n)}})
+	}
+	_, ok = i.Copy("irchuu", "irc", "abc", "telegram")
+	assert.False(ok)
+	id, _, _ = i.Last("irchuu", "irc", "nick")
+	assert.Equal(strconv.Itoa(indexSize-1), id)
+	assert.Len(i.entries, indexSize)
+}
+
+func TestRouter_RelayEdit(t *testing.T) {
+	assert := assert.New(t)
+	r := NewRouter(testBridges)
+	irc := newFakeTransport("irc")
+	r.Add(irc)
+	r.Add(newFakeTransport("telegram"))
+
+	message := Message{Origin: "telegram", Bridge: "irchuu", ID: 42,
+		Text: "hello", Extra: map[string]string{}}
+	assert.NoError(r.Relay(message))
+	message.Text = "hello!"
+	message.Extra = map[string]string{"edit": "1478176875"}
+	assert.NoError(r.Relay(message))
+	assert.Equal("", message.Extra["original"])
+
+	q := r.queue.(*MemoryQueue)
+	_, m, _, _ := q.Peek("irc")
+	assert.Equal("", m.Extra["original"])
+	q.Remove("irc", 1)
+	_, m, _, _ = q.Peek("irc")
+	assert.Equal("hello", m.Extra["original"])
+	assert.Equal("hello!", m.Text)
+}
+
+func TestIndex_Replies(t *testing.T) {
+	assert := assert.New(t)
+	i := NewIndex()
+	tg := Message{Origin: "telegram", Bridge: "irchuu", ID: 42,
+		FirstName: "IRChuu~", LastName: "Bot", Text: "hello"}
+	irc := Message{Origin: "irc", Bridge: "irchuu", Nick: "nick", Text: "hi",
+		Extra: map[string]string{"msgid": "abc"}}
+	i.add(tg)
+	i.add(irc)
+	i.SetCopy(tg, "irc", "def")
+	i.SetCopy(irc, "telegram", "43")
+
+	for _, text := range []string{"irchuu~ bot: hi", "@IRChuu~ Bot hi",
+		"IRChuu~ Bot, hi", "@irchuu~ bot"} {
+		transport, id, ok := i.Addressed("irchuu", text)
+		assert.True(ok, text)
+		assert.Equal("telegram", transport)
+		assert.Equal("42", id)
+	}
+	transport, id, ok := i.Addressed("irchuu", "Nick: hi")
+	assert.True(ok)
+	assert.Equal("irc", transport)
+	assert.Equal("abc", id)
+	for _, text := range []string{"nickname: hi", "nick:hi", "nick hi",
+		"http://example.org"} {
+		_, _, ok = i.Addressed("irchuu", text)
+		assert.False(ok, text)
+	}
+	_, _, ok = i.Addressed("koto", "nick: hi")
+	assert.False(ok)
+
+	// the origin, a copy or the same transport
+	id, ok = i.Resolve("irchuu", "irc", "abc", "telegram")
+	assert.True(ok)
+	assert.Equal("43", id)
+	id, ok = i.Resolve("irchuu", "irc", "def", "telegram")
+	assert.True(ok)
+	assert.Equal("42", id)
+	id, ok = i.Resolve("irchuu", "telegram", "7", "telegram")
+	assert.True(ok)
+	assert.Equal("7", id)
+	_, ok = i.Resolve("irchuu", "irc", "ghi", "telegram")
+	assert.False(ok)
+	_, ok = i.Resolve("irchuu", "irc", "abc", "matrix")
+	assert.False(ok)
+}
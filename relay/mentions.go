@@ -0,0 +1,47 @@
+package relay
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Mention is a mention of a Telegram user in the text of a message.
+type Mention struct {
+	Offset int `json:"offset"` // in bytes of the text
+	Length int `json:"length"` // in bytes
+	ID     int `json:"id"`
+}
+
+// Mentions returns the mentions of Telegram users in the text of the message
+// ordered by their offsets. Those outside the text are skipped.
+func (message *Message) Mentions() []Mention {
+	var mentions []Mention
+	if message.Extra["mentions"] != "" {
+		json.Unmarshal([]byte(message.Extra["mentions"]), &mentions)
+	}
+	valid := mentions[:0]
+	for _, m := range mentions {
+		if m.Offset >= 0 && m.Length > 0 && m.Offset+m.Length <= len(message.Text) {
+			valid = append(valid, m)
+		}
+	}
+	if len(valid) == 0 {
+		return nil
+	}
+	sort.Slice(valid, func(i, j int) bool { return valid[i].Offset < valid[j].Offset })
+	return valid
+}
+
+// SetMentions remembers the mentions of Telegram users in the text of the
+// message, so other transports can translate them.
+func (message *Message) SetMentions(mentions []Mention) {
+	if len(mentions) == 0 {
+		delete(message.Extra, "mentions")
+		return
+	}
+	data, _ := json.Marshal(mentions)
+	if message.Extra == nil {
+		message.Extra = make(map[string]string)
+	}
+	message.Extra["mentions"] = string(data)
+}
@@ -0,0 +1,261 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Queue is an outbound queue of messages with a FIFO per transport. Messages
+// stay in the queue until they are delivered and removed.
+type Queue interface {
+	// Push appends a message to the queue of a transport.
+	Push(transport string, message Message) error
+	// Peek returns the oldest message in the queue of a transport and its
+	// ID. It returns false if the queue is empty.
+	Peek(transport string) (int64, Message, bool, error)
+	// Remove removes a message from the queue of a transport.
+	Remove(transport string, id int64) error
+}
+
+// permanentError is an error which retrying won't fix.
+type permanentError struct {
+	error
+}
+
+// Permanent marks an error of Transport.Send as permanent: the message will
+// be dropped instead of being retried.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err}
+}
+
+// IsPermanent returns whether the error was marked as permanent.
+func IsPermanent(err error) bool {
+	_, ok := err.(permanentError)
+	return ok
+}
+
+// queued is a message in a MemoryQueue.
+type queued struct {
+	id      int64
+	message Message
+}
+
+// MemoryQueue is a Queue which does not survive restarts.
+type MemoryQueue struct {
+	mu     sync.Mutex
+	seq    int64
+	queues map[string][]queued
+}
+
+// NewMemoryQueue creates an empty MemoryQueue.
+func NewMemoryQueue() *MemoryQueue {
+	return &MemoryQueue{queues: make(map[string][]queued)}
+}
+
+// Push appends a message to the queue of a transport.
+func (q *MemoryQueue) Push(transport string, message Message) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.seq++
+	q.queues[transport] = append(q.queues[transport], queued{q.seq, message})
+	return nil
+}
+
+// Peek returns the oldest message in the queue of a transport.
+func (q *MemoryQueue) Peek(transport string) (int64, Message, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.queues[transport]) == 0 {
+		return 0, Message{}, false, nil
+	}
+	m := q.queues[transport][0]
+	return m.id, m.message, true, nil
+}
+
+// Remove removes a message from the queue of a transport.
+func (q *MemoryQueue) Remove(transport string, id int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, m := range q.queues[transport] {
+		if m.id == id {
+			q.queues[transport] = append(q.queues[transport][:i],
+				q.queues[transport][i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// FileQueue is a Queue which keeps every message in a file of its own, in a
+// directory per transport.
+type FileQueue struct {
+	dir string
+
+	mu    sync.Mutex
+	seq   int64
+	files map[string][]string // sorted by transport, loaded on first use
+}
+
+// NewFileQueue opens the queue in the directory, creating it if needed.
+func NewFileQueue(dir string) (*FileQueue, error) {
+	if err := os.MkdirAll(dir, os.FileMode(0700)); err != nil {
+		return nil, err
+	}
+	q := &FileQueue{dir: dir, files: make(map[string][]string)}
+
+	// sequence numbers continue from the last queued message
+	transports, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range transports {
+		if !t.IsDir() {
+			continue
+		}
+		files, err := q.list(t.Name())
+		if err != nil {
+			return nil, err
+		}
+		if len(files) != 0 {
+			if id := fileID(files[len(files)-1]); id > q.seq {
+				q.seq = id
+			}
+		}
+	}
+	return q, nil
+}
+
+// list returns the names of queued message files of a transport in order.
+func (q *FileQueue) list(transport string) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(q.dir, transport))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, info := range infos {
+		// files of messages being written start with a dot
+		if !info.IsDir() && !strings.HasPrefix(info.Name(), ".") &&
+			strings.HasSuffix(info.Name(), ".json") {
+			files = append(files, info.Name())
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// load loads the list of files of a transport if it is not loaded yet.
+func (q *FileQueue) load(transport string) error {
+	if _, ok := q.files[transport]; ok {
+		return nil
+	}
+	files, err := q.list(transport)
+	if err != nil {
+		return err
+	}
+	q.files[transport] = files
+	return nil
+}
+
+// Push writes a message to a new file in the directory of the transport.
+func (q *FileQueue) Push(transport string, message Message) error {
+	if strings.ContainsAny(transport, `/\.`) {
+		return fmt.Errorf("invalid transport name: %v", transport)
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err = q.load(transport); err != nil {
+		return err
+	}
+	dir := filepath.Join(q.dir, transport)
+	if err = os.MkdirAll(dir, os.FileMode(0700)); err != nil {
+		return err
+	}
+
+	q.seq++
+	name := fmt.Sprintf("%020d.json", q.seq)
+	// rename is atomic, so there are no half-written messages after a crash
+	tmp := filepath.Join(dir, "."+name)
+	if err = ioutil.WriteFile(tmp, data, os.FileMode(0600)); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	q.files[transport] = append(q.files[transport], name)
+	return nil
+}
+
+// Peek reads the oldest message of a transport. Unreadable files are
+// removed.
+func (q *FileQueue) Peek(transport string) (int64, Message, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.load(transport); err != nil {
+		return 0, Message{}, false, err
+	}
+
+	for len(q.files[transport]) != 0 {
+		name := q.files[transport][0]
+		path := filepath.Join(q.dir, transport, name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, Message{}, false, err
+		}
+		var message Message
+		if err == nil {
+			if err = json.Unmarshal(data, &message); err == nil {
+				return fileID(name), message, true, nil
+			}
+		}
+		os.Remove(path)
+		q.files[transport] = q.files[transport][1:]
+	}
+	return 0, Message{}, false, nil
+}
+
+// Remove deletes the file of a message.
+func (q *FileQueue) Remove(transport string, id int64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := q.load(transport); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%020d.json", id)
+	files := q.files[transport]
+	for i, f := range files {
+		if f == name {
+			q.files[transport] = append(files[:i], files[i+1:]...)
+			break
+		}
+	}
+	err := os.Remove(filepath.Join(q.dir, transport, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// fileID returns the ID of a message from the name of its file.
+func fileID(name string) int64 {
+	id, _ := strconv.ParseInt(strings.TrimSuffix(name, ".json"), 10, 64)
+	return id
+}
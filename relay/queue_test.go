@@ -0,0 +1,73 @@
+package relay
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileQueue(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "irchuu-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	q, err := NewFileQueue(dir)
+	assert.NoError(err)
+	_, _, ok, err := q.Peek("telegram")
+	assert.NoError(err)
+	assert.False(ok)
+
+	assert.NoError(q.Push("telegram", *testMessages[0]))
+	assert.NoError(q.Push("telegram", *testMessages[1]))
+	assert.NoError(q.Push("irc", *testMessages[1]))
+	assert.Error(q.Push("../telegram", *testMessages[0]))
+
+	id, m, ok, err := q.Peek("telegram")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(int64(1), id)
+	assert.Equal("irchuu", m.Nick)
+	assert.True(centralTime.Equal(m.Date))
+	assert.NoError(q.Remove("telegram", id))
+
+	// the queue survives restarts
+	q, err = NewFileQueue(dir)
+	assert.NoError(err)
+	id, m, ok, err = q.Peek("telegram")
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal(int64(2), id)
+	assert.Equal("IRChuu~ Bot", m.Name())
+	assert.NoError(q.Push("telegram", *testMessages[0]))
+	assert.NoError(q.Remove("telegram", id))
+	id, _, _, _ = q.Peek("telegram")
+	assert.Equal(int64(4), id)
+
+	// broken files are skipped
+	assert.NoError(ioutil.WriteFile(filepath.Join(dir, "irc",
+		"00000000000000000000.json"), []byte("{"), 0600))
+	q, err = NewFileQueue(dir)
+	assert.NoError(err)
+	id, _, ok, _ = q.Peek("irc")
+	assert.True(ok)
+	assert.Equal(int64(3), id)
+}
+
+func TestMemoryQueue(t *testing.T) {
+	assert := assert.New(t)
+	q := NewMemoryQueue()
+	assert.NoError(q.Push("irc", *testMessages[1]))
+	assert.NoError(q.Push("irc", *testMessages[0]))
+	id, m, ok, _ := q.Peek("irc")
+	assert.True(ok)
+	assert.Equal(*testMessages[1], m)
+	assert.NoError(q.Remove("irc", id))
+	_, m, _, _ = q.Peek("irc")
+	assert.Equal(*testMessages[0], m)
+}
@@ -1,42 +1,27 @@
+// Package relay contains the universal message format and the router which
+// passes messages between transports.
 package relay
 
-import "time"
+import (
+	"strconv"
+	"strings"
+	"time"
+)
 
-// NewRelay creates a new Relay.
-func NewRelay() *Relay {
-	teleCh := make(chan Message, 100)
-	irCh := make(chan Message, 100)
-	teleSCh := make(chan ServiceMessage, 20)
-	ircSCh := make(chan ServiceMessage, 20)
-	teleACh := make(chan ServiceMessage, 20)
-	return &Relay{teleCh, teleSCh, irCh, ircSCh, teleACh}
-}
-
-// Relay contains channels used by goroutines to exchange messages.
-type Relay struct {
-	TeleCh        chan Message
-	TeleServiceCh chan ServiceMessage
-	IRCh          chan Message
-	IRCServiceCh  chan ServiceMessage
-
-	// used for messages that need to be
-	// run even when IRC bot not in channel
-	TeleAlwaysCh chan ServiceMessage
-}
-
-// Message represents a generic message which may be either from TG or IRC.
+// Message represents a generic message which may come from any transport.
 type Message struct {
 	Date   time.Time // Time
-	Source bool      // IRC (false) or TG (true)
+	Origin string    // Name of the transport the message came from
+	Bridge string    // Name of the bridge the message belongs to
 	Nick   string    // Nickname in both IRC and Telegram
 	Text   string
 
-	ID        int    // Message ID, Telegram only
+	ID        int    // Message ID, Telegram only, see MessageID
 	FromID    int    // From user ID, Telegram only
 	FirstName string // Realname, Telegram only
 	LastName  string // Realname, Telegram only
 
-	// In IRC: CTCP (ACTION), kick, topic
+	// In IRC: CTCP (ACTION), kick, topic, msgid
 	// In Telegram: medias, replies, forwards, pins, edits, new/left members...
 	Extra map[string]string
 }
@@ -45,6 +30,9 @@ type Message struct {
 type ServiceMessage struct {
 	Command   string
 	Arguments []string
+	Bridge    string // Name of the bridge the command is for
+	Origin    string // Name of the transport the command came from
+	Target    string // Name of the transport to run the command, all if empty
 }
 
 // Name returns string representation of the sender.
@@ -59,3 +47,27 @@ func (message *Message) Name() (nick string) {
 	}
 	return
 }
+
+// MessageID returns the ID of the message in its origin transport or an empty
+// string if it has none.
+func (message *Message) MessageID() string {
+	if id := message.Extra["msgid"]; id != "" {
+		return id
+	}
+	if message.ID != 0 {
+		return strconv.Itoa(message.ID)
+	}
+	return ""
+}
+
+// MediaURLs returns the links to the media of the message: to every item of
+// an album or to its only file.
+func (message *Message) MediaURLs() []string {
+	if album := message.Extra["album"]; album != "" {
+		return strings.Fields(album)
+	}
+	if url := message.Extra["url"]; url != "" {
+		return []string{url}
+	}
+	return nil
+}
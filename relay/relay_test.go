@@ -14,7 +14,7 @@ var (
 	testMessages = []*Message{
 		&Message{
 			Date:   centralTime,
-			Source: false,
+			Origin: "irc",
 			Nick:   "irchuu",
 			Text:   "konnichiha!",
 
@@ -22,7 +22,7 @@ var (
 		},
 		&Message{
 			Date:   centralTime,
-			Source: true,
+			Origin: "telegram",
 			Nick:   "",
 			Text:   "konnichiha!",
 
@@ -42,13 +42,31 @@ func TestMessage_Name(t *testing.T) {
 	assert.Equal("IRChuu~ Bot", testMessages[1].Name())
 }
 
-func TestNewRelay(t *testing.T) {
+func TestMessage_MediaURLs(t *testing.T) {
 	assert := assert.New(t)
-	r := NewRelay()
-	m := make(chan Message)
-	s := make(chan ServiceMessage)
-	assert.IsType(m, r.TeleCh)
-	assert.IsType(m, r.IRCh)
-	assert.IsType(s, r.TeleServiceCh)
-	assert.IsType(s, r.IRCServiceCh)
+	m := Message{Extra: map[string]string{"url": "https://a.org/1.jpg"}}
+	assert.Equal([]string{"https://a.org/1.jpg"}, m.MediaURLs())
+	m.Extra["album"] = "https://a.org/1.jpg https://a.org/2.jpg"
+	assert.Equal([]string{"https://a.org/1.jpg", "https://a.org/2.jpg"}, m.MediaURLs())
+	assert.Nil((&Message{}).MediaURLs())
+}
+
+func TestStripFormatting(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("plain", StripFormatting("plain"))
+	assert.Equal("bold italic", StripFormatting("\x02bold\x0f \x1ditalic\x0f"))
+	assert.Equal("red on blue, 3", StripFormatting("\x034,12red on blue\x03, 3"))
+	assert.Equal("ok", StripFormatting("\x11\x1e\x1f\x16ok"))
+}
+
+func TestMessage_Mentions(t *testing.T) {
+	assert := assert.New(t)
+	message := Message{Text: "Bob, hi @alice"}
+	assert.Nil(message.Mentions())
+	message.SetMentions([]Mention{{Offset: 8, Length: 6, ID: 42},
+		{Offset: 0, Length: 3, ID: 7}, {Offset: 12, Length: 5, ID: 1}})
+	assert.Equal([]Mention{{Offset: 0, Length: 3, ID: 7},
+		{Offset: 8, Length: 6, ID: 42}}, message.Mentions())
+	message.SetMentions(nil)
+	assert.NotContains(message.Extra, "mentions")
 }
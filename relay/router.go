@@ -0,0 +1,358 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/26000/irchuu/config"
+)
+
+// Transport is a network IRChuu relays messages to and from.
+type Transport interface {
+	// Name returns the unique name of the transport, e. g. "irc".
+	Name() string
+	// Start connects to the network and relays incoming messages to the
+	// router. It blocks until the transport is stopped or fails.
+	Start(r *Router) error
+	// Stop disconnects from the network.
+	Stop() error
+	// Send relays a message from another transport into the network. It is
+	// called by the router from one goroutine per transport. If it fails,
+	// the message is retried later unless the error is Permanent.
+	Send(message Message) error
+	// SendService executes a service command sent by another transport.
+	SendService(message ServiceMessage) error
+	// Health returns nil if the transport is connected and working.
+	Health() error
+}
+
+// Delays between attempts to deliver a message.
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute
+)
+
+// NewRouter creates a new Router serving the given bridges. It queues
+// messages in memory until another queue is set.
+func NewRouter(bridges []*config.Bridge) *Router {
+	return &Router{
+		bridges: bridges,
+		queue:   NewMemoryQueue(),
+		notify:  make(map[string]chan struct{}),
+		resume:  make(map[string]chan struct{}),
+		quit:    make(map[string]chan struct{}),
+		failed:  make(map[string]bool),
+		index:   NewIndex(),
+		backoff: minBackoff,
+		logger:  log.New(os.Stdout, "RLY ", log.LstdFlags),
+	}
+}
+
+// Router passes messages from every transport to all the others. Messages
+// are put in a queue and delivered to every transport in order, retrying
+// with backoff while it fails.
+type Router struct {
+	mu         sync.RWMutex
+	transports []Transport
+	bridges    []*config.Bridge
+	queue      Queue
+	notify     map[string]chan struct{}
+	resume     map[string]chan struct{}
+	quit       map[string]chan struct{} // closed to stop the delivery
+	failed     map[string]bool          // transports which failed to start
+	index      *Index
+	backoff    time.Duration // the first delay between attempts
+	delivering sync.WaitGroup
+	logger     *log.Logger
+}
+
+// SetQueue sets the queue of outbound messages. It must be called before
+// anything is relayed.
+func (r *Router) SetQueue(q Queue) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queue = q
+}
+
+// Add adds a transport to the router. All transports must be added before
+// the router is started.
+func (r *Router) Add(t Transport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transports = append(r.transports, t)
+	r.notify[t.Name()] = make(chan struct{}, 1)
+	r.resume[t.Name()] = make(chan struct{}, 1)
+	r.quit[t.Name()] = make(chan struct{})
+}
+
+// Transports returns all the transports of the router.
+func (r *Router) Transports() []Transport {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]Transport(nil), r.transports...)
+}
+
+// Transport returns the transport with the given name or nil.
+func (r *Router) Transport(name string) Transport {
+	for _, t := range r.Transports() {
+		if t.Name() == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// Start starts all the transports and the delivery of queued messages to
+// them and blocks until all of them and the delivery stop. A transport which
+// fails is logged and the others keep running, but nothing is delivered to
+// it any more; Start returns an error only if every transport fails.
+func (r *Router) Start() error {
+	transports := r.Transports()
+	errCh := make(chan error, len(transports))
+	for _, t := range transports {
+		r.delivering.Add(1)
+		go func(t Transport) {
+			defer r.delivering.Done()
+			r.deliver(t)
+		}(t)
+		go func(t Transport) {
+			err := t.Start(r)
+			if err != nil {
+				r.fail(t.Name())
+				err = fmt.Errorf("%v: %v", t.Name(), err)
+			}
+			errCh <- err
+		}(t)
+	}
+
+	var errs []string
+	for range transports {
+		if err := <-errCh; err != nil {
+			r.logger.Printf("Transport failed: %v\n", err)
+			errs = append(errs, err.Error())
+		}
+	}
+	r.delivering.Wait()
+	if len(errs) != 0 && len(errs) == len(transports) {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// fail stops the delivery to the transport which failed, and messages are
+// not queued for it any more.
+func (r *Router) fail(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed[name] = true
+	r.halt(name)
+}
+
+// halt stops the delivery to the transport. r.mu must be held.
+func (r *Router) halt(name string) {
+	select {
+	case <-r.quit[name]:
+	default:
+		close(r.quit[name])
+	}
+}
+
+// Stop stops all the transports and returns the first error occurred.
+// Undelivered messages stay in the queue.
+func (r *Router) Stop() (err error) {
+	r.mu.Lock()
+	for name := range r.quit {
+		r.halt(name)
+	}
+	r.mu.Unlock()
+	for _, t := range r.Transports() {
+		if e := t.Stop(); e != nil && err == nil {
+			err = fmt.Errorf("%v: %v", t.Name(), e)
+		}
+	}
+	return
+}
+
+// Index returns the index of recently relayed messages.
+func (r *Router) Index() *Index {
+	return r.index
+}
+
+// Relay queues the message for every transport except the one it came from.
+// Edits of known messages get their previous text in Extra["original"].
+func (r *Router) Relay(message Message) (err error) {
+	if original, ok := r.index.add(message); ok && message.Extra["edit"] != "" {
+		extra := make(map[string]string, len(message.Extra)+1)
+		for k, v := range message.Extra {
+			extra[k] = v
+		}
+		extra["original"] = original
+		message.Extra = extra
+	}
+
+	r.mu.RLock()
+	q := r.queue
+	failed := make(map[string]bool, len(r.failed))
+	for name := range r.failed {
+		failed[name] = true
+	}
+	r.mu.RUnlock()
+	for _, t := range r.Transports() {
+		if t.Name() == message.Origin || failed[t.Name()] {
+			continue
+		}
+		if e := q.Push(t.Name(), message); e != nil {
+			if err == nil {
+				err = fmt.Errorf("%v: %v", t.Name(), e)
+			}
+			continue
+		}
+		r.wake(t.Name())
+	}
+	return
+}
+
+// wake wakes up the delivery to a transport.
+func (r *Router) wake(name string) {
+	r.mu.RLock()
+	notify := r.notify[name]
+	r.mu.RUnlock()
+	select {
+	case notify <- struct{}{}:
+	default:
+	}
+}
+
+// Resume tells the router that a transport is able to send messages again,
+// so the delivery to it is retried at once instead of after the backoff.
+func (r *Router) Resume(name string) {
+	r.mu.RLock()
+	resume := r.resume[name]
+	r.mu.RUnlock()
+	select {
+	case resume <- struct{}{}:
+	default:
+	}
+}
+
+// deliver sends queued messages to the transport until the router is
+// stopped or the transport fails. Failed messages are retried with
+// exponential backoff, and the following ones wait for them to keep the
+// order.
+func (r *Router) deliver(t Transport) {
+	r.mu.RLock()
+	q, notify, resume := r.queue, r.notify[t.Name()], r.resume[t.Name()]
+	quit := r.quit[t.Name()]
+	r.mu.RUnlock()
+
+	backoff := NewBackoff(r.backoff, maxBackoff)
+	// wait sleeps for the backoff and returns false if the delivery is stopped
+	wait := func() bool {
+		return backoff.WaitOrResume(quit, resume)
+	}
+
+	for {
+		id, message, ok, err := q.Peek(t.Name())
+		if err != nil {
+			r.logger.Printf("Failed to read the queue of %v: %v\n", t.Name(), err)
+			if !wait() {
+				return
+			}
+			continue
+		}
+		if !ok {
+			select {
+			case <-notify:
+				continue
+			case <-quit:
+				return
+			}
+		}
+
+		err = t.Send(message)
+		if err != nil && !IsPermanent(err) {
+			r.logger.Printf("Failed to deliver a message to %v, retrying in %v: %v\n",
+				t.Name(), backoff.Delay(), err)
+			if !wait() {
+				return
+			}
+			continue
+		} else if err != nil {
+			r.logger.Printf("Dropped a message to %v: %v\n", t.Name(), err)
+		}
+		backoff.Reset()
+
+		if err = q.Remove(t.Name(), id); err != nil {
+			r.logger.Printf("Failed to remove a message from the queue of %v: %v\n",
+				t.Name(), err)
+			if !wait() {
+				return
+			}
+		}
+	}
+}
+
+// Service sends the service message to its target transport or, if it has
+// no target, to every transport except the one it came from.
+func (r *Router) Service(message ServiceMessage) (err error) {
+	for _, t := range r.Transports() {
+		if message.Target != "" && t.Name() != message.Target ||
+			message.Target == "" && t.Name() == message.Origin {
+			continue
+		}
+		if e := t.SendService(message); e != nil && err == nil {
+			err = fmt.Errorf("%v: %v", t.Name(), e)
+		}
+	}
+	return
+}
+
+// Health returns the health of every transport by its name.
+func (r *Router) Health() map[string]error {
+	health := make(map[string]error)
+	for _, t := range r.Transports() {
+		health[t.Name()] = t.Health()
+	}
+	return health
+}
+
+// Bridges returns all the bridges served by the router.
+func (r *Router) Bridges() []*config.Bridge {
+	return r.bridges
+}
+
+// Bridge returns the bridge with the given name or nil.
+func (r *Router) Bridge(name string) *config.Bridge {
+	for _, b := range r.bridges {
+		if b.Name == name {
+			return b
+		}
+	}
+	return nil
+}
+
+// ByChannel returns the bridge of an IRC channel or nil. Channel names are
+// compared case-insensitively.
+func (r *Router) ByChannel(channel string) *config.Bridge {
+	for _, b := range r.bridges {
+		if strings.EqualFold(b.Channel, channel) {
+			return b
+		}
+	}
+	return nil
+}
+
+// ByGroup returns the bridge of a Telegram group or nil.
+func (r *Router) ByGroup(group int64) *config.Bridge {
+	for _, b := range r.bridges {
+		if b.Group == group {
+			return b
+		}
+	}
+	return nil
+}
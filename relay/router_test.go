@@ -0,0 +1,218 @@
+package relay
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/26000/irchuu/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testBridges = []*config.Bridge{
+	&config.Bridge{
+		Name:    "irchuu",
+		Channel: "#IRChuu",
+		Group:   -1001234567,
+	},
+	&config.Bridge{
+		Name:    "koto",
+		Channel: "#koto",
+		Group:   -1007654321,
+	},
+}
+
+// fakeTransport records everything it is sent.
+type fakeTransport struct {
+	name     string
+	mu       sync.Mutex
+	messages []Message
+	services []ServiceMessage
+	stop     chan struct{}
+	err      error
+	sendErrs []error // returned by Send one by one
+}
+
+func newFakeTransport(name string) *fakeTransport {
+	return &fakeTransport{name: name, stop: make(chan struct{})}
+}
+
+func (t *fakeTransport) Name() string { return t.name }
+
+func (t *fakeTransport) Start(r *Router) error {
+	if t.err != nil {
+		return t.err
+	}
+	<-t.stop
+	return nil
+}
+
+func (t *fakeTransport) Stop() error {
+	close(t.stop)
+	return nil
+}
+
+func (t *fakeTransport) Send(message Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.sendErrs) != 0 {
+		err := t.sendErrs[0]
+		t.sendErrs = t.sendErrs[1:]
+		if err != nil {
+			return err
+		}
+	}
+	t.messages = append(t.messages, message)
+	return nil
+}
+
+// received returns the messages sent to the transport.
+func (t *fakeTransport) received() []Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]Message(nil), t.messages...)
+}
+
+func (t *fakeTransport) SendService(message ServiceMessage) error {
+	t.services = append(t.services, message)
+	return nil
+}
+
+func (t *fakeTransport) Health() error { return t.err }
+
+func TestRouter_Relay(t *testing.T) {
+	assert := assert.New(t)
+	r := NewRouter(testBridges)
+	irc, tg, mx := newFakeTransport("irc"), newFakeTransport("telegram"),
+		newFakeTransport("matrix")
+	r.Add(irc)
+	r.Add(tg)
+	r.Add(mx)
+	go r.Start()
+	defer r.Stop()
+
+	assert.NoError(r.Relay(*testMessages[0]))
+	assert.Eventually(func() bool {
+		return len(tg.received()) == 1 && len(mx.received()) == 1
+	}, time.Second, time.Millisecond)
+	assert.Empty(irc.received())
+
+	assert.NoError(r.Service(ServiceMessage{Command: "ops", Origin: "telegram"}))
+	assert.Len(irc.services, 1)
+	assert.Empty(tg.services)
+	assert.Len(mx.services, 1)
+
+	assert.NoError(r.Service(ServiceMessage{Command: "announce",
+		Origin: "irc", Target: "telegram"}))
+	assert.Len(irc.services, 1)
+	assert.Len(tg.services, 1)
+	assert.Len(mx.services, 1)
+
+	assert.Equal(mx, r.Transport("matrix"))
+	assert.Nil(r.Transport("xmpp"))
+}
+
+func TestRouter_StartStop(t *testing.T) {
+	assert := assert.New(t)
+	r := NewRouter(testBridges)
+	r.Add(newFakeTransport("irc"))
+	r.Add(newFakeTransport("telegram"))
+
+	done := make(chan error)
+	go func() { done <- r.Start() }()
+	assert.NoError(r.Stop())
+	assert.NoError(<-done)
+
+	broken := newFakeTransport("broken")
+	broken.err = errors.New("cannot connect")
+	r = NewRouter(testBridges)
+	r.Add(newFakeTransport("irc"))
+	r.Add(broken)
+	// the other transports keep running
+	go func() { done <- r.Start() }()
+	select {
+	case err := <-done:
+		t.Fatalf("the router stopped with a broken transport: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.EqualError(r.Health()["broken"], "cannot connect")
+	assert.NoError(r.Health()["irc"])
+	// nothing is queued for the broken one
+	message := *testMessages[1]
+	assert.NoError(r.Relay(message))
+	_, _, ok, err := r.queue.Peek("broken")
+	assert.NoError(err)
+	assert.False(ok)
+	assert.NoError(r.Stop())
+	assert.NoError(<-done)
+
+	// and fail only if all of them do
+	other := newFakeTransport("other")
+	other.err = errors.New("cannot log in")
+	r = NewRouter(testBridges)
+	r.Add(broken)
+	r.Add(other)
+	// the delivery to them stops too
+	err = r.Start()
+	assert.Contains(err.Error(), "broken: cannot connect")
+	assert.Contains(err.Error(), "other: cannot log in")
+}
+
+func TestRouter_Bridges(t *testing.T) {
+	assert := assert.New(t)
+	r := NewRouter(testBridges)
+	assert.Len(r.Bridges(), 2)
+	assert.Equal(testBridges[1], r.Bridge("koto"))
+	assert.Nil(r.Bridge("nonexistent"))
+	assert.Equal(testBridges[0], r.ByChannel("#irchuu"))
+	assert.Equal(testBridges[1], r.ByChannel("#koto"))
+	assert.Nil(r.ByChannel("#nonexistent"))
+	assert.Equal(testBridges[1], r.ByGroup(-1007654321))
+	assert.Nil(r.ByGroup(42))
+}
+
+func TestRouter_Retry(t *testing.T) {
+	assert := assert.New(t)
+	r := NewRouter(testBridges)
+	r.backoff = time.Millisecond
+	tg := newFakeTransport("telegram")
+	tg.sendErrs = []error{errors.New("network is down"),
+		errors.New("network is down"), nil,
+		Permanent(errors.New("bad request"))}
+	r.Add(newFakeTransport("irc"))
+	r.Add(tg)
+	go r.Start()
+	defer r.Stop()
+
+	for _, text := range []string{"first", "dropped", "last"} {
+		message := *testMessages[0]
+		message.Text = text
+		assert.NoError(r.Relay(message))
+	}
+	assert.Eventually(func() bool {
+		return len(tg.received()) == 2
+	}, time.Second, time.Millisecond)
+	received := tg.received()
+	assert.Equal("first", received[0].Text)
+	assert.Equal("last", received[1].Text)
+}
+
+func TestRouter_Resume(t *testing.T) {
+	r := NewRouter(testBridges)
+	r.backoff = time.Hour
+	tg := newFakeTransport("telegram")
+	tg.sendErrs = []error{errors.New("network is down")}
+	r.Add(newFakeTransport("irc"))
+	r.Add(tg)
+	go r.Start()
+	defer r.Stop()
+
+	assert.NoError(t, r.Relay(*testMessages[0]))
+	// the message is retried without waiting for an hour
+	assert.Eventually(t, func() bool {
+		r.Resume("telegram")
+		return len(tg.received()) == 1
+	}, time.Second, time.Millisecond)
+}
@@ -0,0 +1,156 @@
+package mediaserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/26000/irchuu/config"
+)
+
+// contentName matches the names of files which are named after the SHA-256
+// of their content, so they never change.
+var contentName = regexp.MustCompile(`^[0-9a-f]{64}(\.|$)`)
+
+// inlineTypes are the media types shown in browsers. Everything else is
+// downloaded, so no HTML or scripts run on the server's origin.
+var inlineTypes = []string{"image/", "video/", "audio/"}
+
+// URL returns the link to the media file with the name and when it
+// expires. Links are signed if the secret is set.
+func URL(c *config.Telegram, name string) (string, time.Time) {
+	link := c.BaseURL + "/" + url.PathEscape(name)
+	if c.ServerSecret == "" {
+		return link, time.Time{}
+	}
+	var expires time.Time
+	if c.ServerLinkTTL != 0 {
+		expires = time.Now().Add(time.Duration(c.ServerLinkTTL) * 24 * time.Hour)
+	}
+	exp := "0"
+	if !expires.IsZero() {
+		exp = strconv.FormatInt(expires.Unix(), 10)
+	}
+	return link + "?exp=" + exp + "&sig=" + sign(c.ServerSecret, name, exp), expires
+}
+
+// sign returns the HMAC-SHA256 of the name and the expiry time.
+func sign(secret, name, exp string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(name + "\n" + exp))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// mediaHandler serves the media files in the directory. It lists nothing and
+// serves no hidden or partial files. If the secret is set, only signed links
+// which have not expired work.
+func mediaHandler(dir, secret string, logger *log.Logger) http.Handler {
+	return logRequests(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(req.URL.Path, "/")
+		if name == "" || strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") ||
+			strings.HasSuffix(name, ".part") {
+			http.NotFound(w, req)
+			return
+		}
+		if secret != "" {
+			exp, sig := req.URL.Query().Get("exp"), req.URL.Query().Get("sig")
+			expires, err := strconv.ParseInt(exp, 10, 64)
+			if err != nil || !hmac.Equal([]byte(sig), []byte(sign(secret, name, exp))) ||
+				expires != 0 && time.Now().Unix() > expires {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			http.NotFound(w, req)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			http.NotFound(w, req)
+			return
+		}
+
+		h := w.Header()
+		contentType := mime.TypeByExtension(filepath.Ext(name))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+		h.Set("Content-Type", contentType)
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+		disposition := "attachment"
+		for _, t := range inlineTypes {
+			if strings.HasPrefix(contentType, t) && contentType != "image/svg+xml" {
+				disposition = "inline"
+			}
+		}
+		h.Set("Content-Disposition", mime.FormatMediaType(disposition,
+			map[string]string{"filename": name}))
+		if contentName.MatchString(name) {
+			h.Set("ETag", `"`+name[:64]+`"`)
+			h.Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			h.Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+			h.Set("Cache-Control", "public, max-age=86400")
+		}
+		if secret != "" {
+			// the link may expire, so it must not outlive it in caches
+			h.Set("Cache-Control", "private, max-age=3600")
+		}
+		// Range, If-Range and If-None-Match are handled here
+		http.ServeContent(w, req, name, info.ModTime(), f)
+	}), logger)
+}
+
+// statusRecorder remembers the status and the size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+// WriteHeader remembers the status.
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write counts the bytes written.
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.size += int64(n)
+	return n, err
+}
+
+// logRequests logs every request to the handler without its query, which
+// may contain signatures.
+func logRequests(h http.Handler, logger *log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, req)
+		logger.Printf("%v %v %v %v %d %dB %v\n", req.RemoteAddr, req.Method,
+			req.URL.Path, req.Header.Get("Range"), rec.status, rec.size,
+			time.Since(start).Round(time.Millisecond))
+	})
+}
@@ -0,0 +1,147 @@
+package mediaserver
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/26000/irchuu/config"
+	"github.com/stretchr/testify/assert"
+)
+
+const hash = "5e884898da28047151d0e56f8dc6292773603d0d6aabbdd62a11ef721d1542d8"
+
+// mediaDir creates a data directory with some media and service files.
+func mediaDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "irchuu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		hash + ".jpg":        "meow meow",
+		"AgADBAADr6c.html":   "<script>alert(1)</script>",
+		".library.json":      "{}",
+		hash + ".mp4.part":   "half a video",
+		"AgADBAADr6c.webp":   "sticker",
+		"AgADBAADr6c.nofile": "?",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestMediaHandler(t *testing.T) {
+	assert := assert.New(t)
+	dir, remove := mediaDir(t)
+	defer remove()
+	s := httptest.NewServer(mediaHandler(dir, "", log.New(ioutil.Discard, "", 0)))
+	defer s.Close()
+
+	get := func(path string, headers map[string]string) (*http.Response, string) {
+		req, _ := http.NewRequest(http.MethodGet, s.URL+path, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.Nil(err) {
+			t.FailNow()
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	for _, path := range []string{"/", "/sub", "/sub/", "/.library.json",
+		"/" + hash + ".mp4.part", "/../" + filepath.Base(dir) + "/" + hash + ".jpg",
+		"/%2e%2e%2fetc%2fpasswd", "/missing.jpg"} {
+		resp, _ := get(path, nil)
+		assert.Equal(http.StatusNotFound, resp.StatusCode, path)
+	}
+
+	resp, body := get("/"+hash+".jpg", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.Equal("meow meow", body)
+	assert.Equal("image/jpeg", resp.Header.Get("Content-Type"))
+	assert.Equal("nosniff", resp.Header.Get("X-Content-Type-Options"))
+	assert.Equal("inline; filename="+hash+".jpg", resp.Header.Get("Content-Disposition"))
+	assert.Equal(`"`+hash+`"`, resp.Header.Get("ETag"))
+	assert.Contains(resp.Header.Get("Cache-Control"), "immutable")
+	assert.Equal("bytes", resp.Header.Get("Accept-Ranges"))
+
+	resp, body = get("/"+hash+".jpg", map[string]string{"Range": "bytes=5-"})
+	assert.Equal(http.StatusPartialContent, resp.StatusCode)
+	assert.Equal("meow", body)
+	assert.Equal("bytes 5-8/9", resp.Header.Get("Content-Range"))
+
+	resp, body = get("/"+hash+".jpg", map[string]string{"If-None-Match": `"` + hash + `"`})
+	assert.Equal(http.StatusNotModified, resp.StatusCode)
+	assert.Empty(body)
+
+	resp, _ = get("/AgADBAADr6c.html", nil)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+	assert.True(strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html"))
+	assert.Equal("attachment; filename=AgADBAADr6c.html", resp.Header.Get("Content-Disposition"))
+	assert.Contains(resp.Header.Get("Content-Security-Policy"), "sandbox")
+
+	resp, _ = get("/AgADBAADr6c.nofile", nil)
+	assert.Equal("application/octet-stream", resp.Header.Get("Content-Type"))
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(etag)
+	resp, _ = get("/AgADBAADr6c.nofile", map[string]string{"If-None-Match": etag})
+	assert.Equal(http.StatusNotModified, resp.StatusCode)
+
+	resp, err := http.Post(s.URL+"/"+hash+".jpg", "text/plain", strings.NewReader("woof"))
+	assert.Nil(err)
+	resp.Body.Close()
+	assert.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestMediaHandler_Signed(t *testing.T) {
+	assert := assert.New(t)
+	dir, remove := mediaDir(t)
+	defer remove()
+	s := httptest.NewServer(mediaHandler(dir, "hunter2", log.New(ioutil.Discard, "", 0)))
+	defer s.Close()
+	c := &config.Telegram{BaseURL: s.URL, ServerSecret: "hunter2"}
+
+	status := func(url string) int {
+		resp, err := http.Get(url)
+		if !assert.Nil(err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	url, expires := URL(c, hash+".jpg")
+	assert.True(expires.IsZero())
+	assert.Equal(http.StatusOK, status(url))
+	assert.Equal(http.StatusForbidden, status(s.URL+"/"+hash+".jpg"))
+	assert.Equal(http.StatusForbidden, status(strings.Replace(url, hash+".jpg",
+		"AgADBAADr6c.webp", 1)))
+	assert.Equal(http.StatusForbidden, status(strings.Replace(url, "exp=0", "exp=1", 1)))
+
+	c.ServerLinkTTL = 1
+	url, expires = URL(c, hash+".jpg")
+	assert.WithinDuration(time.Now().Add(24*time.Hour), expires, time.Minute)
+	assert.Equal(http.StatusOK, status(url))
+
+	c.ServerLinkTTL = -1
+	url, _ = URL(c, hash+".jpg")
+	assert.Equal(http.StatusForbidden, status(url))
+
+	c.ServerSecret = ""
+	url, expires = URL(c, hash+".jpg")
+	assert.Equal(s.URL+"/"+hash+".jpg", url)
+	assert.True(expires.IsZero())
+}
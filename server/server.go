@@ -10,12 +10,25 @@ import (
 	"github.com/26000/irchuu/config"
 )
 
-// Serve creates a web server and serves media files.
+// mux routes requests to media files and to handlers registered by other
+// parts of IRChuu.
+var mux = http.NewServeMux()
+
+// Handle registers a handler for the pattern on the web server.
+func Handle(pattern string, handler http.Handler) {
+	mux.Handle(pattern, handler)
+}
+
+// Serve creates a web server and serves media files if they are stored on
+// the server.
 func Serve(c *config.Telegram) {
 	logger := log.New(os.Stdout, "SRV ", log.LstdFlags)
+	if c.Stores("server") {
+		mux.Handle("/", mediaHandler(c.DataDir, c.ServerSecret, logger))
+	}
 	s := &http.Server{
 		Addr:           ":" + strconv.FormatUint(uint64(c.ServerPort), 10),
-		Handler:        http.FileServer(http.Dir(c.DataDir)),
+		Handler:        mux,
 		ReadTimeout:    time.Duration(c.ReadTimeout) * time.Second,
 		WriteTimeout:   time.Duration(c.WriteTimeout) * time.Second,
 		MaxHeaderBytes: 1 << 20,
@@ -0,0 +1,48 @@
+package telegram
+
+import (
+	"sync"
+	"time"
+
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+// albumWait is how long the bot waits for more items of an album after the
+// last one.
+const albumWait = 1500 * time.Millisecond
+
+// albums collects the messages of albums, which Telegram sends one by one,
+// so each album is relayed as a single message.
+type albums struct {
+	wait    time.Duration
+	flush   func([]*tgbotapi.Message)
+	mu      sync.Mutex
+	pending map[string][]*tgbotapi.Message // by media group ID
+}
+
+// newAlbums creates a collector which passes every complete album to flush.
+func newAlbums(wait time.Duration, flush func([]*tgbotapi.Message)) *albums {
+	return &albums{wait: wait, flush: flush,
+		pending: make(map[string][]*tgbotapi.Message)}
+}
+
+// add adds a message to its album. The album is complete when no more
+// messages come within the wait.
+func (a *albums) add(group string, message *tgbotapi.Message) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.pending[group] = append(a.pending[group], message)
+	n := len(a.pending[group])
+	time.AfterFunc(a.wait, func() {
+		a.mu.Lock()
+		messages := a.pending[group]
+		if len(messages) != n {
+			// a later message will flush the album
+			a.mu.Unlock()
+			return
+		}
+		delete(a.pending, group)
+		a.mu.Unlock()
+		a.flush(messages)
+	})
+}
@@ -0,0 +1,29 @@
+package telegram
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+func TestAlbums(t *testing.T) {
+	assert := assert.New(t)
+	flushed := make(chan []*tgbotapi.Message, 2)
+	a := newAlbums(50*time.Millisecond, func(messages []*tgbotapi.Message) {
+		flushed <- messages
+	})
+
+	a.add("1", &tgbotapi.Message{MessageID: 1})
+	a.add("2", &tgbotapi.Message{MessageID: 10})
+	time.Sleep(30 * time.Millisecond)
+	a.add("1", &tgbotapi.Message{MessageID: 2, Caption: "trip"})
+
+	// the second album is complete first, as nothing was added to it
+	assert.Len(<-flushed, 1)
+	album := <-flushed
+	assert.Len(album, 2)
+	assert.Equal("trip", album[1].Caption)
+	assert.Empty(a.pending)
+}
@@ -0,0 +1,346 @@
+package telegram
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/26000/irchuu/relay"
+
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+// markupStyle is a set of IRC formatting styles.
+type markupStyle uint
+
+const (
+	styleBold markupStyle = 1 << iota
+	styleItalic
+	styleUnderline
+	styleStrike
+	styleMonospace
+	styleSpoiler
+	styleQuote
+)
+
+// markupCodes are the IRC codes which turn the styles on. Spoilers are black
+// on black, so they can be read by selecting them.
+var markupCodes = []struct {
+	style markupStyle
+	code  string
+}{
+	{styleBold, "\x02"},
+	{styleItalic, "\x1d"},
+	{styleUnderline, "\x1f"},
+	{styleStrike, "\x1e"},
+	{styleMonospace, "\x11"},
+	{styleSpoiler, "\x0301,01"},
+}
+
+// entityStyles are the styles of Telegram's entity types.
+var entityStyles = map[string]markupStyle{
+	"bold":          styleBold,
+	"italic":        styleItalic,
+	"underline":     styleUnderline,
+	"strikethrough": styleStrike,
+	"code":          styleMonospace,
+	"pre":           styleMonospace,
+	"spoiler":       styleSpoiler,
+	"blockquote":    styleQuote,
+}
+
+// markupNode is a part of a message formatted by an entity, containing the
+// parts formatted by the entities nested in it. Offsets are in UTF-16 code
+// units, like Telegram's.
+type markupNode struct {
+	entity     tgbotapi.MessageEntity
+	start, end int
+	children   []*markupNode
+}
+
+// markupPiece is an entity or the part of it which is to be inserted into the
+// tree.
+type markupPiece struct {
+	entity     tgbotapi.MessageEntity
+	start, end int
+}
+
+// translateMarkup turns Telegram's entities into IRC's codes.
+func translateMarkup(message tgbotapi.Message) string {
+	text := utf16.Encode([]rune(message.Text))
+	if message.Entities == nil || len(*message.Entities) == 0 {
+		return message.Text
+	}
+	var b strings.Builder
+	buildMarkupTree(*message.Entities, len(text)).render(&b, text, 0)
+	return b.String()
+}
+
+// buildMarkupTree nests the entities into a tree. Entities which overlap
+// without nesting are split into parts which nest.
+func buildMarkupTree(entities []tgbotapi.MessageEntity, length int) *markupNode {
+	var pieces []markupPiece
+	for _, e := range entities {
+		start, end := e.Offset, e.Offset+e.Length
+		if start < 0 {
+			start = 0
+		}
+		if end > length {
+			end = length
+		}
+		if start < end {
+			pieces = append(pieces, markupPiece{e, start, end})
+		}
+	}
+	// outer entities go first
+	sort.SliceStable(pieces, func(i, j int) bool {
+		if pieces[i].start != pieces[j].start {
+			return pieces[i].start < pieces[j].start
+		}
+		return pieces[i].end > pieces[j].end
+	})
+
+	root := &markupNode{end: length}
+	for len(pieces) > 0 {
+		p := pieces[0]
+		pieces = pieces[1:]
+		root.insert(p, func(rest markupPiece) {
+			i := sort.Search(len(pieces), func(i int) bool {
+				return pieces[i].start > rest.start ||
+					pieces[i].start == rest.start && pieces[i].end < rest.end
+			})
+			pieces = append(pieces[:i], append([]markupPiece{rest}, pieces[i:]...)...)
+		})
+	}
+	return root
+}
+
+// insert inserts the piece into the deepest node containing its start. The
+// part of the piece outside the node is passed to requeue.
+func (n *markupNode) insert(p markupPiece, requeue func(markupPiece)) {
+	if p.end > n.end {
+		requeue(markupPiece{p.entity, n.end, p.end})
+		p.end = n.end
+	}
+	if len(n.children) != 0 {
+		if last := n.children[len(n.children)-1]; p.start < last.end {
+			last.insert(p, requeue)
+			return
+		}
+	}
+	n.children = append(n.children, &markupNode{entity: p.entity, start: p.start, end: p.end})
+}
+
+// render writes the text of the node with the IRC codes of its styles,
+// given the styles of the nodes containing it.
+func (n *markupNode) render(b *strings.Builder, text []uint16, active markupStyle) {
+	style := entityStyles[n.entity.Type]
+	opened := style &^ active
+	if opened&styleQuote != 0 {
+		b.WriteString("> ")
+	}
+	b.WriteString(styleCodes(opened))
+	active |= style
+
+	pos := n.start
+	for _, c := range n.children {
+		writeText(b, text[pos:c.start], active)
+		c.render(b, text, active)
+		pos = c.end
+	}
+	writeText(b, text[pos:n.end], active)
+
+	if styleCodes(opened) != "" {
+		// \x0f resets everything, so the outer styles are turned on again
+		b.WriteString("\x0f" + styleCodes(active&^style))
+	}
+	if n.entity.Type == "text_link" &&
+		n.entity.URL != string(utf16.Decode(text[n.start:n.end])) {
+		b.WriteString(" (" + n.entity.URL + ")")
+	}
+}
+
+// writeText writes plain text, quoting its lines inside blockquotes.
+func writeText(b *strings.Builder, text []uint16, active markupStyle) {
+	s := string(utf16.Decode(text))
+	if active&styleQuote != 0 {
+		s = strings.Replace(s, "\n", "\n> ", -1)
+	}
+	b.WriteString(s)
+}
+
+// styleCodes returns the IRC codes which turn the styles on.
+func styleCodes(style markupStyle) string {
+	var codes string
+	for _, c := range markupCodes {
+		if style&c.style != 0 {
+			codes += c.code
+		}
+	}
+	return codes
+}
+
+// htmlTags are the HTML tags of the styles in the order they are nested.
+// Nothing may be nested in <code>, so it is always the innermost one.
+var htmlTags = []struct {
+	style markupStyle
+	tag   string
+}{
+	{styleSpoiler, "tg-spoiler"},
+	{styleBold, "b"},
+	{styleItalic, "i"},
+	{styleUnderline, "u"},
+	{styleStrike, "s"},
+	{styleMonospace, "code"},
+}
+
+// ircToggles are the IRC codes which toggle the styles. Reverse (\x16) has
+// no counterpart in HTML.
+var ircToggles = map[rune]markupStyle{
+	'\x02': styleBold,
+	'\x1d': styleItalic,
+	'\x1f': styleUnderline,
+	'\x1e': styleStrike,
+	'\x11': styleMonospace,
+}
+
+// colorEmoji are the emoji of the 16 IRC colours.
+var colorEmoji = []string{"⚪", "⚫", "🔵", "🟢", "🔴", "🟤", "🟣", "🟠",
+	"🟡", "🟢", "🔵", "🔵", "🔵", "🟣", "⚪", "⚪"}
+
+// ircColorCode matches IRC colour codes.
+var ircColorCode = regexp.MustCompile("^\x03(?:(\\d{1,2})(?:,(\\d{1,2}))?)?")
+
+// reconstructMarkup translates IRC markup in text to HTML and escapes the
+// rest. Colours are stripped, turned into spoilers if the text has the colour
+// of its background, or also marked with emoji, depending on colors. The
+// mentions, which are at their offsets in the text, become links to the
+// users, so they are notified. The tags are always nested and closed
+// properly.
+func reconstructMarkup(text string, colors string, mentions []relay.Mention) string {
+	var b strings.Builder
+	var open []string // the stack of open tags
+	var style, opened markupStyle
+	fg, bg, shownFg := -1, -1, -1
+	pos, linkEnd := 0, -1 // linkEnd is the end of the open link
+
+	for len(text) > 0 {
+		if linkEnd >= 0 && pos >= linkEnd {
+			b.WriteString("</a>")
+			linkEnd = -1
+		}
+		// mentions which overlap others or start inside codes are skipped
+		for linkEnd < 0 && len(mentions) != 0 && mentions[0].Offset < pos {
+			mentions = mentions[1:]
+		}
+		r, size := utf8.DecodeRuneInString(text)
+		switch {
+		case r == '\x0f':
+			style, fg, bg = 0, -1, -1
+		case ircToggles[r] != 0:
+			style ^= ircToggles[r]
+		case r == '\x03':
+			m := ircColorCode.FindStringSubmatch(text)
+			size = len(m[0])
+			if m[1] == "" {
+				fg, bg = -1, -1
+			} else {
+				fg = ircColorNumber(m[1])
+				if m[2] != "" {
+					bg = ircColorNumber(m[2])
+				}
+			}
+		case r == '\x16':
+		case linkEnd >= 0:
+			// the style of a link does not change inside it
+			b.WriteString(html.EscapeString(text[:size]))
+		default:
+			want := style
+			if colors != "strip" && colors != "" && fg != -1 && fg == bg {
+				want |= styleSpoiler
+			}
+			link := len(mentions) != 0 && mentions[0].Offset == pos
+			if link {
+				// links cannot be inside <code>
+				want &^= styleMonospace
+			}
+			opened = reconcileTags(&b, &open, opened, want)
+			if colors == "emoji" && fg != shownFg && fg >= 0 && fg < len(colorEmoji) &&
+				want&styleSpoiler == 0 {
+				b.WriteString(colorEmoji[fg])
+			}
+			shownFg = fg
+			if link {
+				fmt.Fprintf(&b, `<a href="tg://user?id=%d">`, mentions[0].ID)
+				linkEnd = pos + mentions[0].Length
+				mentions = mentions[1:]
+			}
+			b.WriteString(html.EscapeString(text[:size]))
+		}
+		text = text[size:]
+		pos += size
+	}
+	if linkEnd >= 0 {
+		b.WriteString("</a>")
+	}
+	reconcileTags(&b, &open, opened, 0)
+	return b.String()
+}
+
+// reconcileTags closes and opens tags so that exactly the wanted styles are
+// open, and returns them.
+func reconcileTags(b *strings.Builder, open *[]string, opened, want markupStyle) markupStyle {
+	if opened == want {
+		return opened
+	}
+	// tags are kept open while everything outside them is still wanted, and
+	// <code> is closed if anything is to be opened, since it must be innermost
+	keep := 0
+	for ; keep < len(*open); keep++ {
+		s := tagStyle((*open)[keep])
+		if want&s == 0 || s == styleMonospace && want&^opened != 0 {
+			break
+		}
+	}
+	for i := len(*open) - 1; i >= keep; i-- {
+		b.WriteString("</" + (*open)[i] + ">")
+	}
+	*open = (*open)[:keep]
+
+	opened = 0
+	for _, tag := range *open {
+		opened |= tagStyle(tag)
+	}
+	for _, t := range htmlTags {
+		if want&t.style != 0 && opened&t.style == 0 {
+			b.WriteString("<" + t.tag + ">")
+			*open = append(*open, t.tag)
+			opened |= t.style
+		}
+	}
+	return opened
+}
+
+// tagStyle returns the style of the HTML tag.
+func tagStyle(tag string) markupStyle {
+	for _, t := range htmlTags {
+		if t.tag == tag {
+			return t.style
+		}
+	}
+	return 0
+}
+
+// ircColorNumber parses the number of an IRC colour. 99 is the default one.
+func ircColorNumber(s string) int {
+	n, _ := strconv.Atoi(s)
+	if n == 99 {
+		return -1
+	}
+	return n
+}
@@ -0,0 +1,60 @@
+package telegram
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+func TestTranslateMarkup(t *testing.T) {
+	assert := assert.New(t)
+	markup := func(text string, entities ...tgbotapi.MessageEntity) string {
+		return translateMarkup(tgbotapi.Message{Text: text, Entities: &entities})
+	}
+	entity := func(kind string, offset, length int) tgbotapi.MessageEntity {
+		return tgbotapi.MessageEntity{Type: kind, Offset: offset, Length: length}
+	}
+
+	assert.Equal("plain", translateMarkup(tgbotapi.Message{Text: "plain"}))
+	// offsets are in UTF-16 code units
+	assert.Equal("😺 \x02bold\x0f \x1ditalic\x0f",
+		markup("😺 bold italic", entity("bold", 3, 4), entity("italic", 8, 6)))
+	assert.Equal("\x02bold \x1fboth\x0f\x02 bold\x0f",
+		markup("bold both bold", entity("underline", 5, 4), entity("bold", 0, 14)))
+	// overlapping entities are split
+	assert.Equal("\x1eab\x1dcd\x0f\x1e\x0f\x1def\x0f",
+		markup("abcdef", entity("strikethrough", 0, 4), entity("italic", 2, 4)))
+	assert.Equal("\x11x := 1\ny := 2\x0f, \x0301,01secret\x0f",
+		markup("x := 1\ny := 2, secret", entity("pre", 0, 13), entity("spoiler", 15, 6)))
+	assert.Equal("> quoted\n> lines\nso",
+		markup("quoted\nlines\nso", entity("blockquote", 0, 12)))
+	link := func(offset, length int) tgbotapi.MessageEntity {
+		return tgbotapi.MessageEntity{Type: "text_link", Offset: offset, Length: length,
+			URL: "https://example.org"}
+	}
+	assert.Equal("see \x1dthis (https://example.org)\x0f, https://example.org",
+		markup("see this, https://example.org",
+			entity("italic", 4, 4), link(4, 4), link(10, 19)))
+	// entities are clipped to the text
+	assert.Equal("o\x02k\x0f", markup("ok", entity("bold", 1, 5), entity("bold", 5, 2)))
+}
+
+func TestReconstructMarkup(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("plain &amp; simple", reconstructMarkup("plain & simple", "", nil))
+	assert.Equal("<b><i>both</i></b> none", reconstructMarkup("\x02\x1dboth\x0f none", "", nil))
+	assert.Equal("<b>bold <i>both</i></b><i> italic</i>",
+		reconstructMarkup("\x02bold \x1dboth\x02 italic", "", nil))
+	assert.Equal("<u>u</u><s>s</s> <b><code>code</code><i><code>more</code></i></b>",
+		reconstructMarkup("\x1fu\x1f\x1es\x1e \x11\x02code\x1dmore\x0f", "", nil))
+	// tags are not left empty or unclosed
+	assert.Equal("<b>x</b>", reconstructMarkup("\x02\x1d\x1dx\x16\x1f", "", nil))
+	assert.Equal("<b>a&lt;</b>", reconstructMarkup("\x02a<", "", nil))
+
+	const colored = "\x034red\x03 \x0301,01secret\x03 \x0312,99blue"
+	assert.Equal("red secret blue", reconstructMarkup(colored, "strip", nil))
+	assert.Equal("red <tg-spoiler>secret</tg-spoiler> blue", reconstructMarkup(colored, "spoiler", nil))
+	assert.Equal("🔴red <tg-spoiler>secret</tg-spoiler> 🔵blue", reconstructMarkup(colored, "emoji", nil))
+	assert.Equal("🔴2", reconstructMarkup("\x03042", "emoji", nil))
+}
@@ -0,0 +1,73 @@
+package telegram
+
+import (
+	"strings"
+	"unicode/utf16"
+
+	irchuubase "github.com/26000/irchuu/db"
+	"github.com/26000/irchuu/relay"
+
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+// findMentions returns the mentions of users in the text of the message.
+// Users mentioned by their usernames are looked up in the database.
+func findMentions(message *tgbotapi.Message) []relay.Mention {
+	if message.Entities == nil {
+		return nil
+	}
+	text := utf16.Encode([]rune(message.Text))
+	var mentions []relay.Mention
+	for _, e := range *message.Entities {
+		if e.Offset < 0 || e.Offset+e.Length > len(text) {
+			continue
+		}
+		mention := string(utf16.Decode(text[e.Offset : e.Offset+e.Length]))
+		var id int
+		switch {
+		case e.Type == "text_mention" && e.User != nil:
+			id = e.User.ID
+		case e.Type == "mention" && irchuubase.IsAvailable():
+			id, _, _ = irchuubase.FindUser(strings.TrimPrefix(mention, "@"))
+		}
+		if id != 0 {
+			mentions = append(mentions, relay.Mention{
+				Offset: len(string(utf16.Decode(text[:e.Offset]))),
+				Length: len(mention),
+				ID:     id,
+			})
+		}
+	}
+	return mentions
+}
+
+// moveMentions finds the mentions of the original text in the translated
+// one, where IRC codes are inserted between characters. A mention is the
+// same occurrence of its text in both. Mentions split by the codes are lost.
+func moveMentions(original, translated string, mentions []relay.Mention) []relay.Mention {
+	if original == translated {
+		return mentions
+	}
+	var moved []relay.Mention
+	for _, m := range mentions {
+		mention := original[m.Offset : m.Offset+m.Length]
+		n := strings.Count(original[:m.Offset], mention)
+		offset := 0
+		for i := 0; i <= n; i++ {
+			j := strings.Index(translated[offset:], mention)
+			if j < 0 {
+				offset = -1
+				break
+			}
+			offset += j
+			if i < n {
+				offset += len(mention)
+			}
+		}
+		if offset >= 0 {
+			moved = append(moved, relay.Mention{Offset: offset, Length: m.Length,
+				ID: m.ID})
+		}
+	}
+	return moved
+}
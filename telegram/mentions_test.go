@@ -0,0 +1,51 @@
+package telegram
+
+import (
+	"testing"
+
+	"github.com/26000/irchuu/relay"
+
+	"github.com/stretchr/testify/assert"
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+func TestFindMentions(t *testing.T) {
+	message := &tgbotapi.Message{
+		Text: "😺 Алиса, hi",
+		Entities: &[]tgbotapi.MessageEntity{
+			{Type: "text_mention", Offset: 3, Length: 5, User: &tgbotapi.User{ID: 42}},
+			{Type: "bold", Offset: 10, Length: 2},
+		},
+	}
+	assert.Equal(t, []relay.Mention{{Offset: 5, Length: 10, ID: 42}},
+		findMentions(message))
+	assert.Nil(t, findMentions(&tgbotapi.Message{Text: "hi"}))
+}
+
+func TestMoveMentions(t *testing.T) {
+	assert := assert.New(t)
+	mentions := []relay.Mention{{Offset: 0, Length: 3, ID: 7},
+		{Offset: 8, Length: 3, ID: 42}}
+	assert.Equal(mentions, moveMentions("@al hi, @al", "@al hi, @al", mentions))
+	assert.Equal([]relay.Mention{{Offset: 1, Length: 3, ID: 7},
+		{Offset: 10, Length: 3, ID: 42}},
+		moveMentions("@al hi, @al", "\x02@al\x0f hi, @al", mentions))
+	// the mention is split by the codes
+	assert.Empty(moveMentions("@al hi", "@\x02al\x0f hi", mentions[:1]))
+}
+
+func TestLinkMentions(t *testing.T) {
+	assert := assert.New(t)
+	bob := []relay.Mention{{Offset: 21, Length: 3, ID: 42}}
+	// only the mention at its offset is linked
+	assert.Equal(`bob: hi, bobby (bob) <a href="tg://user?id=42">bob</a>`,
+		reconstructMarkup("bob: hi, bobby (bob) bob", "", bob))
+	assert.Equal(`a&lt;b <b>x</b> <a href="tg://user?id=42">@alice</a> hi`,
+		reconstructMarkup("a<b \x02x\x0f @alice hi", "", []relay.Mention{{Offset: 8, Length: 6, ID: 42}}))
+	assert.Equal(`<b><a href="tg://user?id=7">a&amp;b</a></b>`,
+		reconstructMarkup("\x02a&b\x02", "", []relay.Mention{{Offset: 1, Length: 3, ID: 7}}))
+	// links are not put inside <code>, and codes inside them are ignored
+	assert.Equal(`<code>x </code><a href="tg://user?id=7">a&amp;b</a><b><code> y</code></b>`,
+		reconstructMarkup("\x11x a&\x02b y", "", []relay.Mention{{Offset: 3, Length: 4, ID: 7}}))
+	assert.Equal("hi", reconstructMarkup("hi", "", nil))
+}
@@ -2,70 +2,256 @@
 package telegram
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"html"
-	"io"
 	"log"
-	"net/http"
 	"os"
-	"path"
-	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
-	"unicode/utf16"
 
 	"github.com/26000/irchuu/config"
 	irchuubase "github.com/26000/irchuu/db"
-	"github.com/26000/irchuu/paths"
 	"github.com/26000/irchuu/relay"
 	"github.com/26000/irchuu/upload"
 
+	"code.cloudfoundry.org/bytefmt"
 	tgbotapi "gopkg.in/telegram-bot-api.v4"
 )
 
 var bot *tgbotapi.BotAPI
 
-// Launch launches the Telegram bot and receives updates in an endless loop.
-func Launch(c *config.Telegram, wg *sync.WaitGroup, r *relay.Relay) {
-	defer wg.Done()
+// storage stores media files, nil if they are not stored.
+var storage upload.Backend
+
+// transportName is the name of the Telegram transport in the router.
+const transportName = "telegram"
+
+// linkCodeTTL is how long the codes which link IRC accounts are valid.
+const linkCodeTTL = 10 * time.Minute
+
+// linkCodeSize is the number of random bytes in a link code, enough for the
+// codes not to collide or be guessed.
+const linkCodeSize = 16
+
+// Transport is the Telegram transport. There may be only one Telegram
+// transport as the bot is kept in the package.
+type Transport struct {
+	c        *config.Telegram
+	services chan relay.ServiceMessage
+	stop     chan struct{}
+
+	mu sync.RWMutex
+	r  *relay.Router // set when authorized
+}
+
+// NewTransport creates the Telegram transport.
+func NewTransport(c *config.Telegram) *Transport {
+	return &Transport{
+		c:        c,
+		services: make(chan relay.ServiceMessage, 20),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Name returns the name of the transport.
+func (t *Transport) Name() string {
+	return transportName
+}
+
+// Send sends a message to the group of its bridge. Errors returned by the
+// Bot API are permanent unless Telegram asks to retry later.
+func (t *Transport) Send(message relay.Message) error {
+	t.mu.RLock()
+	r := t.r
+	t.mu.RUnlock()
+	if r == nil {
+		return errors.New("not authorized")
+	}
+	b := r.Bridge(message.Bridge)
+	if b == nil {
+		return relay.Permanent(fmt.Errorf("unknown bridge %v", message.Bridge))
+	}
+
+	m := formatTGMessage(message, b, t.c.Colors)
+	var err error
+	if id, ok := editedCopy(r, message); ok {
+		// the bridge edits its own copy of the message
+		edit := tgbotapi.NewEditMessageText(b.Group, id, m.Text)
+		edit.ParseMode = m.ParseMode
+		_, err = bot.Send(edit)
+	} else {
+		var sent tgbotapi.Message
+		m.ReplyToMessageID = replyTo(r, message)
+		sent, err = bot.Send(m)
+		if e, ok := err.(tgbotapi.Error); ok && e.RetryAfter == 0 &&
+			m.ReplyToMessageID != 0 {
+			// the message may have been deleted, so send it without the reply
+			m.ReplyToMessageID = 0
+			sent, err = bot.Send(m)
+		}
+		if err == nil {
+			r.Index().SetCopy(message, transportName, strconv.Itoa(sent.MessageID))
+		}
+	}
+	if e, ok := err.(tgbotapi.Error); ok && e.RetryAfter == 0 {
+		return relay.Permanent(err)
+	}
+	return err
+}
+
+// replyTo returns the ID of the Telegram message which the message replies
+// to or 0.
+func replyTo(r *relay.Router, message relay.Message) int {
+	if message.Extra["replyID"] == "" {
+		return 0
+	}
+	origin := message.Extra["replyOrigin"]
+	if origin == "" {
+		origin = message.Origin
+	}
+	id, ok := r.Index().Resolve(message.Bridge, origin, message.Extra["replyID"],
+		transportName)
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.Atoi(id)
+	return n
+}
+
+// editedCopy returns the ID of the copy sent to Telegram of the message which
+// was edited.
+func editedCopy(r *relay.Router, message relay.Message) (int, bool) {
+	if message.Extra["edit"] == "" {
+		return 0, false
+	}
+	id, ok := r.Index().Copy(message.Bridge, message.Origin,
+		message.MessageID(), transportName)
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.Atoi(id)
+	return n, err == nil
+}
+
+// SendService queues a service command.
+func (t *Transport) SendService(message relay.ServiceMessage) error {
+	t.services <- message
+	return nil
+}
+
+// Stop stops receiving updates.
+func (t *Transport) Stop() error {
+	if bot != nil {
+		bot.StopReceivingUpdates()
+	}
+	close(t.stop)
+	return nil
+}
+
+// Health returns an error if the Telegram Bot API is not reachable.
+func (t *Transport) Health() error {
+	if bot == nil {
+		return errors.New("not authorized")
+	}
+	_, err := bot.GetMe()
+	return err
+}
+
+// Start launches the Telegram bot and receives updates until stopped.
+func (t *Transport) Start(r *relay.Router) error {
+	c := t.c
 	logger := log.New(os.Stdout, " TG ", log.LstdFlags)
 
 	var err error
 	bot, err = tgbotapi.NewBotAPI(c.Token)
 	if err != nil {
-		logger.Fatalf("Failed to connect to Telegram: %v\n", err)
+		return fmt.Errorf("failed to connect to Telegram: %v", err)
 	}
 	logger.Printf("Authorized on account %s\n", bot.Self.UserName)
+	storage, err = upload.New(c)
+	if err != nil {
+		return err
+	}
+	if c.DownloadMedia || c.Stores("server") {
+		library, err := upload.OpenLibrary(c.DataDir)
+		if err != nil {
+			return fmt.Errorf("failed to open the media library: %v", err)
+		}
+		var linkTTL time.Duration
+		if c.ServerSecret != "" {
+			linkTTL = time.Duration(c.ServerLinkTTL) * 24 * time.Hour
+		}
+		go library.Maintain(int64(c.MediaQuota)<<20,
+			time.Duration(c.MediaTTL)*24*time.Hour, linkTTL, t.stop, logger)
+	}
+	t.mu.Lock()
+	t.r = r
+	t.mu.Unlock()
+
+	go listenService(r, t.services, c)
+	var updates <-chan update
+	if c.Webhook {
+		updates, err = listenWebhook(c, logger)
+		if err != nil {
+			return fmt.Errorf("failed to set the webhook: %v", err)
+		}
+	} else {
+		// updates can't be polled while a webhook is set
+		if _, err = bot.RemoveWebhook(); err != nil {
+			return fmt.Errorf("failed to remove the webhook: %v", err)
+		}
+		polled := make(chan update, bot.Buffer)
+		go pollUpdates(polled, t.stop, logger)
+		updates = polled
+	}
 
-	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-
-	go relayMessagesToTG(r, c)
-	go listenService(r, c)
-	updates, err := bot.GetUpdatesChan(u)
+	media := newAlbums(albumWait, func(messages []*tgbotapi.Message) {
+		processAlbum(c, messages, logger, r)
+	})
+	for {
+		var u update
+		select {
+		case u = <-updates:
+		case <-t.stop:
+			return nil
+		}
 
-	for update := range updates {
+		update := u.Update
 		if update.Message == nil && update.EditedMessage != nil {
 			update.Message = update.EditedMessage
 			update.EditedMessage = nil
 		} else if update.Message == nil {
 			continue
+		} else if u.MediaGroupID != "" && update.Message.Chat.Type != "private" {
+			media.add(u.MediaGroupID, update.Message)
+			continue
 		}
 
 		if update.Message.Chat.Type != "private" {
 			processChatMessage(c, update.Message, logger, r)
 		} else {
-			processPM(c, update.Message, logger)
+			processPM(c, update.Message, logger, r)
 		}
 	}
 }
 
+// sendService sends a service message from Telegram to other transports.
+func sendService(r *relay.Router, message relay.ServiceMessage) {
+	message.Origin = transportName
+	r.Service(message)
+}
+
 // processChatMessage processes messages from public groups, sending them to
 // IRC and Log channels.
-func processChatMessage(c *config.Telegram, message *tgbotapi.Message, logger *log.Logger, r *relay.Relay) {
-	if message.Chat.ID != c.Group {
+func processChatMessage(c *config.Telegram, message *tgbotapi.Message, logger *log.Logger, r *relay.Router) {
+	b := r.ByGroup(message.Chat.ID)
+	if b == nil {
 		msg := tgbotapi.NewMessage(message.Chat.ID,
 			fmt.Sprintf("I'm not configured to work in this group (group id: %d).",
 				message.Chat.ID))
@@ -77,164 +263,242 @@ func processChatMessage(c *config.Telegram, message *tgbotapi.Message, logger *l
 		return
 	}
 	if c.TTL == 0 || c.TTL > (time.Now().Unix()-int64(message.Date)) {
-		f := formatMessage(message, bot.Self.ID, c.Prefix)
+		f := formatMessage(message, bot.Self.ID, b)
 		if f.Extra["mediaID"] != "" {
-			switch {
-			case c.Storage == "pomf":
-				url, err := upload.Pomf(bot, f.Extra["mediaID"], c)
-				if err != nil {
-					logger.Printf("Could not upload media %v: %v\n",
-						f.Extra["mediaID"], err)
-				} else {
-					f.Extra["url"] = url
-				}
-			case c.Storage == "komf":
-				url, err := upload.Komf(bot, f.Extra["mediaID"], c)
-				if err != nil {
-					logger.Printf("Could not upload media %v: %v\n",
-						f.Extra["mediaID"], err)
-				} else {
-					f.Extra["url"] = url
-				}
-			case c.DownloadMedia:
-				url, err := download(f.Extra["mediaID"], c)
-				if err != nil {
-					logger.Printf("Could not download media %v: %v\n",
-						f.Extra["mediaID"], err)
-				} else if c.Storage == "server" {
-					f.Extra["url"] = url
-				}
-			}
+			storeMedia(c, f, logger)
 		}
-		r.TeleCh <- f
+		r.Relay(f)
 		go irchuubase.Log(f, logger)
 		if cmd := message.Command(); cmd != "" {
-			processCmd(c, message, cmd, r)
+			processCmd(c, b, message, cmd, r)
+		}
+	}
+}
+
+// processAlbum relays the messages of an album as a single message with the
+// links to all of its media.
+func processAlbum(c *config.Telegram, messages []*tgbotapi.Message, logger *log.Logger, r *relay.Router) {
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].MessageID < messages[j].MessageID
+	})
+	first := messages[0]
+	b := r.ByGroup(first.Chat.ID)
+	if b == nil || c.TTL != 0 && c.TTL <= (time.Now().Unix()-int64(first.Date)) {
+		return
+	}
+
+	var album relay.Message
+	var urls []string
+	for i, message := range messages {
+		f := formatMessage(message, bot.Self.ID, b)
+		if f.Extra["mediaID"] != "" {
+			storeMedia(c, f, logger)
+		}
+		if f.Extra["url"] != "" {
+			urls = append(urls, f.Extra["url"])
+		}
+		// the caption is usually attached to one of the items
+		if i == 0 || album.Text == "" && f.Text != "" {
+			album = f
 		}
 	}
+	album.Extra["media"] = "album"
+	album.Extra["album"] = strings.Join(urls, " ")
+	album.Extra["items"] = strconv.Itoa(len(messages))
+	delete(album.Extra, "url")
+	r.Relay(album)
+	go irchuubase.Log(album, logger)
 }
 
-// listenService listens to service messages and executes them.
+// storeMedia stores the media of the message and adds its URL to the
+// message.
+func storeMedia(c *config.Telegram, f relay.Message, logger *log.Logger) {
+	result, err := storeFile(c, f.Extra["mediaID"])
+	if err != nil {
+		logger.Printf("Could not store media %v: %v\n", f.Extra["mediaID"], err)
+		return
+	}
+	if result.URL != "" {
+		f.Extra["url"] = result.URL
+	}
+	if !result.Expires.IsZero() {
+		f.Extra["expires"] = strconv.FormatInt(result.Expires.Unix(), 10)
+	}
+}
+
+// storeFile stores the file with the storage set in the config. If media is
+// not stored, it is only downloaded if it has to be.
+func storeFile(c *config.Telegram, id string) (upload.Result, error) {
+	if storage == nil {
+		if c.DownloadMedia {
+			return upload.Result{}, upload.Download(bot, id, c)
+		}
+		return upload.Result{}, nil
+	}
+	return upload.Store(storage, bot, id, c)
+}
+
+// listenService listens to service messages and executes them in the group
+// of their bridge.
 // TODO: restructure
-func listenService(r *relay.Relay, c *config.Telegram) {
-	for f := range r.IRCServiceCh {
+func listenService(r *relay.Router, services chan relay.ServiceMessage, c *config.Telegram) {
+	for f := range services {
+		b := r.Bridge(f.Bridge)
+		if b == nil {
+			continue
+		}
 		switch f.Command {
 		case "announce":
-			m := tgbotapi.NewMessage(c.Group, f.Arguments[0])
+			m := tgbotapi.NewMessage(b.Group, f.Arguments[0])
 			sendAndReport(m)
+		case "pm":
+			if len(f.Arguments) == 3 {
+				sendPM(r, b, f)
+			}
+		case "linked":
+			if len(f.Arguments) == 2 {
+				id, _ := strconv.Atoi(f.Arguments[0])
+				m := tgbotapi.NewMessage(int64(id), fmt.Sprintf("Your Telegram "+
+					"account is now linked to the IRC account <b>%v</b>.",
+					html.EscapeString(f.Arguments[1])))
+				m.ParseMode = "HTML"
+				sendAndReport(m)
+			}
+		case "delete":
+			if len(f.Arguments) == 0 {
+				break
+			}
+			id, ok := r.Index().Copy(b.Name, f.Origin, f.Arguments[0], transportName)
+			if !ok {
+				break
+			}
+			n, _ := strconv.Atoi(id)
+			_, err := bot.DeleteMessage(tgbotapi.DeleteMessageConfig{
+				ChatID: b.Group, MessageID: n})
+			if err != nil {
+				log.Printf("Failed to delete message %v: %v\n", n, err)
+			}
 		case "count":
 			count, err := bot.GetChatMembersCount(
-				tgbotapi.ChatConfig{ChatID: c.Group})
+				tgbotapi.ChatConfig{ChatID: b.Group})
 			if err != nil {
-				r.TeleServiceCh <- relay.ServiceMessage{
-					"announce",
-					[]string{"An error occured: \x02" + err.Error()},
-				}
+				sendService(r, relay.ServiceMessage{
+					Command:   "announce",
+					Arguments: []string{"An error occured: \x02" + err.Error()},
+					Bridge:    b.Name,
+					Target:    f.Origin,
+				})
 			} else {
-				r.TeleServiceCh <- relay.ServiceMessage{
-					"announce",
-					[]string{fmt.Sprintf("There are \x02%v"+
+				sendService(r, relay.ServiceMessage{
+					Command: "announce",
+					Arguments: []string{fmt.Sprintf("There are \x02%v"+
 						"\x0f users in the group.",
 						count)},
-				}
+					Bridge: b.Name,
+					Target: f.Origin,
+				})
 			}
 		case "ops":
 			ops, err := bot.GetChatAdministrators(
-				tgbotapi.ChatConfig{ChatID: c.Group})
+				tgbotapi.ChatConfig{ChatID: b.Group})
 			if err != nil {
-				r.TeleServiceCh <- relay.ServiceMessage{
-					"announce",
-					[]string{"An error occured: \x02" +
+				sendService(r, relay.ServiceMessage{
+					Command: "announce",
+					Arguments: []string{"An error occured: \x02" +
 						err.Error()},
-				}
+					Bridge: b.Name,
+					Target: f.Origin,
+				})
 			} else {
 				opsStr := ""
 				for _, v := range ops {
 					opsStr += v.User.String() + " "
 				}
-				r.TeleServiceCh <- relay.ServiceMessage{
-					"announce",
-					[]string{fmt.Sprintf(
+				sendService(r, relay.ServiceMessage{
+					Command: "announce",
+					Arguments: []string{fmt.Sprintf(
 						"Chat administrators: \x02%v"+
 							"\x0f",
 						opsStr)},
-				}
+					Bridge: b.Name,
+					Target: f.Origin,
+				})
 			}
 		case "sticker":
-			sticker := tgbotapi.NewStickerShare(c.Group, f.Arguments[0])
+			sticker := tgbotapi.NewStickerShare(b.Group, f.Arguments[0])
 			_, err := bot.Send(sticker)
 			if err != nil {
-				r.TeleServiceCh <- relay.ServiceMessage{
-					"announce",
-					[]string{"An error occured: \x02" +
+				sendService(r, relay.ServiceMessage{
+					Command: "announce",
+					Arguments: []string{"An error occured: \x02" +
 						err.Error()},
-				}
+					Bridge: b.Name,
+					Target: f.Origin,
+				})
 			} else {
 				text := "Sent a sticker"
-				switch {
-				case c.Storage == "pomf":
-					url, err := upload.Pomf(bot, f.Arguments[0], c)
-					if err == nil {
-						text += " ( " + url + " )"
-					}
-				case c.Storage == "komf":
-					url, err := upload.Komf(bot, f.Arguments[0], c)
-					if err == nil {
-						text += " ( " + url + " )"
-					}
-				case c.DownloadMedia:
-					url, err := download(f.Arguments[0], c)
-					if err == nil && c.Storage == "server" {
-						text += " ( " + url + " )"
-					}
-				}
-				r.TeleServiceCh <- relay.ServiceMessage{
-					"announce",
-					[]string{text},
+				if result, err := storeFile(c, f.Arguments[0]); err == nil && result.URL != "" {
+					text += " ( " + result.URL + " )"
 				}
+				sendService(r, relay.ServiceMessage{
+					Command:   "announce",
+					Arguments: []string{text},
+					Bridge:    b.Name,
+					Target:    f.Origin,
+				})
 			}
 		case "kick":
 			id, _ := strconv.Atoi(f.Arguments[0])
 			member := tgbotapi.ChatMemberConfig{
-				ChatID: c.Group,
+				ChatID: b.Group,
 				UserID: id,
 			}
-			_, err := bot.KickChatMember(tgbotapi.KickChatMemberConfig{member, 0})
+			_, err := bot.KickChatMember(tgbotapi.KickChatMemberConfig{
+				ChatMemberConfig: member,
+			})
 			if err != nil {
-				r.TeleServiceCh <- relay.ServiceMessage{
-					"announce",
-					[]string{"Unable to kick: " +
+				sendService(r, relay.ServiceMessage{
+					Command: "announce",
+					Arguments: []string{"Unable to kick: " +
 						err.Error() + "."},
-				}
+					Bridge: b.Name,
+					Target: f.Origin,
+				})
 			} else {
-				r.TeleServiceCh <- relay.ServiceMessage{
-					"action",
-					[]string{"kicked " + f.Arguments[1] + "."},
-				}
+				sendService(r, relay.ServiceMessage{
+					Command:   "action",
+					Arguments: []string{"kicked " + f.Arguments[1] + "."},
+					Bridge:    b.Name,
+					Target:    f.Origin,
+				})
 			}
 		case "unban":
 			id, _ := strconv.Atoi(f.Arguments[0])
 			member := tgbotapi.ChatMemberConfig{
-				ChatID: c.Group,
+				ChatID: b.Group,
 				UserID: id,
 			}
 			_, err := bot.UnbanChatMember(member)
 			if err != nil {
-				r.TeleServiceCh <- relay.ServiceMessage{
-					"announce",
-					[]string{"Unable to unban: " +
+				sendService(r, relay.ServiceMessage{
+					Command: "announce",
+					Arguments: []string{"Unable to unban: " +
 						err.Error() + "."},
-				}
+					Bridge: b.Name,
+					Target: f.Origin,
+				})
 			} else {
-				r.TeleServiceCh <- relay.ServiceMessage{
-					"action",
-					[]string{"unbanned " + f.Arguments[1] + "."},
-				}
+				sendService(r, relay.ServiceMessage{
+					Command:   "action",
+					Arguments: []string{"unbanned " + f.Arguments[1] + "."},
+					Bridge:    b.Name,
+					Target:    f.Origin,
+				})
 			}
 		case "status":
 			var text string
 
-			c := tgbotapi.ChatConfigWithUser{ChatID: c.Group, UserID: bot.Self.ID}
+			c := tgbotapi.ChatConfigWithUser{ChatID: b.Group, UserID: bot.Self.ID}
 			m, err := bot.GetChatMember(c)
 
 			if err != nil {
@@ -247,22 +511,25 @@ func listenService(r *relay.Relay, c *config.Telegram) {
 				}
 			}
 
-			r.TeleServiceCh <- relay.ServiceMessage{
-				"announce",
-				[]string{text},
-			}
+			sendService(r, relay.ServiceMessage{
+				Command:   "announce",
+				Arguments: []string{text},
+				Bridge:    b.Name,
+				Target:    f.Origin,
+			})
 		}
 	}
 }
 
-// processCmd works with commands starting with '/'.
-func processCmd(c *config.Telegram, message *tgbotapi.Message, cmd string, r *relay.Relay) {
+// processCmd works with commands starting with '/' sent in the group of the
+// bridge.
+func processCmd(c *config.Telegram, b *config.Bridge, message *tgbotapi.Message, cmd string, r *relay.Router) {
 	arg := message.CommandArguments()
 	switch cmd {
 	case "kick":
-		if c.Moderation {
+		if b.TGModeration {
 			user, err := bot.GetChatMember(
-				tgbotapi.ChatConfigWithUser{ChatID: c.Group,
+				tgbotapi.ChatConfigWithUser{ChatID: b.Group,
 					UserID: message.From.ID})
 			if err == nil {
 				switch user.Status {
@@ -270,42 +537,48 @@ func processCmd(c *config.Telegram, message *tgbotapi.Message, cmd string, r *re
 					fallthrough
 				case "creator":
 					if arg != "" {
-						f := relay.ServiceMessage{"kick",
-							[]string{arg,
-								message.From.String()}}
-						r.TeleServiceCh <- f
+						f := relay.ServiceMessage{
+							Command: "kick",
+							Arguments: []string{arg,
+								message.From.String()},
+							Bridge: b.Name,
+						}
+						sendService(r, f)
 					}
 				case "member":
-					m := tgbotapi.NewMessage(c.Group,
+					m := tgbotapi.NewMessage(b.Group,
 						"Insufficient permission.")
 					sendAndReport(m)
 				case "left":
 					fallthrough
 				case "kicked":
-					m := tgbotapi.NewMessage(c.Group,
+					m := tgbotapi.NewMessage(b.Group,
 						">/kick "+arg+"\n\nOh you.")
 					sendAndReport(m)
 				}
 			}
 		}
 	case "ops":
-		f := relay.ServiceMessage{"ops", []string{arg}}
-		r.TeleServiceCh <- f
+		f := relay.ServiceMessage{Command: "ops", Arguments: []string{arg},
+			Bridge: b.Name}
+		sendService(r, f)
 	case "bot":
 		if c.AllowBots {
-			f := relay.ServiceMessage{"bot", []string{arg}}
-			r.TeleServiceCh <- f
+			f := relay.ServiceMessage{Command: "bot", Arguments: []string{arg},
+				Bridge: b.Name}
+			sendService(r, f)
 		}
 	case "invite":
-		if c.AllowInvites {
-			f := relay.ServiceMessage{"invite", []string{arg}}
-			r.TeleServiceCh <- f
+		if b.AllowInvites {
+			f := relay.ServiceMessage{Command: "invite",
+				Arguments: []string{arg}, Bridge: b.Name}
+			sendService(r, f)
 		}
 	case "topic":
-		f := relay.ServiceMessage{"topic", nil}
-		r.TeleServiceCh <- f
+		f := relay.ServiceMessage{Command: "topic", Bridge: b.Name}
+		sendService(r, f)
 	case "version":
-		m := tgbotapi.NewMessage(c.Group, "IRChuu v"+config.VERSION)
+		m := tgbotapi.NewMessage(b.Group, "IRChuu v"+config.VERSION)
 		sendAndReport(m)
 	case "help":
 		text := `Available commands:
@@ -315,28 +588,91 @@ func processCmd(c *config.Telegram, message *tgbotapi.Message, cmd string, r *re
 /topic — get IRC channel topic
 /ops — view OPs list
 /status — check the IRC bot status`
-		if c.AllowInvites {
+		if b.AllowInvites {
 			text += "\n/invite [nick] — invite a user to the IRC channel"
 		}
-		if c.Moderation {
+		if b.TGModeration {
 			text += "\n/kick — kick a user from IRC"
 		}
 		if c.AllowBots {
 			text += "\n/bot [message] — send messages to IRC bots (no nickname prefix)"
 		}
-		m := tgbotapi.NewMessage(c.Group, text)
+		if c.DownloadMedia || c.Stores("server") {
+			text += "\n/media — show how much disk media files use"
+		}
+		m := tgbotapi.NewMessage(b.Group, text)
 		sendAndReport(m)
 	case "status":
-		f := relay.ServiceMessage{"status", nil}
-		r.TeleAlwaysCh <- f
+		f := relay.ServiceMessage{Command: "status", Bridge: b.Name}
+		sendService(r, f)
+	case "media":
+		if c.DownloadMedia || c.Stores("server") {
+			sendAndReport(tgbotapi.NewMessage(b.Group, mediaStats(c)))
+		}
 	}
 }
 
+// mediaStats describes how much disk the downloaded media files use.
+func mediaStats(c *config.Telegram) string {
+	library, err := upload.OpenLibrary(c.DataDir)
+	if err != nil {
+		return "An error occurred: " + err.Error()
+	}
+	s := library.Stats()
+	text := fmt.Sprintf("Media files: %d, %viB", s.Files,
+		bytefmt.ByteSize(uint64(s.Bytes)))
+	if c.MediaQuota != 0 {
+		text += fmt.Sprintf(" of %d MiB", c.MediaQuota)
+	}
+	if s.IDs > s.Files {
+		text += fmt.Sprintf("\nDuplicates: %d, %viB saved", s.IDs-s.Files,
+			bytefmt.ByteSize(uint64(s.Saved)))
+	}
+	if !s.Oldest.IsZero() {
+		text += "\nOldest: " + s.Oldest.Format("2006-01-02")
+	}
+	if c.MediaTTL != 0 {
+		text += fmt.Sprintf(", removed after %d days", c.MediaTTL)
+	}
+	return text
+}
+
 // processPM replies to private messages from Telegram, sending them info
 // about the bot.
-func processPM(c *config.Telegram, message *tgbotapi.Message, logger *log.Logger) {
+func processPM(c *config.Telegram, message *tgbotapi.Message, logger *log.Logger, r *relay.Router) {
 	logger.Printf("Incoming PM from %v: %v\n", message.From.String(),
 		message.Text)
+	if irchuubase.IsAvailable() && message.From != nil {
+		switch message.Command() {
+		case "link":
+			sendLinkCode(message, logger)
+			return
+		case "unlink":
+			text := "Your IRC account is unlinked."
+			if err := irchuubase.Unlink(message.From.ID); err != nil {
+				text = "An error occurred: " + err.Error()
+			}
+			sendAndReport(tgbotapi.NewMessage(message.Chat.ID, text))
+			return
+		}
+	}
+	if irchuubase.IsAvailable() && message.From != nil && message.Text != "" {
+		// replies go to the IRC user who wrote to them
+		var replyID int
+		if message.ReplyToMessage != nil {
+			replyID = message.ReplyToMessage.MessageID
+		}
+		nick, bridge, err := irchuubase.FindPrivate(message.From.ID, replyID)
+		if err == nil {
+			sendService(r, relay.ServiceMessage{
+				Command:   "pm",
+				Arguments: []string{nick, message.Text, message.From.String()},
+				Bridge:    bridge,
+				Target:    "irc",
+			})
+			return
+		}
+	}
 	msg := tgbotapi.NewMessage(message.Chat.ID,
 		"I only work in my group.\nIf you want to know more about me, "+
 			"visit my [GitHub](https://github.com/26000/irchuu).")
@@ -344,38 +680,83 @@ func processPM(c *config.Telegram, message *tgbotapi.Message, logger *log.Logger
 	sendAndReport(msg)
 }
 
-// relayMessagesToTG listens to the channel and sends messages from IRC to
-// Telegram.
-func relayMessagesToTG(r *relay.Relay, c *config.Telegram) {
-	for message := range r.IRCh {
-		m := formatTGMessage(message, c)
-		sendAndReport(m)
+// sendLinkCode sends the user a one-time code which links their Telegram
+// account to the NickServ account of whoever sends it from IRC.
+func sendLinkCode(message *tgbotapi.Message, logger *log.Logger) {
+	b := make([]byte, linkCodeSize)
+	if _, err := rand.Read(b); err != nil {
+		logger.Printf("Failed to generate a code: %v\n", err)
+		return
+	}
+	code := hex.EncodeToString(b)
+	if err := irchuubase.NewLinkCode(message.From.ID, code, linkCodeTTL); err != nil {
+		sendAndReport(tgbotapi.NewMessage(message.Chat.ID,
+			"An error occurred: "+err.Error()))
+		return
+	}
+	m := tgbotapi.NewMessage(message.Chat.ID, fmt.Sprintf("Identify with "+
+		"NickServ in IRC and send me <code>link %v</code> privately there "+
+		"within %v minutes.", code, int(linkCodeTTL.Minutes())))
+	m.ParseMode = "HTML"
+	sendAndReport(m)
+}
+
+// sendPM delivers a private message of an IRC user to a Telegram user.
+// The user must have started a conversation with the bot before.
+func sendPM(r *relay.Router, b *config.Bridge, f relay.ServiceMessage) {
+	id, _ := strconv.Atoi(f.Arguments[0])
+	nick, text := f.Arguments[1], f.Arguments[2]
+	hint := ""
+	if _, _, err := irchuubase.FindPrivate(id, 0); err != nil {
+		hint = "\n\n<i>Reply to this message to answer.</i>"
+	}
+	m := tgbotapi.NewMessage(int64(id), fmt.Sprintf("<b>%v</b> from %v: %v%v",
+		html.EscapeString(nick), html.EscapeString(b.Channel),
+		html.EscapeString(text), hint))
+	m.ParseMode = "HTML"
+	sent, err := bot.Send(m)
+	if err != nil {
+		reason := err.Error()
+		if strings.Contains(reason, "Forbidden") {
+			reason = "they have not started a conversation with me"
+		}
+		sendService(r, relay.ServiceMessage{
+			Command:   "pm",
+			Arguments: []string{nick, "Could not deliver the message: " + reason + "."},
+			Bridge:    b.Name,
+			Target:    f.Origin,
+		})
+		return
+	}
+	if err = irchuubase.SavePrivate(id, sent.MessageID, nick, b.Name); err != nil {
+		log.Printf("Failed to save a private message: %v\n", err)
 	}
 }
 
 // formatTGMessage translates a universal message into Telegram's one.
-func formatTGMessage(message relay.Message, c *config.Telegram) tgbotapi.MessageConfig {
-	message.Text = html.EscapeString(message.Text)
-	message.Text = reconstructMarkup(message.Text)
+func formatTGMessage(message relay.Message, b *config.Bridge, colors string) tgbotapi.MessageConfig {
+	// display names from other networks may contain anything
+	message.Nick = html.EscapeString(message.Nick)
+	message.Text = reconstructMarkup(message.Text, colors, message.Mentions())
 	var m tgbotapi.MessageConfig
 	switch message.Extra["special"] {
 	case "TOPIC":
-		m = tgbotapi.NewMessage(c.Group,
+		m = tgbotapi.NewMessage(b.Group,
 			fmt.Sprintf("<b>%v</b> has set a new topic: <b>%v</b>.",
 				message.Nick, message.Text))
 	case "KICK":
-		m = tgbotapi.NewMessage(c.Group,
+		m = tgbotapi.NewMessage(b.Group,
 			fmt.Sprintf("<b>%v</b> has kicked <b>%v</b>.",
 				message.Nick, message.Text))
 	case "NICK":
-		m = tgbotapi.NewMessage(c.Group,
+		m = tgbotapi.NewMessage(b.Group,
 			fmt.Sprintf("<b>%v</b> is now known as <b>%v</b>.",
 				message.Nick, message.Text))
 	case "ACTION":
-		m = tgbotapi.NewMessage(c.Group, fmt.Sprintf("*<b>%v</b> %v*",
+		m = tgbotapi.NewMessage(b.Group, fmt.Sprintf("*<b>%v</b> %v*",
 			message.Nick, message.Text))
 	case "MODE":
-		m = tgbotapi.NewMessage(c.Group, fmt.Sprintf("<b>%v</b> has set mode <b>%v</b>.",
+		m = tgbotapi.NewMessage(b.Group, fmt.Sprintf("<b>%v</b> has set mode <b>%v</b>.",
 			message.Nick, message.Text))
 	case "PART":
 		var text string
@@ -386,7 +767,7 @@ func formatTGMessage(message relay.Message, c *config.Telegram) tgbotapi.Message
 			text = fmt.Sprintf("<b>%v</b> has left: <b>%v</b>.",
 				message.Nick, message.Text)
 		}
-		m = tgbotapi.NewMessage(c.Group, text)
+		m = tgbotapi.NewMessage(b.Group, text)
 	case "QUIT":
 		var text string
 		if message.Text == "" {
@@ -396,17 +777,22 @@ func formatTGMessage(message relay.Message, c *config.Telegram) tgbotapi.Message
 			text = fmt.Sprintf("<b>%v</b> has quit: <b>%v</b>.",
 				message.Nick, message.Text)
 		}
-		m = tgbotapi.NewMessage(c.Group, text)
+		m = tgbotapi.NewMessage(b.Group, text)
 	case "JOIN":
-		m = tgbotapi.NewMessage(c.Group,
+		m = tgbotapi.NewMessage(b.Group,
 			fmt.Sprintf("<b>%v</b> has joined.",
 				message.Nick))
 	case "NOTICE":
-		m = tgbotapi.NewMessage(c.Group, fmt.Sprintf("(notice) %s<b>%v</b>%s %v",
-			c.Prefix, message.Nick, c.Postfix, message.Text))
+		m = tgbotapi.NewMessage(b.Group, fmt.Sprintf("(notice) %s<b>%v</b>%s %v",
+			b.TGPrefix, message.Nick, b.TGPostfix, message.Text))
 	default:
-		m = tgbotapi.NewMessage(c.Group, fmt.Sprintf("%s<b>%v</b>%s %v",
-			c.Prefix, message.Nick, c.Postfix, message.Text))
+		// media from other transports is relayed as links
+		if url := message.Extra["url"]; url != "" {
+			message.Text = strings.TrimSpace(message.Text + " " +
+				html.EscapeString(url))
+		}
+		m = tgbotapi.NewMessage(b.Group, fmt.Sprintf("%s<b>%v</b>%s %v",
+			b.TGPrefix, message.Nick, b.TGPostfix, message.Text))
 	}
 	m.ParseMode = "HTML"
 	return m
@@ -415,7 +801,7 @@ func formatTGMessage(message relay.Message, c *config.Telegram) tgbotapi.Message
 // formatMessage maps the message onto the universal message struct
 // (relay.Message).
 // TODO: split into several funcs?
-func formatMessage(message *tgbotapi.Message, id int, prefix string) relay.Message {
+func formatMessage(message *tgbotapi.Message, id int, b *config.Bridge) relay.Message {
 	extra := make(map[string]string)
 
 	if message.PinnedMessage != nil {
@@ -434,13 +820,16 @@ func formatMessage(message *tgbotapi.Message, id int, prefix string) relay.Messa
 		extra["special"] = "pin"
 	}
 
+	mentions := findMentions(message)
 	if message.Text == "" {
 		message.Text = message.Caption
 	} else {
-		message.Text = translateMarkup(*message)
+		text := translateMarkup(*message)
+		mentions = moveMentions(message.Text, text, mentions)
+		message.Text = text
 	}
 
-	if message.ReplyToMessage != nil && message.ReplyToMessage.From.ID == id && message.ReplyToMessage.Entities != nil && len(*message.ReplyToMessage.Entities) > 0 && strings.HasPrefix(message.ReplyToMessage.Text, html.UnescapeString(prefix)) {
+	if message.ReplyToMessage != nil && message.ReplyToMessage.From.ID == id && message.ReplyToMessage.Entities != nil && len(*message.ReplyToMessage.Entities) > 0 && strings.HasPrefix(message.ReplyToMessage.Text, html.UnescapeString(b.TGPrefix)) {
 		extra["reply"] = getEntity(message.ReplyToMessage.Text,
 			(*message.ReplyToMessage.Entities)[0])
 		extra["replyID"] = strconv.Itoa(message.ReplyToMessage.MessageID)
@@ -555,9 +944,10 @@ func formatMessage(message *tgbotapi.Message, id int, prefix string) relay.Messa
 		extra["special"] = "deleteChatPhoto"
 	}
 
-	return relay.Message{
+	f := relay.Message{
 		Date:   message.Time(),
-		Source: true,
+		Origin: transportName,
+		Bridge: b.Name,
 		Nick:   message.From.UserName,
 		Text:   message.Text,
 
@@ -567,39 +957,8 @@ func formatMessage(message *tgbotapi.Message, id int, prefix string) relay.Messa
 		LastName:  message.From.LastName,
 		Extra:     extra,
 	}
-}
-
-// download gets the media link from Telegram and downloads its contents.
-func download(id string, c *config.Telegram) (url string, err error) {
-	file, err := bot.GetFileDirectURL(id)
-	if err != nil {
-		return
-	}
-	fileStrings := strings.Split(file, "/")
-	fileName := strings.Split(fileStrings[len(fileStrings)-1], ".")
-
-	var ext string
-	if len(fileName) > 1 {
-		ext = "." + fileName[len(fileName)-1]
-	}
-	localUrl := path.Join(c.DataDir, id+ext)
-	if paths.Exists(localUrl) {
-		url = c.BaseURL + "/" + id + ext
-		return
-	}
-	downloadable, err := http.Get(file)
-	defer downloadable.Body.Close()
-	if err != nil {
-		return
-	}
-	res, err := os.Create(localUrl)
-	if err != nil {
-		return
-	}
-	defer res.Close()
-	io.Copy(res, downloadable.Body)
-	url = c.BaseURL + "/" + id + ext
-	return
+	f.SetMentions(mentions)
+	return f
 }
 
 // getEntity returns the text of an entity.
@@ -616,112 +975,6 @@ func getFullName(user *tgbotapi.User) string {
 	return name
 }
 
-// translateMarkup turns Telegram's entities into IRC's codes.
-func translateMarkup(message tgbotapi.Message) string {
-	messageText := utf16.Encode([]rune(message.Text))
-	if message.Entities != nil {
-		off := 0
-		for i := 0; i < len(*message.Entities); i++ {
-			e := (*message.Entities)[i]
-			e.Offset += off
-			switch e.Type {
-			case "italic":
-				// \x1d, \x0f
-				messageText = surroundCodePoints(messageText,
-					e.Offset, e.Length, []uint16{29},
-					[]uint16{15})
-				off += 2
-			case "bold":
-				// \x02, \x0f
-				messageText = surroundCodePoints(messageText,
-					e.Offset, e.Length, []uint16{2},
-					[]uint16{15})
-				off += 2
-			case "text_link":
-				var newMessageText []uint16
-				url := utf16.Encode([]rune(e.URL))
-				newMessageText = append(newMessageText,
-					messageText[:e.Offset+e.Length]...)
-				newMessageText = append(newMessageText,
-					[]uint16{32, 40}...) // " ("
-				newMessageText = append(newMessageText, url...)
-				newMessageText = append(newMessageText,
-					[]uint16{41, 32}...) // ") "
-				newMessageText = append(newMessageText,
-					messageText[e.Offset+e.Length:]...)
-				off += 4 + len(url)
-				messageText = newMessageText
-			}
-		}
-	}
-	return string(utf16.Decode(messageText))
-}
-
-// reconstructMarkup translates IRC markup to HTML.
-func reconstructMarkup(text string) string {
-
-	// strip the colors (or they'll be shown as numbers)
-	regex, _ := regexp.Compile("\x03(?:\\d{1,2}(?:,\\d{1,2})?)?")
-	text = regex.ReplaceAllLiteralString(text, "")
-
-	newText := ""
-	// 0 is plain, 1 is bold (\x02), 2 is italic (\x1d), 3 is color (\x03)
-	// if telegram starts supporting it, underline (\x1f) will be added
-	// IRC also has reverse (\x16) and color (\x03), which we don't need
-	// plain (\x0f) stops all the previous modifiers
-	state := 0
-	for _, v := range text {
-		switch state {
-		case 0:
-			switch v {
-			case '\x02':
-				newText += "<b>"
-				state = 1
-			case '\x1d':
-				newText += "<i>"
-				state = 2
-			default:
-				newText += string(v)
-			}
-		case 1:
-			if v == '\x0f' {
-				newText += "</b>"
-				state = 0
-			} else {
-				newText += string(v)
-			}
-		case 2:
-			if v == '\x0f' {
-				newText += "</i>"
-				state = 0
-			} else {
-				newText += string(v)
-			}
-		}
-	}
-
-	// if the tags were not closed, HTML will be invalid (but it's ok for IRC)
-	switch state {
-	case 1:
-		newText += "</b>"
-	case 2:
-		newText += "</i>"
-	}
-
-	return newText
-}
-
-// surroundCodePoints surrounds part of a uint16 slice with two other slices.
-func surroundCodePoints(slice []uint16, offset int, length int, slice1 []uint16, slice2 []uint16) []uint16 {
-	var new []uint16
-	new = append(new, slice[:offset]...)
-	new = append(new, slice1...)
-	new = append(new, slice[offset:offset+length]...)
-	new = append(new, slice2...)
-	new = append(new, slice[offset+length:]...)
-	return new
-}
-
 // sendAndReport sends a message and reports errors if any.
 func sendAndReport(msg tgbotapi.MessageConfig) {
 	_, err := bot.Send(msg)
@@ -0,0 +1,39 @@
+package telegram
+
+import (
+	"testing"
+
+	"github.com/26000/irchuu/config"
+	"github.com/26000/irchuu/relay"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormatTGMessage(t *testing.T) {
+	assert := assert.New(t)
+	b := &config.Bridge{Group: -1001234567, TGPrefix: "<", TGPostfix: ">"}
+
+	m := formatTGMessage(relay.Message{Origin: "matrix", Nick: "a<b",
+		Text: "1 & 2", Extra: map[string]string{}}, b, "none")
+	assert.Equal("HTML", m.ParseMode)
+	assert.Equal("<<b>a&lt;b</b>> 1 &amp; 2", m.Text)
+
+	// the mention is linked at its offset in the IRC text
+	message := relay.Message{Origin: "irc", Nick: "nick",
+		Text: "a<b \x02x\x0f @alice hi", Extra: map[string]string{}}
+	message.SetMentions([]relay.Mention{{Offset: 8, Length: 6, ID: 42}})
+	m = formatTGMessage(message, b, "none")
+	assert.Equal(`<<b>nick</b>> a&lt;b <b>x</b> <a href="tg://user?id=42">@alice</a> hi`,
+		m.Text)
+
+	for special, text := range map[string]string{
+		"NOTICE": "(notice) <<b>a&lt;b</b>> hi",
+		"JOIN":   "<b>a&lt;b</b> has joined.",
+		"QUIT":   "<b>a&lt;b</b> has quit: <b>hi</b>.",
+		"NICK":   "<b>a&lt;b</b> is now known as <b>hi</b>.",
+	} {
+		m = formatTGMessage(relay.Message{Origin: "xmpp", Nick: "a<b",
+			Text: "hi", Extra: map[string]string{"special": special}}, b, "none")
+		assert.Equal(text, m.Text, special)
+	}
+}
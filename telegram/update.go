@@ -0,0 +1,88 @@
+package telegram
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+// pollTimeout is how long Telegram holds a request for updates.
+const pollTimeout = 60
+
+// update is an update from Telegram with the fields the library does not
+// know about.
+type update struct {
+	tgbotapi.Update
+	MediaGroupID string // of the album the message belongs to
+}
+
+// UnmarshalJSON decodes an update.
+func (u *update) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &u.Update); err != nil {
+		return err
+	}
+	type fields struct {
+		MediaGroupID string `json:"media_group_id"`
+	}
+	var extra struct {
+		Message       *fields `json:"message"`
+		EditedMessage *fields `json:"edited_message"`
+	}
+	if err := json.Unmarshal(data, &extra); err != nil {
+		return err
+	}
+	switch {
+	case extra.Message != nil:
+		u.MediaGroupID = extra.Message.MediaGroupID
+	case extra.EditedMessage != nil:
+		u.MediaGroupID = extra.EditedMessage.MediaGroupID
+	}
+	return nil
+}
+
+// pollUpdates requests updates from Telegram and passes them to the channel
+// until stopped.
+func pollUpdates(updates chan<- update, stop chan struct{}, logger *log.Logger) {
+	offset := 0
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		resp, err := bot.MakeRequest("getUpdates", url.Values{
+			"offset":  {strconv.Itoa(offset)},
+			"timeout": {strconv.Itoa(pollTimeout)},
+		})
+		var batch []update
+		if err == nil {
+			err = json.Unmarshal(resp.Result, &batch)
+		}
+		if err != nil {
+			logger.Printf("Failed to get updates, retrying in 3 seconds: %v\n", err)
+			select {
+			case <-time.After(3 * time.Second):
+			case <-stop:
+				return
+			}
+			continue
+		}
+
+		for _, u := range batch {
+			if u.UpdateID < offset {
+				continue
+			}
+			offset = u.UpdateID + 1
+			select {
+			case updates <- u:
+			case <-stop:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package telegram
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/26000/irchuu/config"
+	mediaserver "github.com/26000/irchuu/server"
+)
+
+// secretHeader is the header in which Telegram sends the secret token.
+const secretHeader = "X-Telegram-Bot-Api-Secret-Token"
+
+// maxUpdateSize is the maximum size of an update received via the webhook.
+const maxUpdateSize = 1 << 20
+
+// listenWebhook registers a webhook handler on the web server and tells
+// Telegram to send updates to it.
+func listenWebhook(c *config.Telegram, logger *log.Logger) (<-chan update, error) {
+	secret := c.WebhookSecret
+	if secret == "" {
+		var err error
+		if secret, err = randomToken(); err != nil {
+			return nil, err
+		}
+	}
+	// the path is secret too, so the endpoint is not easy to find
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	path := "/telegram/" + token
+
+	updates := make(chan update, bot.Buffer)
+	mediaserver.Handle(path, webhookHandler(secret, updates, logger))
+
+	base := c.WebhookURL
+	if base == "" {
+		base = c.BaseURL
+	}
+	resp, err := bot.MakeRequest("setWebhook", url.Values{
+		"url":             {base + path},
+		"secret_token":    {secret},
+		"allowed_updates": {`["message","edited_message"]`},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Ok {
+		return nil, errors.New(resp.Description)
+	}
+	logger.Printf("Receiving updates via the webhook at %v/telegram/…\n", base)
+	return updates, nil
+}
+
+// webhookHandler decodes updates sent by Telegram and passes them to the
+// channel. Requests without the secret token are rejected.
+func webhookHandler(secret string, updates chan<- update, logger *log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := req.Header.Get(secretHeader)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			logger.Printf("Rejected a webhook request from %v: wrong secret token\n",
+				req.RemoteAddr)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+
+		var u update
+		err := json.NewDecoder(io.LimitReader(req.Body, maxUpdateSize)).Decode(&u)
+		if err != nil {
+			logger.Printf("Failed to decode an update: %v\n", err)
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		select {
+		case updates <- u:
+		case <-req.Context().Done():
+			// Telegram will send the update again
+			return
+		}
+	})
+}
+
+// randomToken generates a random token suitable for URLs and headers.
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,43 @@
+package telegram
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookHandler(t *testing.T) {
+	assert := assert.New(t)
+	updates := make(chan update, 1)
+	h := webhookHandler("secret", updates, log.New(os.Stdout, " TG ", log.LstdFlags))
+
+	request := func(method, secret, body string) int {
+		req := httptest.NewRequest(method, "/telegram/token", strings.NewReader(body))
+		if secret != "" {
+			req.Header.Set(secretHeader, secret)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	const update = `{"update_id":42,"message":{"message_id":1,"text":"hi",` +
+		`"media_group_id":"13","chat":{"id":-1001234567890,"type":"supergroup"}}}`
+	assert.Equal(http.StatusMethodNotAllowed, request("GET", "secret", ""))
+	assert.Equal(http.StatusForbidden, request("POST", "", update))
+	assert.Equal(http.StatusForbidden, request("POST", "wrong", update))
+	assert.Equal(http.StatusBadRequest, request("POST", "secret", "{"))
+	assert.Empty(updates)
+
+	assert.Equal(http.StatusOK, request("POST", "secret", update))
+	u := <-updates
+	assert.Equal(42, u.UpdateID)
+	assert.Equal("hi", u.Message.Text)
+	assert.Equal(int64(-1001234567890), u.Message.Chat.ID)
+	assert.Equal("13", u.MediaGroupID)
+}
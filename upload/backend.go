@@ -0,0 +1,132 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/26000/irchuu/config"
+
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+// Result describes a stored file.
+type Result struct {
+	URL     string
+	Expires time.Time // zero if the file is stored forever
+	Size    int64
+}
+
+// Backend stores media files and makes them accessible by URL.
+type Backend interface {
+	Store(ctx context.Context, f *File) (Result, error)
+}
+
+// Factory creates a backend from the config.
+type Factory func(c *config.Telegram) (Backend, error)
+
+var (
+	// factories of backends by names
+	factories   = make(map[string]Factory)
+	factoriesMu sync.Mutex
+)
+
+// Register makes a backend available by the name in the storage setting.
+func Register(name string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[name] = factory
+}
+
+// New creates the backends of the storage chain set in the config, which are
+// tried one after another. It returns nil if media is not stored.
+func New(c *config.Telegram) (Backend, error) {
+	var chain Chain
+	for _, name := range c.StorageChain() {
+		factoriesMu.Lock()
+		factory := factories[name]
+		factoriesMu.Unlock()
+		if factory == nil {
+			return nil, fmt.Errorf("unknown storage %v", name)
+		}
+		b, err := factory(c)
+		if err != nil {
+			return nil, fmt.Errorf("storage %v: %v", name, err)
+		}
+		chain = append(chain, Named{name, b})
+	}
+	switch len(chain) {
+	case 0:
+		return nil, nil
+	case 1:
+		return chain[0].Backend, nil
+	}
+	return chain, nil
+}
+
+// Named is a backend with its name.
+type Named struct {
+	Name string
+	Backend
+}
+
+// Chain is a backend which tries its backends one after another until one of
+// them stores the file.
+type Chain []Named
+
+// Store stores the file with the first backend which succeeds.
+func (chain Chain) Store(ctx context.Context, f *File) (Result, error) {
+	var failures []string
+	for _, b := range chain {
+		result, err := b.Store(ctx, f)
+		if err == nil {
+			return result, nil
+		}
+		failures = append(failures, fmt.Sprintf("%v: %v", b.Name, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return Result{}, errors.New(strings.Join(failures, "; "))
+}
+
+// Store stores the Telegram media file with the backend within the upload
+// timeout.
+func Store(b Backend, bot *tgbotapi.BotAPI, id string, c *config.Telegram) (Result, error) {
+	_, timeout := limits(c)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	f, err := Media(bot, id, c)
+	if err != nil {
+		return Result{}, err
+	}
+	return b.Store(ctx, f)
+}
+
+// StoreRemote stores the media file from another network with the backend
+// within the upload timeout.
+func StoreRemote(b Backend, f *File, c *config.Telegram) (Result, error) {
+	_, timeout := limits(c)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return b.Store(ctx, f)
+}
+
+// Download saves the local copy of the Telegram media file within the upload
+// timeout.
+func Download(bot *tgbotapi.BotAPI, id string, c *config.Telegram) error {
+	_, timeout := limits(c)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	f, err := Media(bot, id, c)
+	if err != nil {
+		return err
+	}
+	_, err = f.Download(ctx)
+	return err
+}
@@ -1,147 +1,64 @@
 package upload
 
 import (
-	"bytes"
-	"io"
-	"io/ioutil"
-	"mime/multipart"
-	"net/http"
-	"os"
-	"path"
+	"context"
+	"errors"
 	"regexp"
-	"strings"
+	"time"
 
 	"github.com/26000/irchuu/config"
-	"github.com/26000/irchuu/paths"
-
-	tgbotapi "gopkg.in/telegram-bot-api.v4"
 )
 
 var downloadRegex = regexp.MustCompile("<a href=\".*\">(.*)</a>")
 
-// Komf uploads a Telegram media file to a komf hosting. It doesn't check
-// if the file was already uploaded, that is handeled by pomfs.
-func Komf(bot *tgbotapi.BotAPI, id string, c *config.Telegram) (url string, err error) {
-	file, err := bot.GetFileDirectURL(id)
-	if err != nil {
-		return
-	}
-	fileStrings := strings.Split(file, "/")
-	fileName := strings.Split(fileStrings[len(fileStrings)-1], ".")
-
-	var ext string
-	if len(fileName) > 1 {
-		ext = "." + fileName[len(fileName)-1]
-	}
-	localUrl := path.Join(c.DataDir, id+ext)
-	// if it is already downloaded, just upload the local copy
-	if paths.Exists(localUrl) {
-		return uploadLocalFileKomf(localUrl, c)
-	}
-	return uploadRemoteFileKomf(file, localUrl, id, fileStrings[len(fileStrings)-1], c)
+// komfPeriods are how long komf stores files for each date setting.
+var komfPeriods = map[string]time.Duration{
+	"day":   24 * time.Hour,
+	"week":  7 * 24 * time.Hour,
+	"month": 30 * 24 * time.Hour,
 }
 
-// uploadLocalFileKomf actually uploads the file to a komf using HTTP POST with
-// multipart/form-data mime. It also reads the whole file to memory because of
-// the current implementation of Go's multipart.
-func uploadLocalFileKomf(file string, c *config.Telegram) (url string, err error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return
-	}
-	defer f.Close()
-
-	var b bytes.Buffer
-	w := multipart.NewWriter(&b)
-	ff, err := w.CreateFormFile("file", f.Name())
-	if err != nil {
-		return
-	}
-
-	// i know, copying it to RAM was never a good idea...
-	_, err = io.Copy(ff, f)
-	if err != nil {
-		return
-	}
-
-	err = w.WriteField("date", c.KomfDate)
-	if err != nil {
-		return
-	}
-
-	w.Close()
+func init() {
+	Register("komf", newKomf)
+}
 
-	r, err := http.Post(makeKomfUrl(c.Komf), w.FormDataContentType(), &b)
-	if err != nil {
-		return
-	}
-	defer r.Body.Close()
+// komf uploads files to a komf hosting (https://github.com/koto-bank/komf).
+type komf struct {
+	url  string
+	date string // how long files are stored for
+}
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return
+// newKomf creates the komf backend.
+func newKomf(c *config.Telegram) (Backend, error) {
+	if c.Komf == "" {
+		return nil, errors.New("'komf' is not set")
 	}
-
-	url = makeKomfDownloadUrl(string(body))
-	return
+	return &komf{url: c.Komf, date: c.KomfDate}, nil
 }
 
-// uploadRemoteFileKomf downloads a file from Telegram and uploads it to a
-// komf using HTTP POST with multipart/form-data mime. It also reads the
-// whole file to memory because of the current implementation of Go's multipart.
-func uploadRemoteFileKomf(file string, localUrl string, id string, name string, c *config.Telegram) (url string, err error) {
-	downloadable, err := http.Get(file)
-	defer downloadable.Body.Close()
-	var b bytes.Buffer
-	w := multipart.NewWriter(&b)
-	ff, err := w.CreateFormFile("file", name) // create the multipart file
+// Store streams the file to the komf using HTTP POST with
+// multipart/form-data mime.
+func (k *komf) Store(ctx context.Context, f *File) (Result, error) {
+	file, _, err := f.Open(ctx)
 	if err != nil {
-		return
-	}
-
-	if c.DownloadMedia {
-		// if we need to both upload and download it, we use io.MultiWriter
-		res, err := os.Create(localUrl)
-		if err != nil {
-			return "", err
-		}
-		writer := io.MultiWriter(res, ff)
-
-		// i know, copying it to RAM was never a good idea...
-		_, err = io.Copy(writer, downloadable.Body)
-		res.Close()
-		if err != nil {
-			return "", err
-		}
-	} else {
-		// just io.Copy otherwise
-		// i know, copying it to RAM was never a good idea...
-		_, err = io.Copy(ff, downloadable.Body)
-		if err != nil {
-			return
-		}
+		return Result{}, err
 	}
-	err = w.WriteField("date", c.KomfDate)
+	defer file.Close()
+	body, size, err := postFile(ctx, makeKomfUrl(k.url), "file", f.Name, file,
+		map[string]string{"date": k.date})
 	if err != nil {
-		return
+		return Result{}, err
 	}
 
-	w.Close()
-
-	r, err := http.Post(makeKomfUrl(c.Komf), w.FormDataContentType(), &b)
-	if err != nil {
-		return
+	url := makeKomfDownloadUrl(string(body))
+	if url == "" {
+		return Result{}, errors.New("the komf returned no link")
 	}
-	defer r.Body.Close()
-
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return
+	result := Result{URL: url, Size: size}
+	if period, ok := komfPeriods[k.date]; ok {
+		result.Expires = time.Now().Add(period)
 	}
-
-	url = makeKomfDownloadUrl(string(body))
-
-	return
+	return result, nil
 }
 
 // makePomfUrl just appends "upload" to a komf site link.
@@ -0,0 +1,290 @@
+package upload
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// libraryIndex is the name of the index of the library in the data directory.
+const libraryIndex = ".library.json"
+
+// maintenanceInterval is how often the library evicts files.
+const maintenanceInterval = 10 * time.Minute
+
+// legacyName matches the names of files saved by older versions, which are
+// named after their Telegram file IDs.
+var legacyName = regexp.MustCompile(`^[A-Za-z0-9_-]+(\.[A-Za-z0-9]+)?$`)
+
+var (
+	// libraries by their directories
+	libraries   = make(map[string]*Library)
+	librariesMu sync.Mutex
+)
+
+// Library keeps downloaded media files in a directory. Files are named after
+// the SHA-256 of their content, so a file sent many times is stored once.
+type Library struct {
+	dir string
+
+	mu    sync.Mutex
+	ids   map[string]string       // file names by Telegram file IDs
+	files map[string]*libraryFile // by file names
+	dirty bool                    // the index is to be saved
+}
+
+// libraryFile is a file in the library.
+type libraryFile struct {
+	Size  int64
+	Added time.Time
+	Used  time.Time
+}
+
+// LibraryStats describes how much disk the library uses.
+type LibraryStats struct {
+	Files  int   // stored files
+	Bytes  int64 // their total size
+	IDs    int   // Telegram files they are the content of
+	Saved  int64 // size of the copies not stored thanks to deduplication
+	Oldest time.Time
+}
+
+// OpenLibrary returns the library in the directory.
+func OpenLibrary(dir string) (*Library, error) {
+	librariesMu.Lock()
+	defer librariesMu.Unlock()
+	if l := libraries[dir]; l != nil {
+		return l, nil
+	}
+	l, err := loadLibrary(dir)
+	if err != nil {
+		return nil, err
+	}
+	libraries[dir] = l
+	return l, nil
+}
+
+// loadLibrary reads the index of the library in the directory and imports
+// the files saved before it.
+func loadLibrary(dir string) (*Library, error) {
+	l := &Library{dir: dir, ids: make(map[string]string),
+		files: make(map[string]*libraryFile)}
+	data, err := ioutil.ReadFile(filepath.Join(dir, libraryIndex))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var index struct {
+			IDs   map[string]string
+			Files map[string]*libraryFile
+		}
+		if err = json.Unmarshal(data, &index); err != nil {
+			return nil, err
+		}
+		if index.IDs != nil {
+			l.ids = index.IDs
+		}
+		if index.Files != nil {
+			l.files = index.Files
+		}
+	}
+	if err = l.importLegacy(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// importLegacy adds the files which are not in the index, e. g. the ones
+// named after their Telegram file IDs by older versions, so they are
+// evicted too. They keep their names, so links to them still work.
+func (l *Library) importLegacy() error {
+	infos, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return err
+	}
+	var imported int
+	for _, info := range infos {
+		name := info.Name()
+		if !info.Mode().IsRegular() || !legacyName.MatchString(name) ||
+			strings.HasSuffix(name, ".part") || l.files[name] != nil {
+			continue
+		}
+		l.files[name] = &libraryFile{Size: info.Size(), Added: info.ModTime(),
+			Used: info.ModTime()}
+		l.ids[strings.TrimSuffix(name, filepath.Ext(name))] = name
+		imported++
+	}
+	if imported == 0 {
+		return nil
+	}
+	return l.save()
+}
+
+// Path returns the path of the content of the Telegram file or an empty
+// string if it is not in the library.
+func (l *Library) Path(id string) string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f := l.files[l.ids[id]]
+	if f == nil {
+		return ""
+	}
+	f.Used = time.Now()
+	l.dirty = true
+	return filepath.Join(l.dir, l.ids[id])
+}
+
+// Add adds the content of the Telegram file, which is in the part file, with
+// its SHA-256. The part is removed if the content is already in the library.
+// It returns the path of the content.
+func (l *Library) Add(id, ext, part string, sum []byte) (string, error) {
+	name := hex.EncodeToString(sum) + ext
+	local := filepath.Join(l.dir, name)
+	info, err := os.Stat(part)
+	if err != nil {
+		return "", err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f := l.files[name]
+	if f != nil && exists(local) {
+		os.Remove(part)
+	} else if err = os.Rename(part, local); err != nil {
+		return "", err
+	} else {
+		f = &libraryFile{Size: info.Size(), Added: time.Now()}
+		l.files[name] = f
+	}
+	f.Used = time.Now()
+	l.ids[id] = name
+	return local, l.save()
+}
+
+// Evict removes the files added longer than maxAge ago, and then the least
+// recently used ones until the rest take no more than maxSize bytes. Zero
+// means no limit. Files used less than linkTTL ago are not removed for their
+// age, since links to them are still valid. Files which are being read stay
+// readable until closed, and files which cannot be removed are tried again
+// next time.
+func (l *Library) Evict(maxSize int64, maxAge, linkTTL time.Duration) (removed int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var names []string
+	var total int64
+	for name, f := range l.files {
+		if !exists(filepath.Join(l.dir, name)) ||
+			maxAge != 0 && time.Since(f.Added) > maxAge &&
+				time.Since(f.Used) > linkTTL {
+			if l.remove(name) {
+				removed++
+				continue
+			}
+		}
+		names = append(names, name)
+		total += f.Size
+	}
+	if maxSize != 0 && total > maxSize {
+		sort.Slice(names, func(i, j int) bool {
+			return l.files[names[i]].Used.Before(l.files[names[j]].Used)
+		})
+		for _, name := range names {
+			if total <= maxSize {
+				break
+			}
+			size := l.files[name].Size
+			if l.remove(name) {
+				total -= size
+				removed++
+			}
+		}
+	}
+	if removed != 0 || l.dirty {
+		err = l.save()
+	}
+	return
+}
+
+// remove removes the file and the IDs it is the content of. It returns false
+// if the file cannot be removed.
+func (l *Library) remove(name string) bool {
+	err := os.Remove(filepath.Join(l.dir, name))
+	if err != nil && !os.IsNotExist(err) {
+		return false
+	}
+	delete(l.files, name)
+	for id, n := range l.ids {
+		if n == name {
+			delete(l.ids, id)
+		}
+	}
+	return true
+}
+
+// Stats returns how much disk the library uses.
+func (l *Library) Stats() LibraryStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := LibraryStats{Files: len(l.files), IDs: len(l.ids)}
+	for _, f := range l.files {
+		s.Bytes += f.Size
+		if s.Oldest.IsZero() || f.Added.Before(s.Oldest) {
+			s.Oldest = f.Added
+		}
+	}
+	for _, name := range l.ids {
+		if f := l.files[name]; f != nil {
+			s.Saved += f.Size
+		}
+	}
+	s.Saved -= s.Bytes
+	return s
+}
+
+// Maintain evicts files periodically until stopped.
+func (l *Library) Maintain(maxSize int64, maxAge, linkTTL time.Duration, stop chan struct{}, logger *log.Logger) {
+	for {
+		if removed, err := l.Evict(maxSize, maxAge, linkTTL); err != nil {
+			logger.Printf("Failed to evict media files: %v\n", err)
+		} else if removed != 0 {
+			logger.Printf("Evicted %d media files\n", removed)
+		}
+		select {
+		case <-time.After(maintenanceInterval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// save writes the index of the library.
+func (l *Library) save() error {
+	data, err := json.Marshal(struct {
+		IDs   map[string]string
+		Files map[string]*libraryFile
+	}{l.ids, l.files})
+	if err != nil {
+		return err
+	}
+	index := filepath.Join(l.dir, libraryIndex)
+	if err = ioutil.WriteFile(index+".part", data, 0600); err != nil {
+		return err
+	}
+	l.dirty = false
+	return os.Rename(index+".part", index)
+}
+
+// exists returns true if the file exists.
+func exists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
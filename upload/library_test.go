@@ -0,0 +1,122 @@
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLibrary(t *testing.T) {
+	assert := assert.New(t)
+	dir, remove := tempDir(t)
+	defer remove()
+	l, err := loadLibrary(dir)
+	assert.Nil(err)
+	add := func(id, content string) string {
+		part := filepath.Join(dir, id+".part")
+		assert.Nil(ioutil.WriteFile(part, []byte(content), 0644))
+		sum := sha256.Sum256([]byte(content))
+		local, err := l.Add(id, ".jpg", part, sum[:])
+		assert.Nil(err)
+		assert.False(exists(part))
+		return local
+	}
+
+	cat := add("a", "meow")
+	assert.Equal(cat, add("b", "meow"), "the same content is stored once")
+	assert.Equal(filepath.Join(dir,
+		"404cdd7bc109c432f8cc2443b45bcfe95980f5107215c645236e577929ac3e52.jpg"), cat)
+	assert.Equal(cat, l.Path("b"))
+	assert.Empty(l.Path("c"))
+	stats := func() LibraryStats {
+		s := l.Stats()
+		assert.WithinDuration(time.Now(), s.Oldest, time.Minute)
+		s.Oldest = time.Time{}
+		return s
+	}
+	assert.Equal(LibraryStats{Files: 1, Bytes: 4, IDs: 2, Saved: 4}, stats())
+
+	// the index is kept on disk
+	l, err = loadLibrary(dir)
+	assert.Nil(err)
+	assert.Equal(cat, l.Path("a"))
+
+	dog := add("c", "woof!")
+	cow := add("d", "moo")
+	l.Path("a") // the cat is used more recently than the dog
+	removed, err := l.Evict(8, 0, 0)
+	assert.Nil(err)
+	assert.Equal(1, removed)
+	assert.False(exists(dog))
+	assert.Empty(l.Path("c"))
+	assert.Equal(cat, l.Path("b"))
+
+	l.files[filepath.Base(cow)].Added = time.Now().Add(-48 * time.Hour)
+	// links to the cow made an hour ago are still valid
+	removed, err = l.Evict(0, 24*time.Hour, 2*time.Hour)
+	assert.Nil(err)
+	assert.Equal(0, removed)
+	assert.True(exists(cow))
+	removed, err = l.Evict(0, 24*time.Hour, 0)
+	assert.Nil(err)
+	assert.Equal(1, removed)
+	assert.False(exists(cow))
+	assert.Equal(LibraryStats{Files: 1, Bytes: 4, IDs: 2, Saved: 4}, stats())
+}
+
+func TestLibrary_Legacy(t *testing.T) {
+	assert := assert.New(t)
+	dir, remove := tempDir(t)
+	defer remove()
+	legacy := filepath.Join(dir, "AgADBAADr6cxG.jpg")
+	assert.Nil(ioutil.WriteFile(legacy, []byte("meow"), 0644))
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "AgADBAADr6cxH.part"), []byte("me"), 0644))
+	old := time.Now().Add(-48 * time.Hour)
+	assert.Nil(os.Chtimes(legacy, old, old))
+
+	// files saved by older versions are indexed with their names
+	l, err := loadLibrary(dir)
+	assert.Nil(err)
+	assert.Equal(legacy, l.Path("AgADBAADr6cxG"))
+	assert.Empty(l.Path("AgADBAADr6cxH"))
+	assert.Equal(1, l.Stats().Files)
+	l, err = loadLibrary(dir)
+	assert.Nil(err)
+	assert.Equal(legacy, l.Path("AgADBAADr6cxG"))
+
+	l.files[filepath.Base(legacy)].Used = old
+	removed, err := l.Evict(0, 24*time.Hour, 0)
+	assert.Nil(err)
+	assert.Equal(1, removed)
+	assert.False(exists(legacy))
+}
+
+func TestLibrary_Download(t *testing.T) {
+	assert := assert.New(t)
+	s := hosting(nil)
+	defer s.Close()
+	dir, remove := tempDir(t)
+	defer remove()
+	l, err := loadLibrary(dir)
+	assert.Nil(err)
+
+	var locals []string
+	for _, id := range []string{"sticker1", "sticker2"} {
+		f := &File{ID: id, Name: "cat.jpg", Local: filepath.Join(dir, id+".jpg"),
+			remote: s.URL + "/file/cat.jpg", library: l}
+		local, err := f.Download(context.Background())
+		assert.Nil(err)
+		locals = append(locals, local)
+	}
+	assert.Equal(locals[0], locals[1])
+	b, _ := ioutil.ReadFile(locals[0])
+	assert.Equal(content, string(b))
+	files, _ := filepath.Glob(filepath.Join(dir, "*.jpg*"))
+	assert.Len(files, 1)
+}
@@ -2,144 +2,52 @@
 package upload
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"io"
-	"io/ioutil"
-	"mime/multipart"
-	"net/http"
-	"os"
-	"path"
-	"strings"
+	"errors"
 
 	"github.com/26000/irchuu/config"
-	"github.com/26000/irchuu/paths"
-
-	tgbotapi "gopkg.in/telegram-bot-api.v4"
 )
 
-// Pomf uploads a Telegram media file to a pomf-like hosting. It doesn't check
-// if the file was already uploaded, that is handeled by pomfs.
-func Pomf(bot *tgbotapi.BotAPI, id string, c *config.Telegram) (url string, err error) {
-	file, err := bot.GetFileDirectURL(id)
-	if err != nil {
-		return
-	}
-	fileStrings := strings.Split(file, "/")
-	fileName := strings.Split(fileStrings[len(fileStrings)-1], ".")
-
-	var ext string
-	if len(fileName) > 1 {
-		ext = "." + fileName[len(fileName)-1]
-	}
-	localUrl := path.Join(c.DataDir, id+ext)
-	// if it is already downloaded, just upload the local copy
-	if paths.Exists(localUrl) {
-		return uploadLocalFilePomf(localUrl, c)
-	}
-	return uploadRemoteFilePomf(file, localUrl, id, fileStrings[len(fileStrings)-1], c)
+func init() {
+	Register("pomf", newPomf)
 }
 
-// uploadLocalFilePomf actually uploads the file to a pomf clone using HTTP POST with
-// multipart/form-data mime. It also reads the whole file to memory because of
-// the current implementation of Go's multipart.
-func uploadLocalFilePomf(file string, c *config.Telegram) (url string, err error) {
-	f, err := os.Open(file)
-	if err != nil {
-		return
-	}
-	defer f.Close()
-
-	var b bytes.Buffer
-	w := multipart.NewWriter(&b)
-	ff, err := w.CreateFormFile("files[]", f.Name())
-	if err != nil {
-		return
-	}
-
-	// i know, copying it to RAM was never a good idea...
-	_, err = io.Copy(ff, f)
-	if err != nil {
-		return
-	}
-
-	w.Close()
-
-	var pr pomfResult
-	r, err := http.Post(makePomfUrl(c.Pomf), w.FormDataContentType(), &b)
-	if err != nil {
-		return
-	}
-	defer r.Body.Close()
-
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return
-	}
+// pomf uploads files to a pomf-like hosting. It doesn't check if the file
+// was already uploaded, that is handeled by pomfs.
+type pomf struct {
+	url string
+}
 
-	err = json.Unmarshal(body, &pr)
-	if err != nil {
-		return
+// newPomf creates the pomf backend.
+func newPomf(c *config.Telegram) (Backend, error) {
+	if c.Pomf == "" {
+		return nil, errors.New("'pomf' is not set")
 	}
-	url = pr.Url()
-	return
+	return &pomf{url: c.Pomf}, nil
 }
 
-// uploadRemoteFilePomf downloads a file from Telegram and uploads it to a
-// pomf clone using HTTP POST with multipart/form-data mime. It also reads the
-// whole file to memory because of the current implementation of Go's multipart.
-func uploadRemoteFilePomf(file string, localUrl string, id string, name string, c *config.Telegram) (url string, err error) {
-	downloadable, err := http.Get(file)
-	defer downloadable.Body.Close()
-	var b bytes.Buffer
-	w := multipart.NewWriter(&b)
-	ff, err := w.CreateFormFile("files[]", name) // create the multipart file
+// Store streams the file to the pomf clone using HTTP POST with
+// multipart/form-data mime.
+func (p *pomf) Store(ctx context.Context, f *File) (Result, error) {
+	file, _, err := f.Open(ctx)
 	if err != nil {
-		return
-	}
-
-	if c.DownloadMedia {
-		// if we need to both upload and download it, we use io.MultiWriter
-		res, err := os.Create(localUrl)
-		if err != nil {
-			return "", err
-		}
-		writer := io.MultiWriter(res, ff)
-
-		// i know, copying it to RAM was never a good idea...
-		_, err = io.Copy(writer, downloadable.Body)
-		res.Close()
-		if err != nil {
-			return "", err
-		}
-	} else {
-		// just io.Copy otherwise
-		// i know, copying it to RAM was never a good idea...
-		_, err = io.Copy(ff, downloadable.Body)
-		if err != nil {
-			return
-		}
+		return Result{}, err
 	}
-	w.Close()
-
-	var pr pomfResult
-	r, err := http.Post(makePomfUrl(c.Pomf), w.FormDataContentType(), &b)
+	defer file.Close()
+	body, size, err := postFile(ctx, makePomfUrl(p.url), "files[]", f.Name, file, nil)
 	if err != nil {
-		return
+		return Result{}, err
 	}
-	defer r.Body.Close()
 
-	body, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		return
+	var pr pomfResult
+	if err = json.Unmarshal(body, &pr); err != nil {
+		return Result{}, err
 	}
-
-	err = json.Unmarshal(body, &pr)
-	if err != nil {
-		return
+	if pr.Url() == "" {
+		return Result{}, errors.New("the pomf returned no files")
 	}
-	url = pr.Url()
-	return
+	return Result{URL: pr.Url(), Size: size}, nil
 }
 
 // pomfResult is the data pomf returns in JSON.
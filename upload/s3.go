@@ -0,0 +1,420 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/26000/irchuu/config"
+)
+
+// maxPresignExpiry is the longest time presigned URLs may be valid for.
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// lifecycleRetry is how long to wait before trying to set the lifecycle rule
+// of the bucket again after it failed.
+const lifecycleRetry = time.Hour
+
+// unsignedPayload is signed instead of the hash of the body, so the body
+// can be streamed.
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+func init() {
+	Register("s3", newS3)
+}
+
+// s3 uploads files to a bucket of an S3-compatible storage. Requests are
+// signed with AWS Signature Version 4.
+type s3 struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	prefix    string
+	publicURL string        // blank to link presigned URLs
+	expiry    time.Duration // 0 if objects do not expire
+
+	now    func() time.Time
+	logger *log.Logger
+
+	mu          sync.Mutex
+	expiring    bool      // the lifecycle rule deletes expired objects
+	lifecycleAt time.Time // of the last attempt to set the rule
+}
+
+// lifecycleConfiguration is the lifecycle configuration of a bucket. Rules
+// are kept as they are, except for the one of IRChuu.
+type lifecycleConfiguration struct {
+	Rules []struct {
+		ID     string `xml:"ID"`
+		Prefix string `xml:"Filter>Prefix"`
+		Days   int    `xml:"Expiration>Days"`
+		Status string `xml:"Status"`
+		Raw    string `xml:",innerxml"`
+	} `xml:"Rule"`
+}
+
+// newS3 creates the S3 backend.
+func newS3(c *config.Telegram) (Backend, error) {
+	if c.S3Endpoint == "" || c.S3Bucket == "" || c.S3AccessKey == "" || c.S3SecretKey == "" {
+		return nil, errors.New("'s3endpoint', 's3bucket', 's3accesskey' and 's3secretkey' must be set")
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(c.S3Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	region := c.S3Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &s3{
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    c.S3Bucket,
+		accessKey: c.S3AccessKey,
+		secretKey: c.S3SecretKey,
+		prefix:    c.S3Prefix,
+		publicURL: strings.TrimSuffix(c.S3PublicURL, "/"),
+		expiry:    time.Duration(c.S3Expiry) * 24 * time.Hour,
+		now:       time.Now,
+		logger:    log.New(os.Stdout, "S3 ", log.LstdFlags),
+	}, nil
+}
+
+// Store uploads the file as an object named after its Telegram ID.
+func (s *s3) Store(ctx context.Context, f *File) (Result, error) {
+	file, size, err := f.Open(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	defer file.Close()
+	if size < 0 {
+		// S3 needs the size in advance
+		spool, err := ioutil.TempFile("", "irchuu")
+		if err != nil {
+			return Result{}, err
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+		if size, err = io.Copy(spool, file); err != nil {
+			return Result{}, err
+		}
+		if _, err = spool.Seek(0, io.SeekStart); err != nil {
+			return Result{}, err
+		}
+		file = spool
+	}
+
+	name := f.ID + path.Ext(f.Name)
+	if f.ID == "" {
+		name = f.Name
+	}
+	key := s.prefix + name
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(key).String(), file)
+	if err != nil {
+		return Result{}, err
+	}
+	req.ContentLength = size
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		req.Header.Set("Content-Type", t)
+	}
+	now := s.now()
+	result := Result{Size: size}
+	if s.expire(ctx) {
+		result.Expires = now.Add(s.expiry)
+	}
+	s.sign(req, unsignedPayload, now)
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return Result{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return Result{}, fmt.Errorf("the storage responded with %v: %s", resp.Status, body)
+	}
+
+	if s.publicURL != "" {
+		result.URL = s.publicURL + "/" + escapePath(key)
+		return result, nil
+	}
+	expiry := s.expiry
+	if expiry == 0 || expiry > maxPresignExpiry {
+		expiry = maxPresignExpiry
+	}
+	if result.Expires.IsZero() || now.Add(expiry).Before(result.Expires) {
+		// the link expires before the object does
+		result.Expires = now.Add(expiry)
+	}
+	result.URL = s.presign(http.MethodGet, s.objectURL(key), expiry, now).String()
+	return result, nil
+}
+
+// expire makes sure the bucket has the lifecycle rule which deletes expired
+// objects under the prefix and returns true if it does. Without the rule the
+// objects are kept forever.
+func (s *s3) expire(ctx context.Context) bool {
+	if s.expiry == 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.expiring || s.now().Sub(s.lifecycleAt) < lifecycleRetry {
+		return s.expiring
+	}
+	s.lifecycleAt = s.now()
+	if err := s.setLifecycle(ctx); err != nil {
+		s.logger.Printf("Failed to set the lifecycle rule, objects will not "+
+			"expire: %v\n", err)
+		return false
+	}
+	s.expiring = true
+	return true
+}
+
+// setLifecycle adds the rule which deletes objects under the prefix after the
+// expiry to the lifecycle configuration of the bucket. Other rules are kept.
+func (s *s3) setLifecycle(ctx context.Context) error {
+	id := "irchuu:" + s.prefix
+	days := int(s.expiry / (24 * time.Hour))
+
+	body, err := s.bucketRequest(ctx, http.MethodGet, "lifecycle", nil)
+	var current lifecycleConfiguration
+	if e, ok := err.(*s3Error); ok && e.status == http.StatusNotFound {
+		// the bucket has no rules
+	} else if err != nil {
+		return err
+	} else if err = xml.Unmarshal(body, &current); err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	b.WriteString(`<LifecycleConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/">`)
+	for _, rule := range current.Rules {
+		if rule.ID != id {
+			b.WriteString("<Rule>" + rule.Raw + "</Rule>")
+		} else if rule.Prefix == s.prefix && rule.Days == days && rule.Status == "Enabled" {
+			return nil
+		}
+	}
+	b.WriteString("<Rule><ID>")
+	xml.EscapeText(&b, []byte(id))
+	b.WriteString("</ID><Filter><Prefix>")
+	xml.EscapeText(&b, []byte(s.prefix))
+	fmt.Fprintf(&b, "</Prefix></Filter><Status>Enabled</Status>"+
+		"<Expiration><Days>%d</Days></Expiration></Rule>", days)
+	b.WriteString("</LifecycleConfiguration>")
+	_, err = s.bucketRequest(ctx, http.MethodPut, "lifecycle", []byte(b.String()))
+	return err
+}
+
+// s3Error is an error response of the storage.
+type s3Error struct {
+	status int
+	body   []byte
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("the storage responded with %v %v: %s", e.status,
+		http.StatusText(e.status), e.body)
+}
+
+// bucketRequest sends a signed request for the subresource of the bucket,
+// e. g. "lifecycle", and returns the body of the response.
+func (s *s3) bucketRequest(ctx context.Context, method, subresource string, body []byte) ([]byte, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	u.RawPath = ""
+	u.RawQuery = subresource
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		sum := md5.Sum(body)
+		req.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(sum[:]))
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	hash := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(hash[:]), s.now())
+
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if len(data) > 512 {
+			data = data[:512]
+		}
+		return nil, &s3Error{status: resp.StatusCode, body: data}
+	}
+	return data, nil
+}
+
+// objectURL returns the path-style URL of the object, which works with all
+// S3-compatible storages.
+func (s *s3) objectURL(key string) *url.URL {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	u.RawPath = ""
+	return &u
+}
+
+// sign signs the request with the Authorization header. The payload is the
+// hex SHA-256 of the body or unsignedPayload.
+func (s *s3) sign(req *http.Request, payload string, t time.Time) {
+	req.Header.Set("X-Amz-Date", t.UTC().Format("20060102T150405Z"))
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	headers := map[string]string{"host": requestHost(req)}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	signed, signature := s.signature(req.Method, req.URL, headers, payload, t)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		s.accessKey, s.scope(t), signed, signature))
+}
+
+// presign returns the URL with the signature in the query, which is valid
+// for the duration.
+func (s *s3) presign(method string, u *url.URL, expires time.Duration, t time.Time) *url.URL {
+	signedURL := *u
+	query := signedURL.Query()
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", s.accessKey+"/"+s.scope(t))
+	query.Set("X-Amz-Date", t.UTC().Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	signedURL.RawQuery = canonicalQuery(query)
+	_, signature := s.signature(method, &signedURL, map[string]string{"host": u.Host},
+		unsignedPayload, t)
+	signedURL.RawQuery += "&X-Amz-Signature=" + signature
+	return &signedURL
+}
+
+// scope returns the credential scope of the date.
+func (s *s3) scope(t time.Time) string {
+	return t.UTC().Format("20060102") + "/" + s.region + "/s3/aws4_request"
+}
+
+// signature computes the signature of a request and returns it with the
+// list of signed headers.
+func (s *s3) signature(method string, u *url.URL, headers map[string]string,
+	payload string, t time.Time) (string, string) {
+	var names []string
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders string
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		method,
+		escapePath(u.Path),
+		canonicalQuery(u.Query()),
+		canonicalHeaders,
+		signed,
+		payload,
+	}, "\n")
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		t.UTC().Format("20060102T150405Z"),
+		s.scope(t),
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), t.UTC().Format("20060102"))
+	for _, part := range []string{s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return signed, hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of the data.
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// requestHost returns the host the request is sent to.
+func requestHost(req *http.Request) string {
+	if req.Host != "" {
+		return req.Host
+	}
+	return req.URL.Host
+}
+
+// canonicalQuery encodes the query with the keys sorted, as SigV4 requires.
+func canonicalQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, escape(k)+"="+escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// escapePath encodes every segment of the path.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		segments[i] = escape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// escape encodes everything but unreserved characters, as SigV4 requires.
+func escape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,43 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/26000/irchuu/config"
+	mediaserver "github.com/26000/irchuu/server"
+)
+
+func init() {
+	Register("server", newServer)
+}
+
+// server keeps files in the data directory, from which the media server of
+// IRChuu serves them.
+type server struct {
+	c *config.Telegram
+}
+
+// newServer creates the server backend.
+func newServer(c *config.Telegram) (Backend, error) {
+	if c.BaseURL == "" {
+		return nil, errors.New("'baseurl' is not set")
+	}
+	return &server{c: c}, nil
+}
+
+// Store downloads the file unless it is downloaded already.
+func (s *server) Store(ctx context.Context, f *File) (Result, error) {
+	local, err := f.Download(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	info, err := os.Stat(local)
+	if err != nil {
+		return Result{}, err
+	}
+	url, expires := mediaserver.URL(s.c, filepath.Base(local))
+	return Result{URL: url, Expires: expires, Size: info.Size()}, nil
+}
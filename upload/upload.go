@@ -0,0 +1,317 @@
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/26000/irchuu/config"
+
+	tgbotapi "gopkg.in/telegram-bot-api.v4"
+)
+
+// maxResponseSize is the maximum size of a response of a file hosting.
+const maxResponseSize = 1 << 20
+
+// localName matches the characters which are replaced in the names of local
+// copies of files from other networks.
+var localName = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// ErrTooLarge is returned when a file exceeds the upload limit.
+var ErrTooLarge = errors.New("the file is too large")
+
+// client is shared by all uploads, so connections are reused.
+var client = &http.Client{}
+
+// limits returns the size limit and the timeout of uploads set in the config.
+func limits(c *config.Telegram) (int64, time.Duration) {
+	return int64(c.UploadLimit) << 20, time.Duration(c.UploadTimeout) * time.Second
+}
+
+// File is a media file to be stored.
+type File struct {
+	ID    string // Telegram file ID
+	Name  string // name of the file
+	Local string // path of the local copy, which may not exist yet
+	Limit int64  // maximum size, 0 for no limit
+
+	remote  string      // URL of the file on Telegram's or other servers
+	header  http.Header // sent with requests for the remote file
+	keep    bool        // save the local copy while the remote file is read
+	library *Library    // keeps the local copy if set
+}
+
+// Media returns the Telegram media file with the ID. Its local copy is kept
+// if media is to be downloaded.
+func Media(bot *tgbotapi.BotAPI, id string, c *config.Telegram) (*File, error) {
+	remote, err := bot.GetFileDirectURL(id)
+	if err != nil {
+		return nil, err
+	}
+	name := path.Base(remote)
+	var ext string
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		ext = name[i:]
+	}
+	library, err := OpenLibrary(c.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	// the file is downloaded next to the library if it is not there yet
+	local := library.Path(id)
+	if local == "" {
+		local = path.Join(c.DataDir, id+ext)
+	}
+	limit, _ := limits(c)
+	return &File{
+		ID:      id,
+		Name:    name,
+		Local:   local,
+		Limit:   limit,
+		remote:  remote,
+		keep:    c.DownloadMedia,
+		library: library,
+	}, nil
+}
+
+// Remote returns the media file from another network, which is requested
+// with the header, e. g. for authorization. It is kept in the library under
+// the ID like Telegram files are.
+func Remote(id, name, remote string, header http.Header, c *config.Telegram) (*File, error) {
+	library, err := OpenLibrary(c.DataDir)
+	if err != nil {
+		return nil, err
+	}
+	local := library.Path(id)
+	if local == "" {
+		local = path.Join(c.DataDir, localName.ReplaceAllString(id, "_")+path.Ext(name))
+	}
+	limit, _ := limits(c)
+	return &File{
+		ID:      id,
+		Name:    name,
+		Local:   local,
+		Limit:   limit,
+		remote:  remote,
+		header:  header,
+		keep:    c.DownloadMedia,
+		library: library,
+	}, nil
+}
+
+// Open opens the local copy of the file if it exists, or else the remote
+// file. It also returns the size of the file or -1 if it is unknown.
+func (f *File) Open(ctx context.Context) (io.ReadCloser, int64, error) {
+	if local, err := os.Open(f.Local); err == nil {
+		info, err := local.Stat()
+		if err != nil {
+			local.Close()
+			return nil, 0, err
+		}
+		if f.Limit != 0 && info.Size() > f.Limit {
+			local.Close()
+			return nil, 0, ErrTooLarge
+		}
+		return local, info.Size(), nil
+	}
+	if f.remote == "" {
+		return nil, 0, fmt.Errorf("%v does not exist", f.Local)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, f.remote, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	for name, values := range f.header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("cannot download the file: %v", resp.Status)
+	}
+	if f.Limit != 0 && resp.ContentLength > f.Limit {
+		resp.Body.Close()
+		return nil, 0, ErrTooLarge
+	}
+	body := io.ReadCloser(resp.Body)
+	if f.Limit != 0 {
+		body = struct {
+			io.Reader
+			io.Closer
+		}{&limitedReader{r: resp.Body, n: f.Limit}, resp.Body}
+	}
+	if !f.keep {
+		return body, resp.ContentLength, nil
+	}
+	part, err := os.Create(f.Local + ".part")
+	if err != nil {
+		body.Close()
+		return nil, 0, err
+	}
+	hash := sha256.New()
+	return &teeFile{Reader: io.TeeReader(body, io.MultiWriter(part, hash)),
+		body: body, file: part, hash: hash, finish: f.saved}, resp.ContentLength, nil
+}
+
+// saved puts the complete local copy in its place. The library keeps a
+// single copy of files with the same content.
+func (f *File) saved(part string, sum []byte) error {
+	if f.library == nil {
+		return os.Rename(part, f.Local)
+	}
+	local, err := f.library.Add(f.ID, path.Ext(f.Name), part, sum)
+	if err == nil {
+		f.Local = local
+	}
+	return err
+}
+
+// Download saves the local copy of the file unless it exists and returns its
+// path.
+func (f *File) Download(ctx context.Context) (string, error) {
+	if _, err := os.Stat(f.Local); err == nil {
+		return f.Local, nil
+	}
+	keep := f.keep
+	f.keep = true
+	body, _, err := f.Open(ctx)
+	f.keep = keep
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(ioutil.Discard, body)
+	body.Close()
+	if err != nil {
+		return "", err
+	}
+	return f.Local, nil
+}
+
+// teeFile saves a remote file while it is read. The copy is finished once
+// the file is read completely, or else it is removed.
+type teeFile struct {
+	io.Reader
+	body     io.Closer
+	file     *os.File
+	hash     hash.Hash
+	finish   func(part string, sum []byte) error
+	complete bool
+}
+
+// Read reads the remote file.
+func (t *teeFile) Read(p []byte) (int, error) {
+	n, err := t.Reader.Read(p)
+	if err == io.EOF {
+		t.complete = true
+	}
+	return n, err
+}
+
+// Close closes the remote file and the local copy.
+func (t *teeFile) Close() error {
+	t.body.Close()
+	err := t.file.Close()
+	if t.complete && err == nil {
+		return t.finish(t.file.Name(), t.hash.Sum(nil))
+	}
+	os.Remove(t.file.Name())
+	return err
+}
+
+// limitedReader fails with ErrTooLarge when more than n bytes are read.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read reads from the underlying reader.
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, ErrTooLarge
+	}
+	return n, err
+}
+
+// countingReader counts the bytes read.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+// Read reads from the underlying reader.
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// postFile streams the file to the URL as a multipart form with the fields
+// and returns the body of the response and the size of the file.
+func postFile(ctx context.Context, url, field, name string, file io.Reader,
+	fields map[string]string) ([]byte, int64, error) {
+	counter := &countingReader{r: file}
+	pr, pw := io.Pipe()
+	w := multipart.NewWriter(pw)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		ff, err := w.CreateFormFile(field, name)
+		if err == nil {
+			_, err = io.Copy(ff, counter)
+		}
+		for k, v := range fields {
+			if err == nil {
+				err = w.WriteField(k, v)
+			}
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, url, pr)
+	if err != nil {
+		pr.Close()
+		<-written
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	resp, err := client.Do(req.WithContext(ctx))
+	// the writer stops once the pipe is closed
+	pr.CloseWithError(errors.New("the upload is over"))
+	<-written
+	if err != nil {
+		if errors.Is(err, ErrTooLarge) {
+			return nil, 0, ErrTooLarge
+		}
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, 0, fmt.Errorf("the hosting responded with %v", resp.Status)
+	}
+	return body, counter.n, nil
+}
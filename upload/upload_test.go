@@ -0,0 +1,194 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/26000/irchuu/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// content is the file served by the hosting stand-in.
+var content = strings.Repeat("meow", 1<<18)
+
+// hosting is a pomf and komf stand-in which remembers the uploaded files.
+// It also serves content as Telegram does.
+func hosting(files chan<- string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodGet && req.URL.Path == "/file/cat.jpg" {
+			// without Content-Length, so the limit is checked while reading
+			w.Header().Set("Transfer-Encoding", "chunked")
+			fmt.Fprint(w, content)
+			return
+		}
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		switch req.URL.Path {
+		case "/upload.php":
+			f, header, err := req.FormFile("files[]")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			b, _ := ioutil.ReadAll(f)
+			files <- string(b)
+			fmt.Fprintf(w, `{"success":true,"files":[{"url":"https://p.org/%v"}]}`,
+				header.Filename)
+		case "/upload":
+			f, header, err := req.FormFile("file")
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			b, _ := ioutil.ReadAll(f)
+			files <- string(b) + " for a " + req.FormValue("date")
+			fmt.Fprintf(w, `<a href="https://k.org/%v">https://k.org/%[1]v</a>`,
+				header.Filename)
+		case "/broken/upload.php":
+			http.Error(w, "out of space", http.StatusInternalServerError)
+		case "/slow/upload.php":
+			// the server notices the client is gone only after the body is read
+			ioutil.ReadAll(req.Body)
+			<-req.Context().Done()
+		}
+	}))
+}
+
+// tempDir creates a temporary directory and returns it with the function
+// removing it.
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "irchuu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestUpload(t *testing.T) {
+	assert := assert.New(t)
+	files := make(chan string, 1)
+	s := hosting(files)
+	defer s.Close()
+	dir, remove := tempDir(t)
+	defer remove()
+	ctx := context.Background()
+	remote := func(keep bool, limit int64) *File {
+		return &File{Name: "cat.jpg", Local: filepath.Join(dir, "cat.jpg"),
+			Limit: limit, remote: s.URL + "/file/cat.jpg", keep: keep}
+	}
+
+	result, err := (&pomf{url: s.URL}).Store(ctx, remote(false, 1<<20))
+	assert.Nil(err)
+	assert.Equal(Result{URL: "https://p.org/cat.jpg", Size: 1 << 20}, result)
+	assert.Equal(content, <-files)
+	assert.False(exists(filepath.Join(dir, "cat.jpg")))
+
+	// the local copy is kept and uploaded next time
+	result, err = (&komf{url: s.URL + "/", date: "week"}).Store(ctx, remote(true, 0))
+	assert.Nil(err)
+	assert.Equal("https://k.org/cat.jpg", result.URL)
+	assert.WithinDuration(time.Now().Add(7*24*time.Hour), result.Expires, time.Minute)
+	assert.Equal(content+" for a week", <-files)
+	assert.True(exists(filepath.Join(dir, "cat.jpg")))
+	assert.False(exists(filepath.Join(dir, "cat.jpg.part")))
+
+	_, err = (&pomf{url: s.URL}).Store(ctx, remote(false, 1<<20-1))
+	assert.Equal(ErrTooLarge, err)
+	os.Remove(filepath.Join(dir, "cat.jpg"))
+	_, err = (&pomf{url: s.URL}).Store(ctx, remote(true, 1<<20-1))
+	assert.True(errors.Is(err, ErrTooLarge), "%v", err)
+	assert.Empty(files)
+	assert.False(exists(filepath.Join(dir, "cat.jpg")), "an incomplete copy is removed")
+	assert.False(exists(filepath.Join(dir, "cat.jpg.part")))
+
+	_, err = (&pomf{url: s.URL + "/broken"}).Store(ctx, remote(false, 0))
+	assert.EqualError(err, "the hosting responded with 500 Internal Server Error")
+
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = (&pomf{url: s.URL + "/slow"}).Store(ctx, remote(false, 0))
+	assert.True(errors.Is(err, context.DeadlineExceeded), "%v", err)
+}
+
+func TestChain(t *testing.T) {
+	assert := assert.New(t)
+	files := make(chan string, 1)
+	s := hosting(files)
+	defer s.Close()
+	dir, remove := tempDir(t)
+	defer remove()
+
+	c := &config.Telegram{Storage: "pomf, server", Pomf: s.URL + "/broken",
+		BaseURL: "https://media.org", DataDir: dir}
+	b, err := New(c)
+	assert.Nil(err)
+	f := &File{Name: "cat.jpg", Local: filepath.Join(dir, "42.jpg"),
+		remote: s.URL + "/file/cat.jpg"}
+	result, err := b.Store(context.Background(), f)
+	assert.Nil(err)
+	assert.Equal(Result{URL: "https://media.org/42.jpg", Size: 1 << 20}, result)
+	assert.True(exists(filepath.Join(dir, "42.jpg")))
+
+	c.Storage = "server,pomf"
+	c.BaseURL = ""
+	_, err = New(c)
+	assert.EqualError(err, "storage server: 'baseurl' is not set")
+	c.Storage = "ftp"
+	_, err = New(c)
+	assert.EqualError(err, "unknown storage ftp")
+	c.Storage = "none"
+	b, err = New(c)
+	assert.Nil(b)
+	assert.Nil(err)
+
+	_, err = Chain{{"pomf", &pomf{url: s.URL + "/broken"}}, {"komf", &komf{url: s.URL + "/broken"}}}.
+		Store(context.Background(), f)
+	assert.EqualError(err, "pomf: the hosting responded with 500 Internal Server Error; "+
+		"komf: the komf returned no link")
+}
+
+func TestRemote(t *testing.T) {
+	assert := assert.New(t)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "meow")
+	}))
+	defer s.Close()
+	dir, remove := tempDir(t)
+	defer remove()
+	c := &config.Telegram{DataDir: dir, UploadTimeout: 10}
+
+	f, err := Remote("mxc://example.org/cat", "cat.jpg", s.URL, nil, c)
+	assert.Nil(err)
+	_, err = f.Download(context.Background())
+	assert.EqualError(err, "cannot download the file: 401 Unauthorized")
+
+	f, err = Remote("mxc://example.org/cat", "cat.jpg", s.URL,
+		http.Header{"Authorization": {"Bearer token"}}, c)
+	assert.Nil(err)
+	assert.Equal(filepath.Join(dir, "mxc___example_org_cat.jpg"), f.Local)
+	local, err := f.Download(context.Background())
+	assert.Nil(err)
+	assert.Equal(filepath.Join(dir,
+		"404cdd7bc109c432f8cc2443b45bcfe95980f5107215c645236e577929ac3e52.jpg"), local)
+
+	// the copy is found in the library by the ID
+	f, err = Remote("mxc://example.org/cat", "cat.jpg", s.URL, nil, c)
+	assert.Nil(err)
+	assert.Equal(local, f.Local)
+}
@@ -0,0 +1,390 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/26000/irchuu/config"
+)
+
+// Namespaces.
+const (
+	nsClient = "jabber:client"
+	nsStream = "http://etherx.jabber.org/streams"
+	nsTLS    = "urn:ietf:params:xml:ns:xmpp-tls"
+	nsSASL   = "urn:ietf:params:xml:ns:xmpp-sasl"
+)
+
+// timeout is the timeout of connecting and writing.
+const timeout = 30 * time.Second
+
+// MUC status codes.
+const (
+	statusSelf       = 110
+	statusNickChange = 303
+	statusKicked     = 307
+)
+
+// features are the stream features offered by the server.
+type features struct {
+	XMLName    xml.Name  `xml:"http://etherx.jabber.org/streams features"`
+	StartTLS   *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
+	Mechanisms []string  `xml:"urn:ietf:params:xml:ns:xmpp-sasl mechanisms>mechanism"`
+	Bind       *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+}
+
+// stanzaMessage is a message stanza.
+type stanzaMessage struct {
+	XMLName xml.Name `xml:"jabber:client message"`
+	From    string   `xml:"from,attr,omitempty"`
+	To      string   `xml:"to,attr,omitempty"`
+	ID      string   `xml:"id,attr,omitempty"`
+	Type    string   `xml:"type,attr,omitempty"`
+	Subject *string  `xml:"subject"`
+	Body    string   `xml:"body,omitempty"`
+
+	Delay *struct{} `xml:"urn:xmpp:delay delay"`
+	Reply *struct {
+		To string `xml:"to,attr"`
+		ID string `xml:"id,attr"`
+	} `xml:"urn:xmpp:reply:0 reply"`
+	OOB *struct {
+		URL string `xml:"url"`
+	} `xml:"jabber:x:oob x"`
+}
+
+// presence is a presence stanza.
+type presence struct {
+	XMLName xml.Name `xml:"jabber:client presence"`
+	From    string   `xml:"from,attr,omitempty"`
+	To      string   `xml:"to,attr,omitempty"`
+	Type    string   `xml:"type,attr,omitempty"`
+	Status  string   `xml:"status,omitempty"`
+
+	MUC  *mucJoin `xml:"http://jabber.org/protocol/muc x"`
+	User *mucUser `xml:"http://jabber.org/protocol/muc#user x"`
+}
+
+// mucJoin is the element of a presence which joins a room.
+type mucJoin struct {
+	History struct {
+		MaxStanzas int `xml:"maxstanzas,attr"`
+	} `xml:"history"`
+}
+
+// mucUser describes an occupant of a room.
+type mucUser struct {
+	Item struct {
+		Nick string `xml:"nick,attr"`
+		Role string `xml:"role,attr"`
+	} `xml:"item"`
+	Statuses []struct {
+		Code int `xml:"code,attr"`
+	} `xml:"status"`
+}
+
+// has returns whether there is a status code.
+func (u *mucUser) has(code int) bool {
+	for _, status := range u.Statuses {
+		if status.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// iq is an info/query stanza.
+type iq struct {
+	XMLName xml.Name `xml:"jabber:client iq"`
+	ID      string   `xml:"id,attr"`
+	Type    string   `xml:"type,attr"`
+	From    string   `xml:"from,attr,omitempty"`
+	To      string   `xml:"to,attr,omitempty"`
+
+	Bind *struct {
+		Resource string `xml:"resource,omitempty"`
+		JID      string `xml:"jid,omitempty"`
+	} `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+	Ping *struct{} `xml:"urn:xmpp:ping ping"`
+}
+
+// conn is a client-to-server XMPP stream.
+type conn struct {
+	net net.Conn
+	dec *xml.Decoder
+	jid string
+
+	mu   sync.Mutex    // guards writes
+	done chan struct{} // closed once the stream is no longer read
+}
+
+// dial connects to the server, authenticates and binds a resource.
+func dial(c *config.XMPP) (*conn, error) {
+	local, domain := splitBareJID(c.JID)
+	if local == "" || domain == "" {
+		return nil, fmt.Errorf("invalid JID: %v", c.JID)
+	}
+
+	addr := c.Server
+	if addr == "" {
+		addr = lookup(domain, c.DirectTLS)
+	}
+	tlsConf := &tls.Config{ServerName: domain}
+	var nc net.Conn
+	var err error
+	if c.DirectTLS {
+		nc, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp",
+			addr, tlsConf)
+	} else {
+		nc, err = net.DialTimeout("tcp", addr, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	x := &conn{net: nc, done: make(chan struct{})}
+
+	f, err := x.open(domain)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	_, secure := nc.(*tls.Conn)
+	if f.StartTLS != nil && !secure {
+		if err = x.startTLS(tlsConf); err != nil {
+			nc.Close()
+			return nil, err
+		}
+		secure = true
+		if f, err = x.open(domain); err != nil {
+			x.net.Close()
+			return nil, err
+		}
+	}
+
+	if !secure && !c.AllowPlain {
+		x.net.Close()
+		return nil, errors.New("the server does not support TLS")
+	}
+	if err = x.auth(f, local, c.Password); err != nil {
+		x.net.Close()
+		return nil, err
+	}
+	if f, err = x.open(domain); err != nil {
+		x.net.Close()
+		return nil, err
+	}
+	if err = x.bind(f); err != nil {
+		x.net.Close()
+		return nil, err
+	}
+	return x, nil
+}
+
+// lookup finds the address of the server using SRV records.
+func lookup(domain string, directTLS bool) string {
+	service, port := "xmpp-client", "5222"
+	if directTLS {
+		service, port = "xmpps-client", "5223"
+	}
+	_, addrs, err := net.LookupSRV(service, "tcp", domain)
+	if err != nil || len(addrs) == 0 {
+		return net.JoinHostPort(domain, port)
+	}
+	return net.JoinHostPort(strings.TrimSuffix(addrs[0].Target, "."),
+		fmt.Sprint(addrs[0].Port))
+}
+
+// open opens a new stream and returns the features of the server.
+func (x *conn) open(domain string) (*features, error) {
+	x.dec = xml.NewDecoder(x.net)
+	err := x.sendRaw(fmt.Sprintf("<?xml version='1.0'?><stream:stream to='%v' "+
+		"xmlns='%v' xmlns:stream='%v' version='1.0'>", escape(domain), nsClient,
+		nsStream))
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t, err := x.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if s, ok := t.(xml.StartElement); ok {
+			if s.Name.Space != nsStream || s.Name.Local != "stream" {
+				return nil, fmt.Errorf("expected a stream, got <%v>", s.Name.Local)
+			}
+			break
+		}
+	}
+
+	start, err := x.next()
+	if err != nil {
+		return nil, err
+	}
+	f := new(features)
+	if start.Name.Space != nsStream || start.Name.Local != "features" {
+		return nil, fmt.Errorf("expected stream features, got <%v>", start.Name.Local)
+	}
+	return f, x.dec.DecodeElement(f, &start)
+}
+
+// startTLS upgrades the connection to TLS.
+func (x *conn) startTLS(tlsConf *tls.Config) error {
+	if err := x.sendRaw("<starttls xmlns='" + nsTLS + "'/>"); err != nil {
+		return err
+	}
+	start, err := x.next()
+	if err != nil {
+		return err
+	}
+	if start.Name.Local != "proceed" {
+		return errors.New("the server refused to start TLS")
+	}
+	tc := tls.Client(x.net, tlsConf)
+	if err = tc.Handshake(); err != nil {
+		return err
+	}
+	x.net = tc
+	return nil
+}
+
+// auth authenticates with SASL PLAIN.
+func (x *conn) auth(f *features, user, password string) error {
+	supported := false
+	for _, m := range f.Mechanisms {
+		if m == "PLAIN" {
+			supported = true
+		}
+	}
+	if !supported {
+		return errors.New("the server does not support PLAIN authentication")
+	}
+
+	credentials := base64.StdEncoding.EncodeToString(
+		[]byte("\x00" + user + "\x00" + password))
+	err := x.sendRaw("<auth xmlns='" + nsSASL + "' mechanism='PLAIN'>" +
+		credentials + "</auth>")
+	if err != nil {
+		return err
+	}
+	start, err := x.next()
+	if err != nil {
+		return err
+	}
+	x.dec.Skip()
+	if start.Name.Local != "success" {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
+
+// bind binds a resource and remembers the full JID.
+func (x *conn) bind(f *features) error {
+	if f.Bind == nil {
+		return errors.New("the server does not support resource binding")
+	}
+	req := iq{ID: "bind", Type: "set"}
+	req.Bind = &struct {
+		Resource string `xml:"resource,omitempty"`
+		JID      string `xml:"jid,omitempty"`
+	}{Resource: "irchuu"}
+	if err := x.send(req); err != nil {
+		return err
+	}
+
+	start, err := x.next()
+	if err != nil {
+		return err
+	}
+	var resp iq
+	if start.Name.Local != "iq" {
+		return fmt.Errorf("expected a bind result, got <%v>", start.Name.Local)
+	}
+	if err = x.dec.DecodeElement(&resp, &start); err != nil {
+		return err
+	}
+	if resp.Type != "result" || resp.Bind == nil {
+		return errors.New("failed to bind a resource")
+	}
+	x.jid = resp.Bind.JID
+	return nil
+}
+
+// next returns the next top-level element of the stream.
+func (x *conn) next() (xml.StartElement, error) {
+	for {
+		t, err := x.dec.Token()
+		if err != nil {
+			return xml.StartElement{}, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			return t, nil
+		case xml.EndElement:
+			if t.Name.Space == nsStream && t.Name.Local == "stream" {
+				return xml.StartElement{}, io.EOF
+			}
+		}
+	}
+}
+
+// send marshals a stanza and sends it.
+func (x *conn) send(v interface{}) error {
+	b, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return x.sendRaw(string(b))
+}
+
+// sendRaw sends a raw string.
+func (x *conn) sendRaw(s string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.net.SetWriteDeadline(time.Now().Add(timeout))
+	_, err := io.WriteString(x.net, s)
+	return err
+}
+
+// close closes the stream.
+func (x *conn) close() error {
+	x.sendRaw("</stream:stream>")
+	return x.net.Close()
+}
+
+// escape escapes a string for XML.
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// splitBareJID splits a bare JID into its localpart and domain.
+func splitBareJID(jid string) (string, string) {
+	if i := strings.Index(jid, "/"); i != -1 {
+		jid = jid[:i]
+	}
+	i := strings.Index(jid, "@")
+	if i == -1 {
+		return "", jid
+	}
+	return jid[:i], jid[i+1:]
+}
+
+// splitJID splits a full JID into the bare JID and the resource (which is the
+// nick of an occupant in rooms).
+func splitJID(jid string) (string, string) {
+	i := strings.Index(jid, "/")
+	if i == -1 {
+		return strings.ToLower(jid), ""
+	}
+	return strings.ToLower(jid[:i]), jid[i+1:]
+}
@@ -0,0 +1,532 @@
+// Package xmpp contains everything related to the XMPP part of IRChuu.
+package xmpp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/26000/irchuu/config"
+	irchuubase "github.com/26000/irchuu/db"
+	"github.com/26000/irchuu/relay"
+)
+
+// transportName is the name of the XMPP transport in the router.
+const transportName = "xmpp"
+
+// Delays between attempts to connect.
+const (
+	minReconnectDelay = 5 * time.Second
+	maxReconnectDelay = 5 * time.Minute
+)
+
+// keepAlive is how often whitespace is sent to keep the connection alive.
+const keepAlive = 60 * time.Second
+
+// room is the state of a multi-user chat.
+type room struct {
+	bridge    *config.Bridge
+	nick      string          // own nick
+	live      bool            // the subject has been received after joining
+	occupants map[string]bool // by nick
+}
+
+// Transport is the XMPP transport.
+type Transport struct {
+	c        *config.XMPP
+	logger   *log.Logger
+	services chan relay.ServiceMessage
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// joins and parts are summarized and filtered like those from IRC
+	joinsParts *relay.Digest
+	speakers   *relay.Activity
+
+	mu          sync.Mutex
+	conn        *conn
+	rooms       map[string]*room // by bare JID
+	bridgeRooms map[string]string
+	err         error
+}
+
+// NewTransport creates the XMPP transport.
+func NewTransport(c *config.XMPP) *Transport {
+	return &Transport{
+		c:        c,
+		logger:   log.New(os.Stdout, "XMPP ", log.LstdFlags),
+		services: make(chan relay.ServiceMessage, 20),
+		stop:     make(chan struct{}),
+		speakers: relay.NewActivity(time.Duration(c.ActiveWindow) * time.Minute),
+
+		rooms:       make(map[string]*room),
+		bridgeRooms: make(map[string]string),
+	}
+}
+
+// Name returns the name of the transport.
+func (t *Transport) Name() string {
+	return transportName
+}
+
+// Send sends a message to the room of its bridge. It fails until the room is
+// joined.
+func (t *Transport) Send(message relay.Message) error {
+	return t.send(message.Bridge, formatXMPPMessage(message, t.c))
+}
+
+// SendService queues a service command.
+func (t *Transport) SendService(message relay.ServiceMessage) error {
+	t.services <- message
+	return nil
+}
+
+// Stop closes the stream.
+func (t *Transport) Stop() error {
+	t.stopOnce.Do(func() { close(t.stop) })
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil {
+		return t.conn.close()
+	}
+	return nil
+}
+
+// Health checks that the transport is connected and has joined all rooms.
+func (t *Transport) Health() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	if t.conn == nil {
+		return errors.New("not connected")
+	}
+	for jid, room := range t.rooms {
+		if room.nick == "" {
+			return fmt.Errorf("not in %v", jid)
+		}
+	}
+	return nil
+}
+
+// Start connects to the server, joins the rooms of all bridges and reconnects
+// until stopped.
+func (t *Transport) Start(r *relay.Router) error {
+	t.mu.Lock()
+	for _, b := range r.Bridges() {
+		if b.XMPPRoom == "" {
+			continue
+		}
+		jid := strings.ToLower(b.XMPPRoom)
+		t.rooms[jid] = &room{bridge: b}
+		t.bridgeRooms[b.Name] = jid
+	}
+	t.mu.Unlock()
+	t.joinsParts = relay.NewDigest(time.Duration(t.c.DigestWindow)*time.Second,
+		func(m relay.Message) { r.Relay(m) },
+		func(bridge, text string) {
+			r.Service(relay.ServiceMessage{
+				Command:   "announce",
+				Arguments: []string{text},
+				Bridge:    bridge,
+				Origin:    transportName,
+			})
+		})
+
+	backoff := relay.NewBackoff(minReconnectDelay, maxReconnectDelay)
+	listening := false
+	for {
+		x, err := t.connect()
+		if err != nil {
+			t.mu.Lock()
+			t.err = fmt.Errorf("failed to connect: %v", err)
+			t.mu.Unlock()
+			t.logger.Printf("Failed to connect: %v, retrying in %v\n", err,
+				backoff.Delay())
+			if !backoff.Wait(t.stop) {
+				return nil
+			}
+			continue
+		}
+		if !listening {
+			go t.listenService()
+			listening = true
+		}
+
+		connected := time.Now()
+		err = t.listen(r, x)
+		select {
+		case <-t.stop:
+			return nil
+		default:
+		}
+		t.mu.Lock()
+		t.err = err
+		t.mu.Unlock()
+		// a connection which lasted long enough resets the backoff
+		if time.Since(connected) > maxReconnectDelay {
+			backoff.Reset()
+		}
+		t.logger.Printf("Connection lost, reconnecting in %v: %v\n",
+			backoff.Delay(), err)
+		if !backoff.Wait(t.stop) {
+			return nil
+		}
+	}
+}
+
+// connect opens a stream, sends the initial presence and joins the rooms.
+func (t *Transport) connect() (*conn, error) {
+	x, err := dial(t.c)
+	if err != nil {
+		return nil, err
+	}
+	t.logger.Printf("Connected as %v\n", x.jid)
+	if err = x.send(presence{}); err != nil {
+		x.net.Close()
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for jid, room := range t.rooms {
+		room.nick = ""
+		room.live = false
+		room.occupants = make(map[string]bool)
+		if err = x.send(presence{To: jid + "/" + t.c.Nick, MUC: &mucJoin{}}); err != nil {
+			x.net.Close()
+			return nil, err
+		}
+	}
+	t.conn = x
+	t.err = nil
+	go t.keepAlive(x)
+	return x, nil
+}
+
+// keepAlive sends whitespace until the connection breaks or the transport is
+// stopped.
+func (t *Transport) keepAlive(x *conn) {
+	ticker := time.NewTicker(keepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-x.done:
+			return
+		case <-t.stop:
+			return
+		}
+		if err := x.sendRaw(" "); err != nil {
+			return
+		}
+	}
+}
+
+// listen processes stanzas until the stream is closed.
+func (t *Transport) listen(r *relay.Router, x *conn) error {
+	defer close(x.done)
+	defer x.net.Close()
+	for {
+		start, err := x.next()
+		if err != nil {
+			return err
+		}
+		switch start.Name.Local {
+		case "message":
+			var m stanzaMessage
+			if err := x.dec.DecodeElement(&m, &start); err != nil {
+				return err
+			}
+			if message, ok := t.formatMessage(m); ok {
+				t.speakers.Said(message.Bridge, message.Nick)
+				r.Relay(message)
+				go irchuubase.Log(message, t.logger)
+			}
+		case "presence":
+			var p presence
+			if err := x.dec.DecodeElement(&p, &start); err != nil {
+				return err
+			}
+			if message, ok := t.processPresence(p); ok {
+				t.relayPresence(r, message)
+			}
+		case "iq":
+			var q iq
+			if err := x.dec.DecodeElement(&q, &start); err != nil {
+				return err
+			}
+			t.processIQ(x, q)
+		case "error":
+			x.dec.Skip()
+			return errors.New("stream error")
+		default:
+			x.dec.Skip()
+		}
+	}
+}
+
+// processIQ answers pings and rejects other requests.
+func (t *Transport) processIQ(x *conn, q iq) {
+	if q.Type != "get" && q.Type != "set" {
+		return
+	}
+	if q.Ping != nil {
+		x.send(iq{ID: q.ID, Type: "result", To: q.From})
+		return
+	}
+	x.sendRaw(fmt.Sprintf("<iq type='error' id='%v' to='%v'><error type='cancel'>"+
+		"<service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/>"+
+		"</error></iq>", escape(q.ID), escape(q.From)))
+}
+
+// processPresence tracks the occupants of rooms and maps their joins, parts
+// and nick changes onto universal messages.
+func (t *Transport) processPresence(p presence) (relay.Message, bool) {
+	jid, nick := splitJID(p.From)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	room := t.rooms[jid]
+	if room == nil || p.User == nil || nick == "" {
+		return relay.Message{}, false
+	}
+
+	if p.User.has(statusSelf) {
+		if p.Type == "unavailable" {
+			room.nick = ""
+			t.logger.Printf("Left %v: %v\n", jid, p.Status)
+			return relay.Message{}, false
+		}
+		room.nick = nick
+		room.occupants[nick] = true
+		return relay.Message{}, false
+	}
+
+	var message relay.Message
+	if p.Type == "unavailable" {
+		delete(room.occupants, nick)
+		switch {
+		case p.User.has(statusNickChange) && p.User.Item.Nick != "":
+			room.occupants[p.User.Item.Nick] = true
+			message = formatMessage(room.bridge, nick, p.User.Item.Nick, "NICK")
+		case p.User.has(statusKicked):
+			message = formatMessage(room.bridge, nick, "kicked", "PART")
+		default:
+			message = formatMessage(room.bridge, nick, p.Status, "PART")
+		}
+	} else {
+		if room.occupants[nick] {
+			return relay.Message{}, false
+		}
+		room.occupants[nick] = true
+		message = formatMessage(room.bridge, nick, "", "JOIN")
+	}
+	return message, room.live
+}
+
+// relayPresence relays a join, part or nick change of an occupant who spoke
+// recently. Joins and parts are collected into digests.
+func (t *Transport) relayPresence(r *relay.Router, message relay.Message) {
+	go irchuubase.Log(message, t.logger)
+	active := t.speakers.Active(message.Bridge, message.Nick)
+	if message.Extra["special"] == "NICK" {
+		t.speakers.Rename(message.Nick, message.Text)
+		if active {
+			r.Relay(message)
+		}
+		return
+	}
+	if t.c.RelayJoinsParts && active {
+		t.joinsParts.Add(message)
+	}
+}
+
+// formatMessage maps a groupchat message onto the universal message struct
+// (relay.Message). It returns false if the message should not be relayed.
+func (t *Transport) formatMessage(m stanzaMessage) (relay.Message, bool) {
+	jid, nick := splitJID(m.From)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	room := t.rooms[jid]
+	if m.Type != "groupchat" || room == nil || nick == "" {
+		return relay.Message{}, false
+	}
+
+	// the subject is the last thing sent when joining
+	if m.Subject != nil && m.Body == "" {
+		live := room.live
+		room.live = true
+		return formatMessage(room.bridge, nick, *m.Subject, "TOPIC"), live
+	}
+	if m.Delay != nil || nick == room.nick || m.Body == "" {
+		return relay.Message{}, false
+	}
+
+	text := m.Body
+	message := formatMessage(room.bridge, nick, text, "")
+	if strings.HasPrefix(text, "/me ") {
+		message.Text = strings.TrimPrefix(text, "/me ")
+		message.Extra["special"] = "ACTION"
+	}
+	if m.Reply != nil {
+		if _, reply := splitJID(m.Reply.To); reply != "" {
+			message.Extra["reply"] = reply
+			message.Extra["replyID"] = m.Reply.ID
+		}
+		message.Text = stripReplyFallback(message.Text)
+	}
+	if m.OOB != nil && m.OOB.URL != "" {
+		message.Extra["media"] = "document"
+		message.Extra["url"] = m.OOB.URL
+		message.Extra["mediaName"] = path.Base(m.OOB.URL)
+		if message.Text == m.OOB.URL {
+			message.Text = ""
+		}
+	}
+	return message, true
+}
+
+// formatMessage creates a Message in the universal format of an XMPP message.
+func formatMessage(b *config.Bridge, nick string, text string, special string) relay.Message {
+	extra := make(map[string]string)
+	if special != "" {
+		extra["special"] = special
+	}
+	return relay.Message{
+		Date:   time.Now(),
+		Origin: transportName,
+		Bridge: b.Name,
+		Nick:   nick,
+		Text:   text,
+		Extra:  extra,
+	}
+}
+
+// stripReplyFallback removes the quote of the original message which clients
+// put before the text of a reply.
+func stripReplyFallback(text string) string {
+	lines := strings.Split(text, "\n")
+	i := 0
+	for i < len(lines) && strings.HasPrefix(lines[i], ">") {
+		i++
+	}
+	return strings.Join(lines[i:], "\n")
+}
+
+// listenService listens to service messages and executes them.
+func (t *Transport) listenService() {
+	for f := range t.services {
+		if len(f.Arguments) == 0 {
+			continue
+		}
+		text := relay.StripFormatting(f.Arguments[0])
+		switch f.Command {
+		case "announce":
+		case "action":
+			text = "/me " + text
+		default:
+			continue
+		}
+		if err := t.send(f.Bridge, text); err != nil {
+			t.logger.Printf("Sending message failed: %v\n", err)
+		}
+	}
+}
+
+// send sends a groupchat message to the room of a bridge. Bridges without a
+// room are ignored.
+func (t *Transport) send(bridge string, text string) error {
+	t.mu.Lock()
+	x := t.conn
+	jid, ok := t.bridgeRooms[bridge]
+	joined := ok && t.rooms[jid].nick != ""
+	t.mu.Unlock()
+	if x == nil {
+		return errors.New("not connected")
+	}
+	if !ok {
+		return nil
+	}
+	if !joined {
+		return fmt.Errorf("not in %v", jid)
+	}
+	return x.send(stanzaMessage{To: jid, Type: "groupchat", Body: text})
+}
+
+// formatXMPPMessage translates a universal message into the text of an XMPP
+// message, prefixed with the name of its sender.
+func formatXMPPMessage(message relay.Message, c *config.XMPP) string {
+	text := relay.StripFormatting(message.Text)
+	nick := message.Name()
+
+	switch message.Extra["special"] {
+	case "ACTION":
+		return fmt.Sprintf("* %v %v", nick, text)
+	case "JOIN":
+		return fmt.Sprintf("%v has joined.", nick)
+	case "PART":
+		if text == "" {
+			return fmt.Sprintf("%v has left.", nick)
+		}
+		return fmt.Sprintf("%v has left: %v.", nick, text)
+	case "QUIT":
+		if text == "" {
+			return fmt.Sprintf("%v has quit.", nick)
+		}
+		return fmt.Sprintf("%v has quit: %v.", nick, text)
+	case "KICK":
+		return fmt.Sprintf("%v has kicked %v.", nick, text)
+	case "NICK":
+		return fmt.Sprintf("%v is now known as %v.", nick, text)
+	case "TOPIC":
+		return fmt.Sprintf("%v has set a new topic: %v.", nick, text)
+	case "MODE":
+		return fmt.Sprintf("%v has set mode %v.", nick, text)
+	case "pin":
+		return fmt.Sprintf("%v pinned %v's message: %v", message.Extra["pin"],
+			nick, text)
+	case "newChatMember":
+		if strconv.Itoa(message.FromID) == message.Extra["memberID"] {
+			return fmt.Sprintf("%v joined the group via invite link.",
+				message.Extra["memberName"])
+		}
+		return fmt.Sprintf("%v was added by %v.", message.Extra["memberName"], nick)
+	case "leftChatMember":
+		if strconv.Itoa(message.FromID) == message.Extra["memberID"] {
+			return fmt.Sprintf("%v left the group.", message.Extra["memberName"])
+		}
+		return fmt.Sprintf("%v was removed by %v.", message.Extra["memberName"], nick)
+	case "newChatTitle":
+		return fmt.Sprintf("Chat renamed to \"%v\" by %v.", message.Extra["title"],
+			nick)
+	case "newChatPhoto":
+		return fmt.Sprintf("The chat photo has been changed by %v.", nick)
+	case "deleteChatPhoto":
+		return fmt.Sprintf("The chat photo has been deleted by %v.", nick)
+	}
+
+	if message.Extra["forward"] != "" {
+		text = fmt.Sprintf("[fwd from @%v] %v", message.Extra["forward"], text)
+	} else if message.Extra["forwardChatTitle"] != "" {
+		text = fmt.Sprintf("[fwd from channel %v] %v",
+			message.Extra["forwardChatTitle"], text)
+	} else if message.Extra["reply"] != "" {
+		text = fmt.Sprintf("%v, %v", message.Extra["reply"], text)
+	}
+	if message.Extra["edit"] != "" {
+		text = "[edited] " + text
+	}
+	if urls := message.MediaURLs(); len(urls) != 0 {
+		text = strings.TrimSpace(text + " " + strings.Join(urls, " "))
+	} else if media := message.Extra["media"]; media != "" {
+		text = strings.TrimSpace(text + " (" + media + ")")
+	}
+	return c.Prefix + nick + c.Postfix + " " + text
+}
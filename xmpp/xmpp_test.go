@@ -0,0 +1,249 @@
+package xmpp
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/26000/irchuu/config"
+	"github.com/26000/irchuu/relay"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const streamHeader = "<?xml version='1.0'?><stream:stream from='example.org' " +
+	"xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' " +
+	"version='1.0'>"
+
+// fakeServer is an XMPP server which serves a single client over plain TCP.
+type fakeServer struct {
+	t        *testing.T
+	listener net.Listener
+	auth     chan string
+	sent     chan stanzaMessage
+	// stanzas are sent after the client joins the room
+	stanzas []string
+}
+
+func newFakeServer(t *testing.T, stanzas []string) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{t: t, listener: l, auth: make(chan string, 1),
+		sent: make(chan stanzaMessage, 10), stanzas: stanzas}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) serve() {
+	c, err := s.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer c.Close()
+	dec := xml.NewDecoder(c)
+
+	// next returns the next element
+	next := func() (xml.StartElement, error) {
+		for {
+			t, err := dec.Token()
+			if err != nil {
+				return xml.StartElement{}, err
+			}
+			if start, ok := t.(xml.StartElement); ok {
+				return start, nil
+			}
+		}
+	}
+
+	next() // stream header
+	fmt.Fprint(c, streamHeader+"<stream:features><mechanisms "+
+		"xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism>"+
+		"</mechanisms></stream:features>")
+	start, _ := next()
+	var auth string
+	dec.DecodeElement(&auth, &start)
+	s.auth <- auth
+	fmt.Fprint(c, "<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>")
+
+	dec = xml.NewDecoder(c)
+	next() // stream header
+	fmt.Fprint(c, streamHeader+"<stream:features><bind "+
+		"xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>")
+	start, _ = next()
+	dec.Skip()
+	fmt.Fprint(c, "<iq type='result' id='bind'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'>"+
+		"<jid>irchuu@example.org/irchuu</jid></bind></iq>")
+
+	for {
+		start, err := next()
+		if err != nil {
+			return
+		}
+		switch start.Name.Local {
+		case "presence":
+			var p presence
+			dec.DecodeElement(&p, &start)
+			if p.MUC != nil {
+				for _, stanza := range s.stanzas {
+					fmt.Fprint(c, stanza)
+				}
+			}
+		case "message":
+			var m stanzaMessage
+			dec.DecodeElement(&m, &start)
+			s.sent <- m
+		default:
+			dec.Skip()
+		}
+	}
+}
+
+// recorder is a transport which records messages sent to it.
+type recorder struct {
+	messages chan relay.Message
+}
+
+func (t *recorder) Name() string                                   { return "irc" }
+func (t *recorder) Start(r *relay.Router) error                    { select {} }
+func (t *recorder) Stop() error                                    { return nil }
+func (t *recorder) Send(message relay.Message) error               { t.messages <- message; return nil }
+func (t *recorder) SendService(message relay.ServiceMessage) error { return nil }
+func (t *recorder) Health() error                                  { return nil }
+
+func TestTransport(t *testing.T) {
+	assert := assert.New(t)
+	const user = "<x xmlns='http://jabber.org/protocol/muc#user'><item role='participant'/></x>"
+	s := newFakeServer(t, []string{
+		"<presence from='irchuu@conference.example.org/alice'>" + user + "</presence>",
+		"<presence from='irchuu@conference.example.org/IRChuu'>" +
+			"<x xmlns='http://jabber.org/protocol/muc#user'><item role='participant'/>" +
+			"<status code='110'/></x></presence>",
+		"<message from='irchuu@conference.example.org/alice' type='groupchat'>" +
+			"<body>old</body><delay xmlns='urn:xmpp:delay' stamp='2016-11-03T12:41:15Z'/></message>",
+		"<message from='irchuu@conference.example.org/alice' type='groupchat'>" +
+			"<subject>IRChuu~</subject></message>",
+		"<message from='irchuu@conference.example.org/alice' type='groupchat'>" +
+			"<body>konnichiha!</body></message>",
+		"<message from='irchuu@conference.example.org/IRChuu' type='groupchat'>" +
+			"<body>echo</body></message>",
+		"<presence from='irchuu@conference.example.org/bob'>" + user + "</presence>",
+		"<presence from='irchuu@conference.example.org/alice' type='unavailable'>" +
+			"<x xmlns='http://jabber.org/protocol/muc#user'><item nick='alice2'/>" +
+			"<status code='303'/></x></presence>",
+		"<presence from='irchuu@conference.example.org/alice2'>" + user + "</presence>",
+		"<message from='irchuu@conference.example.org/alice2' type='groupchat'>" +
+			"<body>/me waves</body></message>",
+		"<message from='irchuu@conference.example.org/bob' type='groupchat'>" +
+			"<body>&gt; alice2: waves\nhi</body><reply xmlns='urn:xmpp:reply:0' " +
+			"to='irchuu@conference.example.org/alice2' id='1'/></message>",
+		"<presence from='irchuu@conference.example.org/bob' type='unavailable'>" +
+			user + "<status>bye</status></presence>",
+	})
+	defer s.listener.Close()
+
+	bridges := []*config.Bridge{
+		&config.Bridge{Name: "irchuu", XMPPRoom: "irchuu@conference.example.org"},
+	}
+	r := relay.NewRouter(bridges)
+	rec := &recorder{messages: make(chan relay.Message, 10)}
+	r.Add(rec)
+	tr := NewTransport(&config.XMPP{JID: "irchuu@example.org", Password: "pass",
+		Server: s.listener.Addr().String(), AllowPlain: true, Nick: "IRChuu",
+		Prefix: "<", Postfix: ">", RelayJoinsParts: true, ActiveWindow: 1})
+	r.Add(tr)
+	go r.Start()
+	defer r.Stop()
+
+	auth, _ := base64.StdEncoding.DecodeString(<-s.auth)
+	assert.Equal("\x00irchuu\x00pass", string(auth))
+
+	expected := []struct{ nick, text, special string }{
+		{"alice", "konnichiha!", ""},
+		// bob has not spoken yet, so his join is not relayed
+		{"alice", "alice2", "NICK"},
+		{"alice2", "waves", "ACTION"},
+		{"bob", "hi", ""},
+		{"bob", "bye", "PART"},
+	}
+	for _, e := range expected {
+		var m relay.Message
+		select {
+		case m = <-rec.messages:
+		case <-time.After(5 * time.Second):
+			t.Fatal("no message received")
+		}
+		assert.Equal("xmpp", m.Origin)
+		assert.Equal("irchuu", m.Bridge)
+		assert.Equal(e.nick, m.Nick)
+		assert.Equal(e.text, m.Text)
+		assert.Equal(e.special, m.Extra["special"])
+		if e.nick == "bob" && e.special == "" {
+			assert.Equal("alice2", m.Extra["reply"])
+		}
+	}
+	assert.NoError(tr.Health())
+
+	r.Relay(relay.Message{Origin: "irc", Bridge: "irchuu", Nick: "nick",
+		Text: "\x02hello\x0f & <bye>"})
+	select {
+	case m := <-s.sent:
+		assert.Equal("irchuu@conference.example.org", m.To)
+		assert.Equal("groupchat", m.Type)
+		assert.Equal("<nick> hello & <bye>", m.Body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message sent")
+	}
+}
+
+func TestTransport_NoTLS(t *testing.T) {
+	s := newFakeServer(t, nil)
+	defer s.listener.Close()
+
+	tr := NewTransport(&config.XMPP{JID: "irchuu@example.org",
+		Server: s.listener.Addr().String()})
+	done := make(chan error)
+	go func() { done <- tr.Start(relay.NewRouter(nil)) }()
+	// the transport keeps retrying and reports why it cannot connect
+	assert.Eventually(t, func() bool {
+		err := tr.Health()
+		return err != nil &&
+			err.Error() == "failed to connect: the server does not support TLS"
+	}, 5*time.Second, 10*time.Millisecond)
+	tr.Stop()
+	assert.NoError(t, <-done)
+	// the router may stop it again
+	assert.NotPanics(t, func() { tr.Stop() })
+}
+
+func TestFormatXMPPMessage(t *testing.T) {
+	assert := assert.New(t)
+	c := &config.XMPP{Prefix: "", Postfix: ":"}
+
+	assert.Equal("* nick waves", formatXMPPMessage(relay.Message{Origin: "irc",
+		Nick: "nick", Text: "waves", Extra: map[string]string{"special": "ACTION"}}, c))
+	assert.Equal("nick has joined.", formatXMPPMessage(relay.Message{Origin: "irc",
+		Nick: "nick", Extra: map[string]string{"special": "JOIN"}}, c))
+	assert.Equal("IRChuu~: nick, look https://example.org/a.jpg",
+		formatXMPPMessage(relay.Message{Origin: "telegram", FirstName: "IRChuu~",
+			Text: "look", Extra: map[string]string{"reply": "nick",
+				"media": "photo", "url": "https://example.org/a.jpg"}}, c))
+	assert.Equal("IRChuu~: trip https://a.org/1.jpg https://a.org/2.jpg",
+		formatXMPPMessage(relay.Message{Origin: "telegram", FirstName: "IRChuu~",
+			Text: "trip", Extra: map[string]string{"media": "album",
+				"album": "https://a.org/1.jpg https://a.org/2.jpg", "items": "2"}}, c))
+}
+
+func TestSplitJID(t *testing.T) {
+	assert := assert.New(t)
+	jid, nick := splitJID("IRChuu@Conference.example.org/Nick/x")
+	assert.Equal("irchuu@conference.example.org", jid)
+	assert.Equal("Nick/x", nick)
+	local, domain := splitBareJID("irchuu@example.org/res")
+	assert.Equal("irchuu", local)
+	assert.Equal("example.org", domain)
+}